@@ -0,0 +1,107 @@
+package prototype
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+// Artifact is a blob to attach to an image in a registry, e.g. a provenance
+// statement or a signature.
+type Artifact struct {
+	MediaType   types.MediaType
+	Payload     []byte
+	Annotations map[string]string
+}
+
+// ArtifactRef returns the reference that an artifact attached to the image
+// with the given manifest digest is tagged as: 'sha256-<hex>.<suffix>' in
+// repository, following cosign's convention (e.g. ".sig" or ".att").
+func ArtifactRef(repository string, subject v1.Hash, suffix string) (name.Tag, error) {
+	return name.NewTag(fmt.Sprintf("%s:%s-%s.%s", repository, subject.Algorithm, subject.Hex, suffix))
+}
+
+// AttachArtifact pushes the artifact as a single layer OCI image, tagged
+// after the image it's attached to (see ArtifactRef). Credentials are taken
+// from the Docker config, as for any registry client.
+func AttachArtifact(repository string, subject v1.Hash, suffix string, artifact Artifact) (name.Tag, error) {
+	ref, err := ArtifactRef(repository, subject, suffix)
+	if err != nil {
+		return name.Tag{}, errors.Wrap(err, "artifact ref")
+	}
+
+	image, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       newBlobLayer(artifact.Payload, artifact.MediaType),
+		MediaType:   artifact.MediaType,
+		Annotations: artifact.Annotations,
+	})
+	if err != nil {
+		return name.Tag{}, errors.Wrap(err, "create artifact")
+	}
+
+	image = mutate.MediaType(image, types.OCIManifestSchema1)
+
+	err = remote.Write(ref, image, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return name.Tag{}, errors.Wrapf(err, "push %s", ref)
+	}
+
+	return ref, nil
+}
+
+// blobLayer is a layer which is an arbitrary blob rather than a tarball, so
+// it is neither compressed nor has a distinct diff ID.
+type blobLayer struct {
+	content   []byte
+	digest    v1.Hash
+	mediaType types.MediaType
+}
+
+func newBlobLayer(content []byte, mediaType types.MediaType) v1.Layer {
+	sum := sha256.Sum256(content)
+
+	return blobLayer{
+		content: content,
+		digest: v1.Hash{
+			Algorithm: "sha256",
+			Hex:       hex.EncodeToString(sum[:]),
+		},
+		mediaType: mediaType,
+	}
+}
+
+func (layer blobLayer) Digest() (v1.Hash, error) {
+	return layer.digest, nil
+}
+
+func (layer blobLayer) DiffID() (v1.Hash, error) {
+	return layer.digest, nil
+}
+
+func (layer blobLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(layer.content)), nil
+}
+
+func (layer blobLayer) Uncompressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(layer.content)), nil
+}
+
+func (layer blobLayer) Size() (int64, error) {
+	return int64(len(layer.content)), nil
+}
+
+func (layer blobLayer) MediaType() (types.MediaType, error) {
+	return layer.mediaType, nil
+}
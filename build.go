@@ -1,6 +1,7 @@
 package prototype
 
 import (
+	"crypto"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	prototype "github.com/aoldershaw/prototype-sdk-go"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -21,7 +23,11 @@ import (
 func BuildConfig(img OCIImage) prototype.Config {
 	var config prototype.Config
 
-	config.Inputs = append(config.Inputs, prototype.Input{Name: img.ContextDir})
+	contextInput := contextInputName(img)
+	if contextInput != "" {
+		config.Inputs = append(config.Inputs, prototype.Input{Name: contextInput})
+	}
+
 	for name, path := range img.ContextInputs {
 		config.Inputs = append(config.Inputs, prototype.Input{
 			Name: name,
@@ -29,6 +35,14 @@ func BuildConfig(img OCIImage) prototype.Config {
 		})
 	}
 
+	for _, input := range namedContextInputs(img.BuildContexts) {
+		if input.Name == contextInput {
+			continue
+		}
+
+		config.Inputs = append(config.Inputs, input)
+	}
+
 	config.Outputs = []prototype.Output{{Name: img.Output, Path: "image"}}
 
 	if img.Cache {
@@ -38,7 +52,7 @@ func BuildConfig(img OCIImage) prototype.Config {
 	return config
 }
 
-func RunBuild(img OCIImage) ([]prototype.MessageResponse, error) {
+func RunBuild(img OCIImage) (_ []prototype.MessageResponse, err error) {
 	wd, err := os.Getwd()
 	if err != nil {
 		return nil, fmt.Errorf("get root path: %w", err)
@@ -56,226 +70,596 @@ func RunBuild(img OCIImage) ([]prototype.MessageResponse, error) {
 		}
 	}
 
-	var opts BuildkitdOpts
+	opts := img.buildkitdOpts()
+
 	if _, err := os.Stat("/scratch"); err == nil {
 		opts.RootDir = "/scratch/buildkitd"
 	}
 
+	err = img.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	if img.DryRun {
+		plan, err := PlanBuild(img, wd)
+		if err != nil {
+			return nil, fmt.Errorf("plan: %w", err)
+		}
+
+		return nil, plan.Write(os.Stdout, img.PlanFormat)
+	}
+
+	events, err := OpenEventLog(img.EventLog, filepath.Join(wd, finalOutput))
+	if err != nil {
+		return nil, fmt.Errorf("open event log: %w", err)
+	}
+
+	defer events.Close()
+
+	tracer := startTrace(img)
+	defer func() {
+		finishTrace(tracer, img, filepath.Join(wd, finalOutput), err)
+	}()
+
+	opts.Events = events
+	opts.Tracer = tracer
+
 	buildkitd, err := SpawnBuildkitd(img, &opts)
 	if err != nil {
 		return nil, fmt.Errorf("start buildkitd: %w", err)
 	}
 
+	defer func() {
+		cleanupErr := buildkitd.Cleanup()
+		if cleanupErr == nil {
+			return
+		}
+
+		if err != nil {
+			logrus.Warn("failed to cleanup buildkitd:", cleanupErr)
+			return
+		}
+
+		err = fmt.Errorf("cleanup buildkitd: %w", cleanupErr)
+	}()
+
 	err = Build(img, buildkitd, wd)
 	if err != nil {
 		return nil, fmt.Errorf("build: %w", err)
 	}
 
-	err = buildkitd.Cleanup()
-	if err != nil {
-		return nil, fmt.Errorf("cleanup buildkitd: %w", err)
-	}
-
 	return nil, nil
 }
 
+// buildkitdOpts are the options for spawning buildkitd for the image.
+func (img OCIImage) buildkitdOpts() BuildkitdOpts {
+	return BuildkitdOpts{
+		Worker:            img.Worker,
+		ContainerdAddress: img.ContainerdAddress,
+		Snapshotter:       img.Snapshotter,
+		Runtime:           img.Runtime,
+	}
+}
+
 func Build(img OCIImage, buildkitd *Buildkitd, outputsDir string) error {
 	if img.Debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	err := sanitize(&img)
+	sanitize(&img)
+
+	plan, err := PlanBuild(img, outputsDir)
 	if err != nil {
-		return errors.Wrap(err, "config")
+		return err
 	}
 
-	cacheDir := filepath.Join(outputsDir, "cache")
-
-	dockerfileDir := filepath.Dir(img.DockerfilePath)
-	dockerfileName := filepath.Base(img.DockerfilePath)
+	for _, warning := range plan.Warnings {
+		logrus.Warn(warning)
+	}
 
-	buildctlArgs := []string{
-		"build",
-		"--progress", "plain",
-		"--frontend", "dockerfile.v0",
-		"--local", "context=" + img.ContextDir,
-		"--local", "dockerfile=" + dockerfileDir,
-		"--opt", "filename=" + dockerfileName,
+	err = checkBaseImagePolicy(img, plan)
+	if err != nil {
+		return err
 	}
 
-	for _, arg := range img.Labels {
-		buildctlArgs = append(buildctlArgs,
-			"--opt", "label:"+arg,
+	var servedArgs []string
+
+	if isStreamedContext(img) {
+		contextURL, server, err := serveContext(img)
+		if err != nil {
+			return errors.Wrap(err, "serve context")
+		}
+
+		defer server.Close()
+
+		servedArgs = append(servedArgs,
+			"--opt", "context="+contextURL,
 		)
 	}
 
-	for _, arg := range img.BuildArgs {
-		buildctlArgs = append(buildctlArgs,
-			"--opt", "build-arg:"+arg,
-		)
+	if len(plan.ImageArgs) > 0 && plan.ImageArgsPublicKey != "" {
+		err := VerifyImageArgs(plan.ImageArgs, plan.ImageArgsPublicKey)
+		if err != nil {
+			return err
+		}
 	}
 
-	if len(img.ImageArgs) > 0 {
-		imagePaths := map[string]string{}
-		for _, arg := range img.ImageArgs {
-			segs := strings.SplitN(arg, "=", 2)
-			imagePaths[segs[0]] = segs[1]
+	// image args and image tarball build contexts share a local registry
+	contextImages := namedContextImages(plan.BuildContexts)
+
+	var registryPort string
+	if len(plan.ImageArgs) > 0 || len(contextImages) > 0 {
+		imageArgs, err := LoadRegistry(plan.ImageArgs)
+		if err != nil {
+			return fmt.Errorf("create local image registry: %w", err)
 		}
 
-		registry, err := LoadRegistry(imagePaths)
+		registry, err := LoadRegistry(contextImages)
 		if err != nil {
 			return fmt.Errorf("create local image registry: %w", err)
 		}
 
-		port, err := ServeRegistry(registry)
+		for name, image := range imageArgs {
+			registry[name] = image
+		}
+
+		port, server, err := ServeRegistry(registry)
 		if err != nil {
 			return fmt.Errorf("serve local image registry: %w", err)
 		}
 
-		for _, arg := range registry.BuildArgs(port) {
-			buildctlArgs = append(buildctlArgs,
+		defer server.Close()
+
+		for _, arg := range imageArgs.BuildArgs(port) {
+			servedArgs = append(servedArgs,
 				"--opt", "build-arg:"+arg,
 			)
 		}
-	}
 
-	if _, err := os.Stat(cacheDir); err == nil {
-		buildctlArgs = append(buildctlArgs,
-			"--export-cache", "type=local,mode=min,dest="+cacheDir,
-		)
+		registryPort = port
 	}
 
-	for id, src := range img.BuildkitSecrets {
-		buildctlArgs = append(buildctlArgs,
-			"--secret", "id="+id+",src="+src,
-		)
-	}
-
-	var builds [][]string
-	var targets []string
-	var imagePaths []string
+	if len(plan.BuildContexts) > 0 {
+		contextArgs, err := namedContextArgs(plan.BuildContexts, registryPort)
+		if err != nil {
+			return errors.Wrap(err, "build contexts")
+		}
 
-	for _, t := range img.AdditionalTargets {
-		// prevent re-use of the buildctlArgs slice as it is appended to later on,
-		// and that would clobber args for all targets if the slice was re-used
-		targetArgs := make([]string, len(buildctlArgs))
-		copy(targetArgs, buildctlArgs)
+		servedArgs = append(servedArgs, contextArgs...)
+	}
 
-		targetArgs = append(targetArgs, "--opt", "target="+t)
+	secrets, err := resolveSecrets(img.BuildkitSecretEnvs, img.BuildkitSecretValues)
+	if err != nil {
+		return errors.Wrap(err, "resolve secrets")
+	}
 
-		targetDir := filepath.Join(outputsDir, t)
+	defer secrets.Close()
 
-		if _, err := os.Stat(targetDir); err == nil {
-			imagePath := filepath.Join(targetDir, "image.tar")
-			imagePaths = append(imagePaths, imagePath)
+	servedArgs = append(servedArgs, secrets.args...)
 
-			targetArgs = append(targetArgs,
-				"--output", "type=docker,dest="+imagePath,
-			)
+	if len(plan.SSH) > 0 {
+		agents, err := startSSHAgents(plan.SSH)
+		if err != nil {
+			return errors.Wrap(err, "start ssh agents")
 		}
 
-		builds = append(builds, targetArgs)
-		targets = append(targets, t)
-	}
-
-	finalTargetDir := filepath.Join(outputsDir, "image")
-	if _, err := os.Stat(finalTargetDir); err == nil {
-		imagePath := filepath.Join(finalTargetDir, "image.tar")
-		imagePaths = append(imagePaths, imagePath)
+		defer agents.Close()
 
-		buildctlArgs = append(buildctlArgs,
-			"--output", "type=docker,dest="+imagePath,
-		)
+		servedArgs = append(servedArgs, agents.BuildctlArgs()...)
 	}
 
-	if img.Target != "" {
-		buildctlArgs = append(buildctlArgs,
-			"--opt", "target="+img.Target,
-		)
+	signingKey, err := readSigningKey(img)
+	if err != nil {
+		return errors.Wrap(err, "read signing key")
 	}
 
-	if img.AddHosts != "" {
-		buildctlArgs = append(buildctlArgs,
-			"--opt", "add-hosts="+img.AddHosts,
-		)
+	var materials []ProvenanceMaterial
+	if plan.Provenance {
+		materials, err = ProvenanceMaterials(img)
+		if err != nil {
+			return errors.Wrap(err, "provenance materials")
+		}
 	}
 
-	builds = append(builds, buildctlArgs)
-	targets = append(targets, "")
+	built := map[string]builtTarget{}
+
+	events := buildkitd.events
+	tracer := buildkitd.tracer
 
-	for i, args := range builds {
+	for i, target := range plan.Targets {
 		if i > 0 {
 			fmt.Fprintln(os.Stderr)
 		}
 
-		targetName := targets[i]
-		if targetName == "" {
+		if target.Output == finalOutput {
 			logrus.Info("building image")
 		} else {
-			logrus.Infof("building target '%s'", targetName)
+			logrus.Infof("building target '%s'", target.Target)
 		}
 
-		if _, err := os.Stat(filepath.Join(cacheDir, "index.json")); err == nil {
-			args = append(args,
-				"--import-cache", "type=local,src="+cacheDir,
-			)
+		args := append(plan.buildctlArgs(target), servedArgs...)
+
+		traceFile, err := ioutil.TempFile("", "buildctl-trace")
+		if err != nil {
+			return errors.Wrap(err, "create trace file")
 		}
 
+		traceFile.Close()
+
+		args = append(args, "--trace", traceFile.Name())
+
 		logrus.Debugf("running buildctl %s", strings.Join(args, " "))
 
-		err = buildctl(buildkitd.Addr, os.Stdout, args...)
+		started := time.Now()
+
+		events.Emit(Event{
+			Type:   EventTargetStarted,
+			Time:   started,
+			Target: target.Output,
+		})
+
+		span := tracer.Start("build "+target.Output, nil)
+		span.SetAttribute("output", target.Output)
+		span.SetAttribute("target", target.Target)
+
+		output := NewSecretMasker(os.Stdout, secrets.values)
+
+		err = buildctl(buildkitd.Addr, nil, output, args...)
+
+		closeErr := output.Close()
+		if err == nil {
+			err = closeErr
+		}
+
+		finished := time.Now()
+
+		stats, statsErr := readBuildStats(target.Output, traceFile.Name())
+		stats.Target = target.Output
+		stats.Duration = time.Since(started).Seconds()
+
+		emitBuildEvents(events, stats, err)
+
+		traceErr := recordSolveSpans(tracer, span, traceFile.Name())
+		if traceErr != nil {
+			logrus.Warn("failed to trace build steps:", traceErr)
+		}
+
+		var baseImages []ProvenanceMaterial
+		var baseImagesErr error
+		if plan.Provenance && err == nil {
+			baseImages, baseImagesErr = readBaseImages(traceFile.Name())
+		}
+
+		// the trace has been read, so remove it rather than leaving one
+		// per target until the build finishes
+		os.Remove(traceFile.Name())
+
+		span.SetAttribute("cached_steps", stats.CachedSteps)
+		span.SetAttribute("executed_steps", stats.ExecutedSteps)
+		span.SetError(err)
+		span.End()
+
 		if err != nil {
-			return errors.Wrap(err, "build")
+			return buildkitd.withLogTail(errors.Wrap(err, "build"))
+		}
+
+		if plan.Provenance {
+			if baseImagesErr != nil {
+				return errors.Wrap(baseImagesErr, "read base images")
+			}
+
+			built[target.Output] = builtTarget{
+				started:   started,
+				finished:  finished,
+				materials: append(append([]ProvenanceMaterial{}, materials...), baseImages...),
+			}
+		}
+
+		// the stats are only reported, so a trace which can't be parsed
+		// shouldn't fail a build which succeeded
+		if statsErr != nil {
+			logrus.Warn("failed to read build stats:", statsErr)
+			continue
+		}
+
+		fmt.Fprintln(os.Stderr)
+		printBuildStats(os.Stderr, stats)
+
+		if target.ImagePath != "" {
+			err = writeBuildStats(filepath.Join(filepath.Dir(target.ImagePath), "build-stats.json"), stats)
+			if err != nil {
+				return errors.Wrap(err, "write build stats")
+			}
 		}
 	}
 
-	for _, imagePath := range imagePaths {
-		image, err := tarball.ImageFromPath(imagePath, nil)
+	if plan.PruneCacheDir != "" {
+		span := tracer.Start("prune cache", nil)
+
+		reclaimed, err := PruneCache(plan.PruneCacheDir, plan.CacheMaxSize*1024*1024)
+		span.SetAttribute("reclaimed_bytes", reclaimed)
+		span.SetError(err)
+		span.End()
+
 		if err != nil {
-			return errors.Wrap(err, "open oci image")
+			return errors.Wrap(err, "prune cache")
 		}
 
-		outputDir := filepath.Dir(imagePath)
+		logrus.Infof("pruned local cache, reclaiming %s", formatBytes(reclaimed))
+	}
+
+	for _, target := range plan.Targets {
+		if target.ImagePath == "" {
+			continue
+		}
 
-		err = writeDigest(outputDir, image)
+		err := finishTarget(img, plan, target, built[target.Output], signingKey, events, tracer)
 		if err != nil {
 			return err
 		}
+	}
 
-		if img.UnpackRootfs {
-			err = unpackRootfs(outputDir, image, img)
-			if err != nil {
-				return errors.Wrap(err, "unpack rootfs")
-			}
+	return nil
+}
+
+// finishTarget writes the digest of a target's image, after normalizing its
+// timestamps for a reproducible build, then checks it against the policy,
+// writes its SBOM, provenance and signature, and unpacks it if configured to.
+func finishTarget(img OCIImage, plan BuildPlan, target TargetPlan, built builtTarget, signingKey crypto.Signer, events *EventLog, tracer *Tracer) error {
+	outputDir := filepath.Dir(target.ImagePath)
+
+	if plan.SourceDateEpoch != nil {
+		span := tracer.Start("normalize timestamps", nil)
+		span.SetAttribute("output", target.Output)
+
+		err := normalizeTimestamps(target.ImagePath, time.Unix(*plan.SourceDateEpoch, 0).UTC())
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			return errors.Wrap(err, "normalize timestamps")
+		}
+	}
+
+	span := tracer.Start("write digest", nil)
+	span.SetAttribute("output", target.Output)
+
+	started := time.Now()
+
+	image, err := tarball.ImageFromPath(target.ImagePath, nil)
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return errors.Wrap(err, "open oci image")
+	}
+
+	digest, err := writeDigest(outputDir, image)
+	span.SetAttribute("digest", digest)
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		return err
+	}
+
+	events.Emit(Event{
+		Type:     EventDigestWritten,
+		Target:   target.Output,
+		Duration: time.Since(started).Seconds(),
+		Digest:   digest,
+		Path:     filepath.Join(outputDir, "digest"),
+	})
+
+	if img.Policy != nil {
+		span := tracer.Start("check policy", nil)
+		span.SetAttribute("output", target.Output)
+
+		err := checkImagePolicy(img.Policy, target.Output, image)
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if img.SBOM {
+		span := tracer.Start("generate sbom", nil)
+		span.SetAttribute("output", target.Output)
+
+		err := generateSBOM(filepath.Join(outputDir, SBOMFile), image, target.Output)
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			return errors.Wrap(err, "generate sbom")
+		}
+	}
+
+	if plan.Provenance {
+		span := tracer.Start("write provenance", nil)
+		span.SetAttribute("output", target.Output)
+
+		statement, err := newProvenance(img, target, image, built)
+		if err == nil {
+			err = writeProvenance(outputDir, image, statement, plan.ProvenanceRepository)
+		}
+
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			return errors.Wrap(err, "write provenance")
+		}
+	}
+
+	if signingKey != nil {
+		span := tracer.Start("sign image", nil)
+		span.SetAttribute("output", target.Output)
+
+		err := signImage(outputDir, image, signingKey, target.Output, plan.SignatureRepository)
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			return errors.Wrap(err, "sign image")
+		}
+	}
+
+	if !img.UnpackRootfs {
+		return nil
+	}
+
+	span = tracer.Start("unpack rootfs", nil)
+	span.SetAttribute("output", target.Output)
+
+	err = unpackRootfs(outputDir, image, img, func(layer v1.Layer, started time.Time) error {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+
+		size, err := layer.Size()
+		if err != nil {
+			return err
 		}
+
+		layerSpan := tracer.Record("unpack layer", span, started, time.Now())
+		layerSpan.SetAttribute("digest", digest.String())
+		layerSpan.SetAttribute("size", size)
+		layerSpan.End()
+
+		events.Emit(Event{
+			Type:     EventUnpackLayer,
+			Target:   target.Output,
+			Duration: time.Since(started).Seconds(),
+			Layer:    digest.String(),
+			Size:     size,
+		})
+
+		return nil
+	})
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		return errors.Wrap(err, "unpack rootfs")
 	}
 
 	return nil
 }
 
-func writeDigest(dest string, image v1.Image) error {
+// localCacheDirs finds every cache that has been exported within cacheDir,
+// including a cache exported to cacheDir itself by older versions.
+func localCacheDirs(cacheDir string) ([]string, error) {
+	var dirs []string
+
+	if _, err := os.Stat(filepath.Join(cacheDir, "index.json")); err == nil {
+		dirs = append(dirs, cacheDir)
+	}
+
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dirs, nil
+		}
+
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		dir := filepath.Join(cacheDir, entry.Name())
+
+		if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs, nil
+}
+
+// writeDigest writes the image's digest to the 'digest' file in dest, and
+// returns it.
+func writeDigest(dest string, image v1.Image) (string, error) {
 	digestPath := filepath.Join(dest, "digest")
 
 	manifest, err := image.Manifest()
 	if err != nil {
-		return errors.Wrap(err, "get image digest")
+		return "", errors.Wrap(err, "get image digest")
 	}
 
-	err = ioutil.WriteFile(digestPath, []byte(manifest.Config.Digest.String()), 0644)
+	digest := manifest.Config.Digest.String()
+
+	err = ioutil.WriteFile(digestPath, []byte(digest), 0644)
 	if err != nil {
-		return errors.Wrap(err, "write digest file")
+		return "", errors.Wrap(err, "write digest file")
 	}
 
-	return nil
+	return digest, nil
 }
 
-func unpackRootfs(dest string, image v1.Image, img OCIImage) error {
+// emitBuildEvents reports each step of a target's build, and then the
+// target finishing, failed if buildErr is non-nil.
+func emitBuildEvents(events *EventLog, stats BuildStats, buildErr error) {
+	for _, step := range stats.Steps {
+		event := Event{
+			Type:     EventStepCompleted,
+			Target:   stats.Target,
+			Duration: step.Duration,
+			Step:     step.Name,
+			Cached:   step.Cached,
+			Error:    step.Error,
+		}
+
+		if step.Completed != nil {
+			event.Time = *step.Completed
+		}
+
+		events.Emit(event)
+	}
+
+	finished := Event{
+		Type:          EventTargetFinished,
+		Target:        stats.Target,
+		Duration:      stats.Duration,
+		CachedSteps:   stats.CachedSteps,
+		ExecutedSteps: stats.ExecutedSteps,
+	}
+
+	if buildErr != nil {
+		finished.Error = buildErr.Error()
+	}
+
+	events.Emit(finished)
+}
+
+func generateSBOM(path string, image v1.Image, name string) error {
+	doc, err := GenerateSBOM(image, name)
+	if err != nil {
+		return err
+	}
+
+	if doc.Comment != "" {
+		for _, warning := range strings.Split(doc.Comment, "\n") {
+			logrus.Warn(warning)
+		}
+	}
+
+	logrus.Infof("found %d packages in %s", len(doc.Packages)-1, name)
+
+	return writeSBOM(path, doc)
+}
+
+// unpackRootfs unpacks the image to rootfs/ in dest and writes its
+// metadata.json, calling layerUnpacked after each layer is unpacked.
+func unpackRootfs(dest string, image v1.Image, img OCIImage, layerUnpacked func(v1.Layer, time.Time) error) error {
 	rootfsDir := filepath.Join(dest, "rootfs")
 	metadataPath := filepath.Join(dest, "metadata.json")
 
 	logrus.Info("unpacking image")
 
-	err := unpackImage(rootfsDir, image, img.Debug)
+	err := unpackImage(rootfsDir, image, img.Debug, layerUnpacked)
 	if err != nil {
 		return errors.Wrap(err, "unpack image")
 	}
@@ -315,24 +699,28 @@ func writeImageMetadata(metadataPath string, image v1.Image) error {
 	return nil
 }
 
-func sanitize(img *OCIImage) error {
+func sanitize(img *OCIImage) {
 	if img.ContextDir == "" {
 		img.ContextDir = "."
 	}
 
-	if img.DockerfilePath == "" {
+	if img.DockerfilePath == "" && !isStreamedContext(*img) {
 		img.DockerfilePath = filepath.Join(img.ContextDir, "Dockerfile")
 	}
 
-	return nil
+	if img.CacheMode == "" {
+		img.CacheMode = "min"
+	}
 }
 
-func buildctl(addr string, out io.Writer, args ...string) error {
-	return run(out, "buildctl", append([]string{"--addr=" + addr}, args...)...)
+func buildctl(addr string, env []string, out io.Writer, args ...string) error {
+	return run(out, env, "buildctl", append([]string{"--addr=" + addr}, args...)...)
 }
 
-func run(out io.Writer, path string, args ...string) error {
+// run runs the command with env added to the current environment.
+func run(out io.Writer, env []string, path string, args ...string) error {
 	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), env...)
 	cmd.Stdout = out
 	cmd.Stderr = out
 	cmd.Stdin = os.Stdin
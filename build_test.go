@@ -1,14 +1,24 @@
 package prototype_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	prototype "github.com/aoldershaw/oci-image-prototype"
@@ -95,6 +105,341 @@ func (s *TaskSuite) TestDigestFile() {
 	s.Equal(string(digest), manifest.Config.Digest.String())
 }
 
+func (s *TaskSuite) TestBuildStats() {
+	s.ociImage.ContextDir = "testdata/basic"
+
+	err := s.build()
+	s.NoError(err)
+
+	payload, err := ioutil.ReadFile(s.imagePath("build-stats.json"))
+	s.NoError(err)
+
+	var stats prototype.BuildStats
+	err = json.Unmarshal(payload, &stats)
+	s.NoError(err)
+
+	s.Equal(1, stats.CachedSteps+stats.ExecutedSteps)
+	s.Equal("[1/1] COPY Dockerfile /", stats.Steps[0].Name)
+	s.NotZero(stats.Duration)
+}
+
+func (s *TaskSuite) TestEventLog() {
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.UnpackRootfs = true
+
+	buf := new(bytes.Buffer)
+
+	buildkitd, err := prototype.ConnectBuildkitd(s.buildkitd.Addr, prototype.NewEventLog(buf))
+	s.NoError(err)
+
+	err = prototype.Build(s.ociImage, buildkitd, s.outputsDir)
+	s.NoError(err)
+
+	var events []prototype.Event
+
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var event prototype.Event
+		err := decoder.Decode(&event)
+		s.NoError(err)
+
+		s.Equal("image", event.Target)
+		s.False(event.Time.IsZero())
+
+		events = append(events, event)
+	}
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+
+	s.Equal([]string{
+		prototype.EventTargetStarted,
+		prototype.EventStepCompleted,
+		prototype.EventTargetFinished,
+		prototype.EventDigestWritten,
+		prototype.EventUnpackLayer,
+	}, types)
+
+	s.Equal("[1/1] COPY Dockerfile /", events[1].Step)
+	s.Equal(1, events[2].CachedSteps+events[2].ExecutedSteps)
+	s.NotZero(events[2].Duration)
+
+	digest, err := ioutil.ReadFile(s.imagePath("digest"))
+	s.NoError(err)
+	s.Equal(string(digest), events[3].Digest)
+	s.Equal(s.imagePath("digest"), events[3].Path)
+}
+
+func (s *TaskSuite) TestTrace() {
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.UnpackRootfs = true
+	s.ociImage.Trace = true
+
+	err := prototype.RunLocalBuild(s.ociImage, prototype.LocalOpts{
+		OutputDir:     s.outputsDir,
+		BuildkitdAddr: s.buildkitd.Addr,
+	})
+	s.NoError(err)
+
+	payload, err := ioutil.ReadFile(s.imagePath(prototype.TraceFile))
+	s.NoError(err)
+
+	var trace exportedTrace
+	s.NoError(json.Unmarshal(payload, &trace))
+
+	parents := map[string]string{}
+	for _, span := range trace.ResourceSpans[0].ScopeSpans[0].Spans {
+		parents[span.SpanID] = span.Name
+	}
+
+	var names []string
+	for _, span := range trace.ResourceSpans[0].ScopeSpans[0].Spans {
+		names = append(names, parents[span.ParentSpanID]+" > "+span.Name)
+	}
+
+	s.Contains(names, " > oci-image build")
+	s.Contains(names, "oci-image build > build image")
+	s.Contains(names, "build image > [1/1] COPY Dockerfile /")
+	s.Contains(names, "build image > exporting to oci image format")
+	s.Contains(names, "oci-image build > write digest")
+	s.Contains(names, "oci-image build > unpack rootfs")
+	s.Contains(names, "unpack rootfs > unpack layer")
+}
+
+func (s *TaskSuite) TestSBOM() {
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.SBOM = true
+
+	err := s.build()
+	s.NoError(err)
+
+	payload, err := ioutil.ReadFile(s.imagePath(prototype.SBOMFile))
+	s.NoError(err)
+
+	var doc prototype.SPDXDocument
+	err = json.Unmarshal(payload, &doc)
+	s.NoError(err)
+
+	digest, err := ioutil.ReadFile(s.imagePath("digest"))
+	s.NoError(err)
+
+	s.Equal("image", doc.Name)
+	s.Len(doc.Packages, 1)
+	s.Equal(string(digest), doc.Packages[0].VersionInfo)
+}
+
+func (s *TaskSuite) TestProvenance() {
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.Provenance = true
+	s.ociImage.BuildkitSecretValues = map[string]string{"some_secret": "hunter2"}
+
+	err := s.build()
+	s.NoError(err)
+
+	payload, err := ioutil.ReadFile(s.imagePath(prototype.ProvenanceFile))
+	s.NoError(err)
+	s.NotContains(string(payload), "hunter2")
+
+	var statement prototype.ProvenanceStatement
+	err = json.Unmarshal(payload, &statement)
+	s.NoError(err)
+
+	digest, err := ioutil.ReadFile(s.imagePath("digest"))
+	s.NoError(err)
+
+	s.Equal("https://slsa.dev/provenance/v0.2", statement.PredicateType)
+	s.Len(statement.Subject, 1)
+	s.Equal("image", statement.Subject[0].Name)
+	s.Equal("sha256:"+statement.Subject[0].Digest["sha256"], string(digest))
+
+	predicate := statement.Predicate
+	s.Equal(map[string]string{"some_secret": "***"}, predicate.Invocation.Parameters.BuildkitSecretValues)
+	s.False(predicate.Metadata.BuildStartedOn.IsZero())
+	s.True(predicate.Metadata.BuildFinishedOn.After(predicate.Metadata.BuildStartedOn))
+
+	// the image is built from scratch, so there are no base images
+	s.Len(predicate.Materials, 2)
+	s.Equal("file:testdata/basic", predicate.Materials[0].URI)
+	s.Equal("file:testdata/basic/Dockerfile", predicate.Materials[1].URI)
+}
+
+func (s *TaskSuite) TestSign() {
+	signatureRegistry := httptest.NewServer(registry.New())
+	defer signatureRegistry.Close()
+
+	registryURL, err := url.Parse(signatureRegistry.URL)
+	s.NoError(err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.NoError(err)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	s.NoError(err)
+
+	keyPath := filepath.Join(s.outputsDir, "cosign.key")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: keyBytes,
+	}), 0600)
+	s.NoError(err)
+
+	repository := registryURL.Host + "/some-image"
+
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.SigningKey = keyPath
+	s.ociImage.SignatureRepository = repository
+
+	err = s.build()
+	s.NoError(err)
+
+	image, err := tarball.ImageFromPath(s.imagePath("image.tar"), nil)
+	s.NoError(err)
+
+	signature, err := ioutil.ReadFile(s.imagePath(prototype.SignatureFile))
+	s.NoError(err)
+
+	payload, err := ioutil.ReadFile(s.imagePath(prototype.SignaturePayloadFile))
+	s.NoError(err)
+
+	err = prototype.VerifyImage(&key.PublicKey, image, payload, string(signature))
+	s.NoError(err)
+
+	digest, err := image.Digest()
+	s.NoError(err)
+
+	sigRef, err := name.NewTag(repository + ":sha256-" + digest.Hex + ".sig")
+	s.NoError(err)
+
+	sigImage, err := remote.Image(sigRef)
+	s.NoError(err)
+
+	manifest, err := sigImage.Manifest()
+	s.NoError(err)
+
+	s.Len(manifest.Layers, 1)
+	s.Equal("application/vnd.dev.cosign.simplesigning.v1+json", string(manifest.Layers[0].MediaType))
+	s.Equal(string(signature), manifest.Layers[0].Annotations["dev.cosignproject.cosign/signature"])
+}
+
+func (s *TaskSuite) TestImageArgsUnsigned() {
+	imagesDir, err := ioutil.TempDir("", "preload-images")
+	s.NoError(err)
+
+	defer os.RemoveAll(imagesDir)
+
+	image, err := random.Image(1024, 2)
+	s.NoError(err)
+	imagePath := filepath.Join(imagesDir, "image.tar")
+	err = tarball.WriteToFile(imagePath, nil, image)
+	s.NoError(err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.NoError(err)
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	s.NoError(err)
+
+	publicKeyPath := filepath.Join(imagesDir, "cosign.pub")
+	err = ioutil.WriteFile(publicKeyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	}), 0644)
+	s.NoError(err)
+
+	s.ociImage.ContextDir = "testdata/image-args"
+	s.ociImage.ImageArgs = []string{"second_image=" + imagePath}
+	s.ociImage.ImageArgsPublicKey = publicKeyPath
+
+	err = s.build()
+	s.Error(err)
+	s.Contains(err.Error(), "verify image arg second_image")
+}
+
+func (s *TaskSuite) TestPolicyBaseImages() {
+	s.ociImage.ContextDir = "testdata/build-args"
+	s.ociImage.Policy = &prototype.Policy{
+		AllowedRegistries: []string{"registry.example.com"},
+	}
+
+	err := s.build()
+	s.EqualError(err, "base images violate policy:\n"+
+		"  - allowed_registries: line 1: busybox is not from an allowed registry and is not pinned by digest")
+
+	s.ociImage.Policy.AllowedRegistries = []string{"docker.io"}
+
+	err = s.build()
+	s.NoError(err)
+}
+
+func (s *TaskSuite) TestPolicyImage() {
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.Policy = &prototype.Policy{
+		NonRootUser:    true,
+		RequiredLabels: []string{"some_label"},
+	}
+
+	err := s.build()
+	s.EqualError(err, "image 'image' violates policy:\n"+
+		"  - non_root_user: runs as root (by default)\n"+
+		"  - required_labels: missing label some_label")
+
+	s.ociImage.Policy.NonRootUser = false
+	s.ociImage.Labels = []string{"some_label=some_value"}
+
+	err = s.build()
+	s.NoError(err)
+}
+
+func (s *TaskSuite) TestReproducible() {
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.Reproducible = true
+
+	err := s.build()
+	s.NoError(err)
+
+	firstDigest, err := ioutil.ReadFile(s.imagePath("digest"))
+	s.NoError(err)
+
+	// make sure the second build doesn't just re-use the first
+	err = exec.Command("buildctl", "--addr="+s.buildkitd.Addr, "prune", "--all").Run()
+	s.NoError(err)
+
+	err = os.RemoveAll(s.imagePath())
+	s.NoError(err)
+	err = os.Mkdir(s.imagePath(), 0755)
+	s.NoError(err)
+
+	err = s.build()
+	s.NoError(err)
+
+	secondDigest, err := ioutil.ReadFile(s.imagePath("digest"))
+	s.NoError(err)
+
+	s.Equal(string(firstDigest), string(secondDigest))
+}
+
+func (s *TaskSuite) TestReproducibleSourceDateEpoch() {
+	epoch := int64(1600000000)
+
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.Reproducible = true
+	s.ociImage.SourceDateEpoch = &epoch
+
+	err := s.build()
+	s.NoError(err)
+
+	image, err := tarball.ImageFromPath(s.imagePath("image.tar"), nil)
+	s.NoError(err)
+
+	configFile, err := image.ConfigFile()
+	s.NoError(err)
+
+	s.Equal(epoch, configFile.Created.Unix())
+	for _, history := range configFile.History {
+		s.Equal(epoch, history.Created.Unix())
+	}
+}
+
 func (s *TaskSuite) TestDockerfilePath() {
 	s.ociImage.ContextDir = "testdata/dockerfile-path"
 	s.ociImage.DockerfilePath = "testdata/dockerfile-path/hello.Dockerfile"
@@ -103,6 +448,79 @@ func (s *TaskSuite) TestDockerfilePath() {
 	s.NoError(err)
 }
 
+func (s *TaskSuite) TestBuildErrorIncludesBuildkitdLog() {
+	// the Dockerfile in the context always fails
+	s.ociImage.ContextDir = "testdata/dockerfile-path"
+
+	err := s.build()
+	s.Error(err)
+	s.Contains(err.Error(), "lines of buildkitd log:")
+	s.Contains(err.Error(), "/moby.buildkit.v1.Control/Solve returned error")
+}
+
+func (s *TaskSuite) TestContextTarball() {
+	contextPath := filepath.Join(s.outputsDir, "context.tar.gz")
+	s.writeContextTarball(contextPath, "testdata/context-source")
+
+	s.ociImage.ContextDir = contextPath
+	s.ociImage.UnpackRootfs = true
+
+	err := s.build()
+	s.NoError(err)
+
+	content, err := ioutil.ReadFile(s.outputPath("image", "rootfs", "some-file"))
+	s.NoError(err)
+	s.Equal("committed\n", string(content))
+}
+
+func (s *TaskSuite) TestContextGitRef() {
+	repoDir, err := ioutil.TempDir("", "git-context")
+	s.NoError(err)
+
+	defer os.RemoveAll(repoDir)
+
+	for _, name := range []string{"Dockerfile", "some-file"} {
+		content, err := ioutil.ReadFile(filepath.Join("testdata/context-source", name))
+		s.NoError(err)
+
+		err = ioutil.WriteFile(filepath.Join(repoDir, name), content, 0644)
+		s.NoError(err)
+	}
+
+	s.git(repoDir, "init")
+	s.git(repoDir, "add", ".")
+	s.git(repoDir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-m", "init")
+
+	err = ioutil.WriteFile(filepath.Join(repoDir, "some-file"), []byte("uncommitted\n"), 0644)
+	s.NoError(err)
+
+	err = ioutil.WriteFile(filepath.Join(repoDir, "untracked-file"), []byte("untracked\n"), 0644)
+	s.NoError(err)
+
+	s.ociImage.ContextDir = repoDir
+	s.ociImage.ContextRef = "HEAD"
+	s.ociImage.UnpackRootfs = true
+
+	err = s.build()
+	s.NoError(err)
+
+	content, err := ioutil.ReadFile(s.outputPath("image", "rootfs", "some-file"))
+	s.NoError(err)
+	s.Equal("committed\n", string(content))
+
+	s.NoFileExists(s.outputPath("image", "rootfs", "untracked-file"))
+	s.NoDirExists(s.outputPath("image", "rootfs", ".git"))
+}
+
+func (s *TaskSuite) TestContextGitRefUnknown() {
+	s.ociImage.ContextDir = "."
+	s.ociImage.ContextRef = "does-not-exist"
+
+	err := s.build()
+	s.Error(err)
+	s.Contains(err.Error(), "resolve ref does-not-exist")
+}
+
 func (s *TaskSuite) TestTarget() {
 	s.ociImage.ContextDir = "testdata/target"
 	s.ociImage.Target = "working-target"
@@ -177,6 +595,78 @@ func (s *TaskSuite) TestBuildkitSecrets() {
 	s.NoError(err)
 }
 
+func (s *TaskSuite) TestBuildkitSecretEnvs() {
+	s.ociImage.ContextDir = "testdata/buildkit-secret"
+	s.ociImage.BuildkitSecretEnvs = map[string]string{"secret": "SOME_SECRET"}
+
+	os.Setenv("SOME_SECRET", "hello-world")
+	defer os.Unsetenv("SOME_SECRET")
+
+	err := s.build()
+	s.NoError(err)
+}
+
+func (s *TaskSuite) TestBuildkitSecretEnvsUnset() {
+	s.ociImage.ContextDir = "testdata/buildkit-secret"
+	s.ociImage.BuildkitSecretEnvs = map[string]string{"secret": "SOME_UNSET_SECRET"}
+
+	err := s.build()
+	s.Error(err)
+	s.Contains(err.Error(), "environment variable SOME_UNSET_SECRET is not set")
+}
+
+func (s *TaskSuite) TestBuildkitSecretValues() {
+	s.ociImage.ContextDir = "testdata/buildkit-secret"
+	s.ociImage.BuildkitSecretValues = map[string]string{"secret": "hello-world"}
+
+	err := s.build()
+	s.NoError(err)
+}
+
+func (s *TaskSuite) TestBuildkitSecretValuesMasked() {
+	s.ociImage.ContextDir = "testdata/buildkit-secret-leak"
+	s.ociImage.BuildkitSecretValues = map[string]string{"secret": "hello-world"}
+
+	output, err := s.buildCapturingStdout()
+	s.NoError(err)
+	s.NotContains(output, "hello-world")
+	s.Contains(output, "leaked: ***")
+}
+
+func (s *TaskSuite) TestSSH() {
+	contextDir, err := ioutil.TempDir("", "ssh-context")
+	s.NoError(err)
+	defer os.RemoveAll(contextDir)
+
+	dockerfile, err := ioutil.ReadFile("testdata/ssh/Dockerfile")
+	s.NoError(err)
+	err = ioutil.WriteFile(filepath.Join(contextDir, "Dockerfile"), dockerfile, 0644)
+	s.NoError(err)
+
+	build := exec.Command("go", "build", "-o", filepath.Join(contextDir, "ssh-add"), "./testdata/ssh/ssh-add")
+	build.Env = append(os.Environ(), "CGO_ENABLED=0")
+	output, err := build.CombinedOutput()
+	s.NoError(err, string(output))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.NoError(err)
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	s.NoError(err)
+
+	keyPath := filepath.Join(s.outputsDir, "id_ecdsa")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: keyBytes,
+	}), 0600)
+	s.NoError(err)
+
+	s.ociImage.ContextDir = contextDir
+	s.ociImage.SSH = map[string][]string{"default": {keyPath}}
+
+	err = s.build()
+	s.NoError(err)
+}
+
 func (s *TaskSuite) TestRegistryMirrors() {
 	mirror := httptest.NewServer(registry.New())
 	defer mirror.Close()
@@ -232,6 +722,67 @@ func (s *TaskSuite) TestRegistryMirrors() {
 	}
 }
 
+func (s *TaskSuite) TestRegistryCache() {
+	cacheRegistry := httptest.NewServer(registry.New())
+	defer cacheRegistry.Close()
+
+	registryURL, err := url.Parse(cacheRegistry.URL)
+	s.NoError(err)
+
+	cacheRef := fmt.Sprintf("%s/cache:latest", registryURL.Host)
+
+	s.ociImage.ContextDir = "testdata/multi-target"
+	s.ociImage.CacheTo = cacheRef
+	s.ociImage.CacheMode = "max"
+
+	err = s.build()
+	s.NoError(err)
+
+	ref, err := name.ParseReference(cacheRef)
+	s.NoError(err)
+
+	_, err = remote.Index(ref)
+	s.NoError(err)
+
+	s.ociImage.CacheTo = ""
+	s.ociImage.CacheFrom = []string{
+		fmt.Sprintf("%s/missing-cache:latest", registryURL.Host),
+		cacheRef,
+	}
+
+	err = s.build()
+	s.NoError(err)
+}
+
+func (s *TaskSuite) TestInlineCache() {
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.InlineCache = true
+
+	err := s.build()
+	s.NoError(err)
+
+	image, err := tarball.ImageFromPath(s.imagePath("image.tar"), nil)
+	s.NoError(err)
+
+	rawConfig, err := image.RawConfigFile()
+	s.NoError(err)
+
+	var config map[string]interface{}
+	err = json.Unmarshal(rawConfig, &config)
+	s.NoError(err)
+
+	s.Contains(config, "moby.buildkit.cache.v0")
+}
+
+func (s *TaskSuite) TestInvalidCacheMode() {
+	s.ociImage.ContextDir = "testdata/basic"
+	s.ociImage.CacheMode = "most"
+
+	err := s.build()
+	s.Error(err)
+	s.Contains(err.Error(), "cache_mode: unknown cache mode: most")
+}
+
 func (s *TaskSuite) TestImageArgs() {
 	imagesDir, err := ioutil.TempDir("", "preload-images")
 	s.NoError(err)
@@ -292,6 +843,54 @@ func (s *TaskSuite) TestImageArgs() {
 	}
 }
 
+func (s *TaskSuite) TestBuildContexts() {
+	imagesDir, err := ioutil.TempDir("", "preload-images")
+	s.NoError(err)
+
+	defer os.RemoveAll(imagesDir)
+
+	depsImage, err := random.Image(1024, 2)
+	s.NoError(err)
+	depsPath := filepath.Join(imagesDir, "deps.tar")
+	err = tarball.WriteToFile(depsPath, nil, depsImage)
+	s.NoError(err)
+
+	s.ociImage.ContextDir = "testdata/build-contexts/context"
+	s.ociImage.BuildContexts = map[string]string{
+		"assets": "testdata/build-contexts/assets",
+		"deps":   depsPath,
+	}
+	s.ociImage.UnpackRootfs = true
+
+	err = s.build()
+	s.NoError(err)
+
+	builtImage, err := tarball.ImageFromPath(s.outputPath("image", "image.tar"), nil)
+	s.NoError(err)
+
+	layers, err := depsImage.Layers()
+	s.NoError(err)
+
+	builtLayers, err := builtImage.Layers()
+	s.NoError(err)
+	s.Len(builtLayers, len(layers)+1)
+
+	asset, err := ioutil.ReadFile(s.outputPath("image", "rootfs", "asset"))
+	s.NoError(err)
+	s.Equal("some-asset\n", string(asset))
+}
+
+func (s *TaskSuite) TestBuildContextsReservedName() {
+	s.ociImage.ContextDir = "testdata/build-contexts/context"
+	s.ociImage.BuildContexts = map[string]string{
+		"context": "testdata/build-contexts/assets",
+	}
+
+	err := s.build()
+	s.Error(err)
+	s.Contains(err.Error(), "build_contexts[context]: name is reserved")
+}
+
 func (s *TaskSuite) TestImageArgsUnpack() {
 	imagesDir, err := ioutil.TempDir("", "preload-images")
 	s.NoError(err)
@@ -408,6 +1007,34 @@ func (s *TaskSuite) TestMultiTargetDigest() {
 	s.Equal(string(digest), finalManifest.Config.Digest.String())
 }
 
+func (s *TaskSuite) TestMultiTargetCache() {
+	s.ociImage.ContextDir = "testdata/multi-target"
+	s.ociImage.AdditionalTargets = []string{"additional-target"}
+
+	err := os.Mkdir(s.outputPath("additional-target"), 0755)
+	s.NoError(err)
+
+	err = os.Mkdir(s.outputPath("cache"), 0755)
+	s.NoError(err)
+
+	err = s.build()
+	s.NoError(err)
+
+	s.FileExists(s.outputPath("cache", "additional-target", "index.json"))
+	s.FileExists(s.outputPath("cache", "image", "index.json"))
+
+	// make sure nothing is cached by buildkitd itself
+	err = exec.Command("buildctl", "--addr="+s.buildkitd.Addr, "prune", "--all").Run()
+	s.NoError(err)
+
+	output, err := s.buildCapturingStdout()
+	s.NoError(err)
+
+	cachedSteps := cachedSteps(output)
+	s.Contains(cachedSteps, "[additional-target 1/1] ADD Dockerfile /Dockerfile.banana")
+	s.Contains(cachedSteps, "[final-target 1/1] ADD Dockerfile /Dockerfile.orange")
+}
+
 func (s *TaskSuite) TestMultiTargetUnpack() {
 	s.ociImage.ContextDir = "testdata/multi-target"
 	s.ociImage.AdditionalTargets = []string{"additional-target"}
@@ -454,6 +1081,90 @@ func (s *TaskSuite) build() error {
 	return prototype.Build(s.ociImage, s.buildkitd, s.outputsDir)
 }
 
+func (s *TaskSuite) buildCapturingStdout() (string, error) {
+	r, w, err := os.Pipe()
+	s.NoError(err)
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	output := make(chan []byte)
+	go func() {
+		content, _ := ioutil.ReadAll(r)
+		output <- content
+	}()
+
+	buildErr := s.build()
+
+	err = w.Close()
+	s.NoError(err)
+
+	return string(<-output), buildErr
+}
+
+// cachedSteps finds the names of the steps reported as CACHED in plain
+// buildctl progress output.
+func cachedSteps(output string) []string {
+	var cached []string
+
+	names := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		segs := strings.SplitN(line, " ", 2)
+		if len(segs) != 2 || !strings.HasPrefix(segs[0], "#") {
+			continue
+		}
+
+		if segs[1] == "CACHED" {
+			cached = append(cached, names[segs[0]])
+		} else if strings.HasPrefix(segs[1], "[") {
+			names[segs[0]] = segs[1]
+		}
+	}
+
+	return cached
+}
+
+func (s *TaskSuite) git(dir string, args ...string) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	output, err := cmd.CombinedOutput()
+	s.NoError(err, string(output))
+}
+
+func (s *TaskSuite) writeContextTarball(dest string, dir string) {
+	file, err := os.Create(dest)
+	s.NoError(err)
+
+	defer file.Close()
+
+	zw := gzip.NewWriter(file)
+	tw := tar.NewWriter(zw)
+
+	infos, err := ioutil.ReadDir(dir)
+	s.NoError(err)
+
+	for _, info := range infos {
+		content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		s.NoError(err)
+
+		err = tw.WriteHeader(&tar.Header{
+			Name: info.Name(),
+			Mode: 0644,
+			Size: int64(len(content)),
+		})
+		s.NoError(err)
+
+		_, err = tw.Write(content)
+		s.NoError(err)
+	}
+
+	s.NoError(tw.Close())
+	s.NoError(zw.Close())
+}
+
 func (s *TaskSuite) imagePath(path ...string) string {
 	return s.outputPath(append([]string{"image"}, path...)...)
 }
@@ -1,42 +1,125 @@
 package prototype
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/aoldershaw/oci-image-prototype/cgroups"
+	"github.com/fatih/color"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// DefaultCleanupGracePeriod is how long Cleanup waits for buildkitd to exit
+// after SIGTERM before resorting to SIGKILL.
+const DefaultCleanupGracePeriod = 10 * time.Second
+
+// DefaultLogTailLines is how many lines of buildkitd's log are attached to
+// build errors.
+const DefaultLogTailLines = 50
+
 type Buildkitd struct {
 	Addr string
 
-	rootDir string
-	proc    *os.Process
+	rootDir     string
+	proc        *os.Process
+	exited      chan error
+	gracePeriod time.Duration
+
+	logPath      string
+	logOffset    int64
+	logTailLines int
+
+	stopTailing chan struct{}
+	tailingDone chan struct{}
+
+	events *EventLog
+	tracer *Tracer
 }
 
 // BuildkitdOpts to provide to Buildkitd
 type BuildkitdOpts struct {
 	RootDir    string
 	ConfigPath string
+
+	// How long to wait for buildkitd to exit on Cleanup before killing it.
+	// Defaults to DefaultCleanupGracePeriod.
+	CleanupGracePeriod time.Duration
+
+	// Worker backend to use: WorkerOCI (the default) or WorkerContainerd.
+	Worker string
+
+	// Address of containerd's socket when using WorkerContainerd. Defaults to
+	// buildkitd's own default.
+	ContainerdAddress string
+
+	// Snapshotter for the worker to use, e.g. "overlayfs", "native" or
+	// "fuse-overlayfs". When empty or "auto" with the OCI worker, overlayfs is
+	// probed for and a fallback is chosen if it cannot be mounted.
+	Snapshotter string
+
+	// OCI runtime binary for the OCI worker to use, e.g. "crun". Defaults to
+	// runc.
+	Runtime string
+
+	// Number of trailing buildkitd log lines to attach to build errors.
+	// Defaults to DefaultLogTailLines.
+	LogTailLines int
+
+	// Event log to report buildkitd starting, and then builds using it, to.
+	Events *EventLog
+
+	// Tracer to record spawning buildkitd, and then builds using it, with.
+	Tracer *Tracer
 }
 
-func SpawnBuildkitd(ociImage OCIImage, opts *BuildkitdOpts) (*Buildkitd, error) {
-	err := run(os.Stdout, "setup-cgroups")
+const (
+	WorkerOCI        = "oci"
+	WorkerContainerd = "containerd"
+)
+
+func SpawnBuildkitd(ociImage OCIImage, opts *BuildkitdOpts) (_ *Buildkitd, err error) {
+	if opts == nil {
+		opts = &BuildkitdOpts{}
+	}
+
+	started := time.Now()
+
+	span := opts.Tracer.Start("spawn buildkitd", nil)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	switch opts.Worker {
+	case "", WorkerOCI:
+	case WorkerContainerd:
+		if opts.Runtime != "" {
+			return nil, fmt.Errorf("runtime cannot be configured for the %s worker", WorkerContainerd)
+		}
+	default:
+		return nil, fmt.Errorf("unknown worker: %s", opts.Worker)
+	}
+
+	err = cgroups.New().Run()
 	if err != nil {
 		return nil, errors.Wrap(err, "setup cgroups")
 	}
 
 	rootDir := filepath.Join(os.TempDir(), "buildkitd")
-	if opts != nil && opts.RootDir != "" {
+	if opts.RootDir != "" {
 		rootDir = opts.RootDir
 	}
 
@@ -47,13 +130,26 @@ func SpawnBuildkitd(ociImage OCIImage, opts *BuildkitdOpts) (*Buildkitd, error)
 
 	sockPath := filepath.Join(rootDir, "buildkitd.sock")
 	logPath := filepath.Join(rootDir, "buildkitd.log")
+	pidPath := filepath.Join(rootDir, "buildkitd.pid")
+
+	err = recoverStaleState(rootDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "recover stale state")
+	}
 
 	configPath := filepath.Join(rootDir, "builtkitd.toml")
-	if opts != nil && opts.ConfigPath != "" {
+	if opts.ConfigPath != "" {
 		configPath = opts.ConfigPath
 	}
 
-	err = generateConfig(ociImage, configPath)
+	// probe the host here, so that the config only depends on what it's
+	// given
+	workerOpts := *opts
+	if workerOpts.Worker != WorkerContainerd && os.Getuid() == 0 {
+		workerOpts.Snapshotter = resolveSnapshotter(rootDir, opts.Snapshotter)
+	}
+
+	err = GenerateBuildkitdConfig(ociImage, workerOpts, configPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "generate config")
 	}
@@ -77,16 +173,24 @@ func SpawnBuildkitd(ociImage OCIImage, opts *BuildkitdOpts) (*Buildkitd, error)
 		cmd = exec.Command("rootlesskit", append([]string{"buildkitd"}, buildkitdFlags...)...)
 	}
 
-	// kill buildkitd on exit
+	// kill buildkitd on exit, and place it in its own process group so that
+	// rootlesskit's children can be reaped along with it
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Pdeathsig: syscall.SIGKILL,
+		Setpgid:   true,
 	}
 
-	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND, 0600)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
 	if err != nil {
 		return nil, errors.Wrap(err, "open log file")
 	}
 
+	// the log file is appended to across runs; only care about this one
+	logOffset, err := logFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, errors.Wrap(err, "seek log file")
+	}
+
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
 
@@ -95,49 +199,192 @@ func SpawnBuildkitd(ociImage OCIImage, opts *BuildkitdOpts) (*Buildkitd, error)
 		return nil, errors.Wrap(err, "start buildkitd")
 	}
 
-	err = logFile.Close()
-	if err != nil {
-		return nil, errors.Wrap(err, "close log file")
+	// reap buildkitd as soon as it exits, so that waiting for it to start
+	// notices if it dies
+	exited := make(chan error, 1)
+	go func() {
+		_, err := cmd.Process.Wait()
+		exited <- err
+	}()
+
+	stopTailing := make(chan struct{})
+	tailingDone := make(chan struct{})
+	if ociImage.Debug {
+		go tailLogFile(logPath, logOffset, stopTailing, tailingDone)
+	} else {
+		close(tailingDone)
 	}
 
-	for {
-		err := buildctl(addr, ioutil.Discard, "debug", "workers")
+	// nothing else can clean up buildkitd until it is returned, so kill it
+	// (and anything rootlesskit spawned) on any failure from here on
+	var reaped, dumpLogs bool
+	defer func() {
 		if err == nil {
-			break
+			return
 		}
 
-		err = cmd.Process.Signal(syscall.Signal(0))
-		if err != nil {
-			logrus.Warn("builtkitd process probe failed:", err)
+		killErr := killProcessGroup(cmd.Process.Pid)
+		if killErr != nil {
+			logrus.Warn("failed to kill buildkitd:", killErr)
+		}
 
+		if !reaped {
+			<-exited
+		}
+
+		close(stopTailing)
+		<-tailingDone
+
+		if dumpLogs {
 			logrus.Warn("dumping buildkit logs due to probe failure")
 			fmt.Fprintln(os.Stderr)
 			dumpLogFile(logPath)
+		}
 
-			os.Exit(1)
+		_ = os.Remove(pidPath)
+	}()
+
+	err = logFile.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "close log file")
+	}
+
+	err = ioutil.WriteFile(pidPath, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "write pid file")
+	}
+
+	waitSpan := opts.Tracer.Start("wait for buildkitd", span)
+
+	polls := 0
+	for {
+		polls++
+
+		err := buildctl(addr, nil, ioutil.Discard, "debug", "workers")
+		if err == nil {
+			break
 		}
 
 		logrus.Debugf("waiting for buildkitd...")
-		time.Sleep(100 * time.Millisecond)
+
+		select {
+		case waitErr := <-exited:
+			waitSpan.End()
+
+			reaped, dumpLogs = true, true
+			if waitErr != nil {
+				return nil, errors.Wrap(waitErr, "wait buildkitd")
+			}
+
+			return nil, fmt.Errorf("buildkitd exited before it was ready")
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
 
+	waitSpan.SetAttribute("polls", polls)
+	waitSpan.End()
+
 	logrus.Debug("buildkitd started")
 
+	opts.Events.Emit(Event{
+		Type:     EventBuildkitdStarted,
+		Duration: time.Since(started).Seconds(),
+		Addr:     addr,
+	})
+
+	gracePeriod := DefaultCleanupGracePeriod
+	if opts.CleanupGracePeriod != 0 {
+		gracePeriod = opts.CleanupGracePeriod
+	}
+
+	logTailLines := DefaultLogTailLines
+	if opts.LogTailLines != 0 {
+		logTailLines = opts.LogTailLines
+	}
+
 	return &Buildkitd{
 		Addr: addr,
 
-		rootDir: rootDir,
-		proc:    cmd.Process,
+		rootDir:     rootDir,
+		proc:        cmd.Process,
+		exited:      exited,
+		gracePeriod: gracePeriod,
+
+		logPath:      logPath,
+		logOffset:    logOffset,
+		logTailLines: logTailLines,
+
+		stopTailing: stopTailing,
+		tailingDone: tailingDone,
+
+		events: opts.Events,
+		tracer: opts.Tracer,
 	}, nil
 }
 
-func (buildkitd *Buildkitd) Cleanup() error {
-	err := buildkitd.proc.Signal(syscall.SIGTERM)
+// ConnectBuildkitd connects to an already running buildkitd at addr, e.g.
+// 'unix:///run/buildkit/buildkitd.sock'. Cleanup leaves it running.
+//
+// Builds using it are reported to events, which may be nil.
+func ConnectBuildkitd(addr string, events *EventLog) (*Buildkitd, error) {
+	err := buildctl(addr, nil, ioutil.Discard, "debug", "workers")
 	if err != nil {
+		return nil, fmt.Errorf("probe buildkitd at %s: %w", addr, err)
+	}
+
+	return &Buildkitd{
+		Addr: addr,
+
+		events: events,
+	}, nil
+}
+
+// Cleanup terminates buildkitd, escalating to SIGKILL if it has not exited
+// within the grace period. Any processes left over in buildkitd's process
+// group (i.e. rootlesskit's children) are killed afterwards, even if
+// buildkitd had already exited.
+func (buildkitd *Buildkitd) Cleanup() (err error) {
+	// nothing to clean up for a buildkitd that was connected to
+	if buildkitd.proc == nil {
+		return nil
+	}
+
+	pgid := buildkitd.proc.Pid
+
+	defer func() {
+		killErr := killProcessGroup(pgid)
+		if killErr != nil && err == nil {
+			err = errors.Wrap(killErr, "reap buildkitd children")
+		}
+
+		close(buildkitd.stopTailing)
+		<-buildkitd.tailingDone
+
+		removeErr := os.Remove(filepath.Join(buildkitd.rootDir, "buildkitd.pid"))
+		if removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = errors.Wrap(removeErr, "remove pid file")
+		}
+	}()
+
+	// if it has already exited, its exit is waiting to be received below
+	err = buildkitd.proc.Signal(syscall.SIGTERM)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
 		return errors.Wrap(err, "terminate buildkitd")
 	}
 
-	_, err = buildkitd.proc.Wait()
+	select {
+	case err = <-buildkitd.exited:
+	case <-time.After(buildkitd.gracePeriod):
+		logrus.Warnf("buildkitd did not exit within %s; killing", buildkitd.gracePeriod)
+
+		err = killProcessGroup(pgid)
+		if err != nil {
+			return errors.Wrap(err, "kill buildkitd")
+		}
+
+		err = <-buildkitd.exited
+	}
+
 	if err != nil {
 		return errors.Wrap(err, "wait buildkitd")
 	}
@@ -145,7 +392,178 @@ func (buildkitd *Buildkitd) Cleanup() error {
 	return nil
 }
 
-func generateConfig(ociImage OCIImage, configPath string) error {
+// LogTail returns the last lines written to buildkitd's log since it was
+// spawned.
+func (buildkitd *Buildkitd) LogTail() ([]string, error) {
+	logFile, err := os.Open(buildkitd.logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer logFile.Close()
+
+	_, err = logFile.Seek(buildkitd.logOffset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+
+	scanner := bufio.NewScanner(logFile)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > buildkitd.logTailLines {
+			lines = lines[1:]
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// withLogTail attaches the tail of buildkitd's log to err, as build failures
+// are often caused by something only buildkitd knows about (e.g. snapshotter
+// or registry TLS errors).
+func (buildkitd *Buildkitd) withLogTail(err error) error {
+	if buildkitd.logPath == "" {
+		return err
+	}
+
+	lines, tailErr := buildkitd.LogTail()
+	if tailErr != nil {
+		logrus.Warn("failed to read buildkitd log:", tailErr)
+		return err
+	}
+
+	if len(lines) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("%w\n\nlast %d lines of buildkitd log:\n%s", err, len(lines), strings.Join(lines, "\n"))
+}
+
+// recoverStaleState cleans up after a buildkitd that was not cleaned up
+// properly, e.g. because the previous run crashed while using the same root
+// dir.
+//
+// An orphaned buildkitd that is still running is killed, and a socket or lock
+// file that nothing is listening on or holding is removed.
+func recoverStaleState(rootDir string) error {
+	pidPath := filepath.Join(rootDir, "buildkitd.pid")
+	sockPath := filepath.Join(rootDir, "buildkitd.sock")
+	lockPath := filepath.Join(rootDir, "buildkitd.lock")
+
+	pidContent, err := ioutil.ReadFile(pidPath)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(pidContent)))
+		if err == nil && isBuildkitdProcess(pid) {
+			logrus.Warnf("killing orphaned buildkitd (pid %d)", pid)
+
+			err := killProcessGroup(pid)
+			if err != nil {
+				return errors.Wrap(err, "kill orphaned buildkitd")
+			}
+
+			err = waitForExit(pid, DefaultCleanupGracePeriod)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = os.Remove(pidPath)
+		if err != nil {
+			return errors.Wrap(err, "remove stale pid file")
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "read pid file")
+	}
+
+	if _, err := os.Lstat(sockPath); err == nil {
+		conn, err := net.Dial("unix", sockPath)
+		if err == nil {
+			conn.Close()
+			return fmt.Errorf("buildkitd is already listening on %s", sockPath)
+		}
+
+		logrus.Warnf("removing stale socket %s", sockPath)
+
+		err = os.Remove(sockPath)
+		if err != nil {
+			return errors.Wrap(err, "remove stale socket")
+		}
+	}
+
+	if _, err := os.Lstat(lockPath); err == nil {
+		lockFile, err := os.OpenFile(lockPath, os.O_RDWR, 0)
+		if err != nil {
+			return errors.Wrap(err, "open lock file")
+		}
+
+		defer lockFile.Close()
+
+		err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			return fmt.Errorf("lock %s is held by another process: %w", lockPath, err)
+		}
+
+		logrus.Warnf("removing stale lock %s", lockPath)
+
+		err = os.Remove(lockPath)
+		if err != nil {
+			return errors.Wrap(err, "remove stale lock")
+		}
+	}
+
+	return nil
+}
+
+// isBuildkitdProcess checks whether pid refers to a live (i.e. non-zombie)
+// buildkitd or rootlesskit process, guarding against the pid having been
+// re-used since the pid file was written.
+func isBuildkitdProcess(pid int) bool {
+	cmdline, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil || !strings.Contains(string(cmdline), "buildkitd") {
+		return false
+	}
+
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+
+	// the state follows the parenthesized command name, which may itself
+	// contain spaces or parens
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func killProcessGroup(pgid int) error {
+	err := syscall.Kill(-pgid, syscall.SIGKILL)
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+
+	return nil
+}
+
+func waitForExit(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for isBuildkitdProcess(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("process %d did not exit within %s", pid, timeout)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// GenerateBuildkitdConfig writes buildkitd's config for the image's registry
+// mirrors, GC and parallelism settings and the worker options to configPath.
+// The snapshotter is written as given; SpawnBuildkitd resolves an automatic
+// one against the host beforehand.
+func GenerateBuildkitdConfig(ociImage OCIImage, opts BuildkitdOpts, configPath string) error {
 	var config BuildkitdConfig
 
 	if len(ociImage.RegistryMirrors) > 0 {
@@ -158,6 +576,39 @@ func generateConfig(ociImage OCIImage, configPath string) error {
 		config.Registries = registryConfigs
 	}
 
+	var workerConfig WorkerConfig
+
+	if ociImage.GC != nil {
+		gc := true
+		workerConfig.GC = &gc
+		workerConfig.GCKeepStorage = ociImage.GC.KeepStorage * 1024 * 1024
+		workerConfig.GCPolicy = ociImage.GC.Policies
+	}
+
+	if opts.Worker == WorkerContainerd {
+		enabled, disabled := true, false
+
+		config.Workers = &WorkersConfig{
+			OCI: &OCIWorkerConfig{
+				Enabled: &disabled,
+			},
+			Containerd: &ContainerdWorkerConfig{
+				Enabled:      &enabled,
+				Address:      opts.ContainerdAddress,
+				Snapshotter:  opts.Snapshotter,
+				WorkerConfig: workerConfig,
+			},
+		}
+	} else if ociImage.GC != nil || opts.Snapshotter != "" || opts.Runtime != "" {
+		config.Workers = &WorkersConfig{
+			OCI: &OCIWorkerConfig{
+				Snapshotter:  opts.Snapshotter,
+				Binary:       opts.Runtime,
+				WorkerConfig: workerConfig,
+			},
+		}
+	}
+
 	err := os.MkdirAll(filepath.Dir(configPath), 0700)
 	if err != nil {
 		return err
@@ -176,6 +627,116 @@ func generateConfig(ociImage OCIImage, configPath string) error {
 	return f.Close()
 }
 
+// resolveSnapshotter falls back from overlayfs when it is (or would be)
+// selected automatically but cannot actually be mounted under rootDir, which
+// is the case on some filesystems (e.g. overlay on overlay).
+func resolveSnapshotter(rootDir string, snapshotter string) string {
+	if snapshotter != "" && snapshotter != "auto" {
+		return snapshotter
+	}
+
+	err := probeOverlay(rootDir)
+	if err == nil {
+		return snapshotter
+	}
+
+	fallback := "native"
+	if _, err := exec.LookPath("fuse-overlayfs"); err == nil {
+		fallback = "fuse-overlayfs"
+	}
+
+	logrus.Warnf("overlayfs unavailable (%s); falling back to %s snapshotter", err, fallback)
+
+	return fallback
+}
+
+func probeOverlay(dir string) error {
+	probeDir, err := ioutil.TempDir(dir, "overlay-probe")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(probeDir)
+
+	var dirs []string
+	for _, name := range []string{"lower", "upper", "work", "merged"} {
+		path := filepath.Join(probeDir, name)
+
+		err := os.Mkdir(path, 0755)
+		if err != nil {
+			return err
+		}
+
+		dirs = append(dirs, path)
+	}
+
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", dirs[0], dirs[1], dirs[2])
+
+	err = syscall.Mount("overlay", dirs[3], "overlay", 0, data)
+	if err != nil {
+		return err
+	}
+
+	return syscall.Unmount(dirs[3], 0)
+}
+
+// tailLogFile streams the log file to stderr from the given offset until
+// stop is closed, at which point everything written so far is flushed.
+func tailLogFile(logPath string, offset int64, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	logFile, err := os.Open(logPath)
+	if err != nil {
+		logrus.Warn("error opening log file:", err)
+		return
+	}
+
+	defer logFile.Close()
+
+	_, err = logFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		logrus.Warn("error seeking log file:", err)
+		return
+	}
+
+	prefix := color.HiBlackString("buildkitd |")
+
+	reader := bufio.NewReader(logFile)
+
+	var line string
+	var stopping bool
+	for {
+		chunk, err := reader.ReadString('\n')
+		line += chunk
+
+		if err == nil {
+			fmt.Fprintln(os.Stderr, prefix, strings.TrimSuffix(line, "\n"))
+			line = ""
+			continue
+		}
+
+		if err != io.EOF {
+			logrus.Warn("error streaming log file:", err)
+			return
+		}
+
+		if stopping {
+			if line != "" {
+				fmt.Fprintln(os.Stderr, prefix, line)
+			}
+
+			return
+		}
+
+		select {
+		case <-stop:
+			// drain whatever is left
+			stopping = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
 func dumpLogFile(logPath string) {
 	logFile, err := os.Open(logPath)
 	if err != nil {
@@ -2,6 +2,41 @@ package prototype
 
 type BuildkitdConfig struct {
 	Registries map[string]RegistryConfig `toml:"registry"`
+	Workers    *WorkersConfig            `toml:"worker"`
+}
+
+type WorkersConfig struct {
+	OCI        *OCIWorkerConfig        `toml:"oci"`
+	Containerd *ContainerdWorkerConfig `toml:"containerd"`
+}
+
+type OCIWorkerConfig struct {
+	Enabled     *bool  `toml:"enabled"`
+	Snapshotter string `toml:"snapshotter,omitempty"`
+	Binary      string `toml:"binary,omitempty"`
+
+	WorkerConfig
+}
+
+type ContainerdWorkerConfig struct {
+	Enabled     *bool  `toml:"enabled"`
+	Address     string `toml:"address,omitempty"`
+	Snapshotter string `toml:"snapshotter,omitempty"`
+
+	WorkerConfig
+}
+
+type WorkerConfig struct {
+	GC            *bool      `toml:"gc"`
+	GCKeepStorage int64      `toml:"gckeepstorage,omitzero"`
+	GCPolicy      []GCPolicy `toml:"gcpolicy,omitempty"`
+}
+
+type GCPolicy struct {
+	All          bool     `toml:"all,omitempty" json:"all,omitempty"`
+	KeepBytes    int64    `toml:"keepBytes,omitzero" json:"keep_bytes,omitempty"`
+	KeepDuration int64    `toml:"keepDuration,omitzero" json:"keep_duration,omitempty"`
+	Filters      []string `toml:"filters,omitempty" json:"filters,omitempty"`
 }
 
 type RegistryConfig struct {
@@ -1,10 +1,17 @@
 package prototype_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -19,22 +26,32 @@ type BuildkitdSuite struct {
 	buildkitd  *prototype.Buildkitd
 	outputsDir string
 	ociImage   prototype.OCIImage
-}
 
-func (s *BuildkitdSuite) TearDownSuite() {
-	if s.buildkitd != nil {
-		err := s.buildkitd.Cleanup()
-		s.NoError(err)
-	}
+	// PATH to restore after faking binaries
+	path string
 }
 
 func (s *BuildkitdSuite) SetupTest() {
 	var err error
+
+	s.ociImage = prototype.OCIImage{}
 	s.outputsDir, err = ioutil.TempDir("", "oci-build-task-test")
 	s.NoError(err)
 }
 
 func (s *BuildkitdSuite) TearDownTest() {
+	if s.buildkitd != nil {
+		err := s.buildkitd.Cleanup()
+		s.NoError(err)
+
+		s.buildkitd = nil
+	}
+
+	if s.path != "" {
+		s.NoError(os.Setenv("PATH", s.path))
+		s.path = ""
+	}
+
 	err := os.RemoveAll(s.outputsDir)
 	s.NoError(err)
 }
@@ -54,18 +71,324 @@ func (s *BuildkitdSuite) TestGenerateConfig() {
 
 	s.ociImage.RegistryMirrors = []string{"hub.docker.io"}
 
+	err = prototype.GenerateBuildkitdConfig(s.ociImage, prototype.BuildkitdOpts{}, s.configPath("mirrors.toml"))
+	s.NoError(err)
+
+	configContent, err := ioutil.ReadFile(s.configPath("mirrors.toml"))
+	s.NoError(err)
+
+	expectedContent, err := ioutil.ReadFile("testdata/buildkitd-config/mirrors.toml")
+	s.NoError(err)
+
+	s.Equal(expectedContent, configContent)
+}
+
+func (s *BuildkitdSuite) TestGenerateGCConfig() {
+	var err error
+
+	s.ociImage.GC = &prototype.GCConfig{
+		KeepStorage: 10000,
+		Policies: []prototype.GCPolicy{
+			{
+				KeepBytes:    512000000,
+				KeepDuration: 172800,
+				Filters:      []string{"type==source.local", "type==exec.cachemount"},
+			},
+			{
+				All:       true,
+				KeepBytes: 1024000000,
+			},
+		},
+	}
+
+	err = prototype.GenerateBuildkitdConfig(s.ociImage, prototype.BuildkitdOpts{}, s.configPath("gc.toml"))
+	s.NoError(err)
+
+	configContent, err := ioutil.ReadFile(s.configPath("gc.toml"))
+	s.NoError(err)
+
+	expectedContent, err := ioutil.ReadFile("testdata/buildkitd-config/gc.toml")
+	s.NoError(err)
+
+	s.Equal(expectedContent, configContent)
+}
+
+func (s *BuildkitdSuite) TestGenerateWorkerConfig() {
+	var err error
+
+	err = prototype.GenerateBuildkitdConfig(s.ociImage, prototype.BuildkitdOpts{
+		Snapshotter: "native",
+		Runtime:     "runc",
+	}, s.configPath("worker.toml"))
+	s.NoError(err)
+
+	configContent, err := ioutil.ReadFile(s.configPath("worker.toml"))
+	s.NoError(err)
+
+	expectedContent, err := ioutil.ReadFile("testdata/buildkitd-config/worker.toml")
+	s.NoError(err)
+
+	s.Equal(expectedContent, configContent)
+}
+
+func (s *BuildkitdSuite) TestGenerateContainerdWorkerConfig() {
+	var err error
+
+	s.ociImage.GC = &prototype.GCConfig{KeepStorage: 5000}
+
+	err = prototype.GenerateBuildkitdConfig(s.ociImage, prototype.BuildkitdOpts{
+		Worker:            prototype.WorkerContainerd,
+		ContainerdAddress: "/run/containerd/containerd.sock",
+		Snapshotter:       "overlayfs",
+	}, s.configPath("containerd.toml"))
+	s.NoError(err)
+
+	configContent, err := ioutil.ReadFile(s.configPath("containerd.toml"))
+	s.NoError(err)
+
+	expectedContent, err := ioutil.ReadFile("testdata/buildkitd-config/containerd.toml")
+	s.NoError(err)
+
+	s.Equal(expectedContent, configContent)
+}
+
+func (s *BuildkitdSuite) TestSpawnWritesConfig() {
+	s.fakeBinaries(map[string]string{
+		"buildkitd":   "exec sleep 60",
+		"rootlesskit": "exec sleep 60",
+		"buildctl":    "exit 0",
+	})
+
+	s.ociImage.RegistryMirrors = []string{"hub.docker.io"}
+
+	var err error
 	s.buildkitd, err = prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		RootDir:    filepath.Join(s.outputsDir, "root"),
 		ConfigPath: s.configPath("mirrors.toml"),
 	})
 	s.NoError(err)
 
+	// the snapshotter may have been resolved against the host, so only
+	// check that the config was generated there
 	configContent, err := ioutil.ReadFile(s.configPath("mirrors.toml"))
 	s.NoError(err)
 
-	expectedContent, err := ioutil.ReadFile("testdata/buildkitd-config/mirrors.toml")
+	s.Contains(string(configContent), `mirrors = ["hub.docker.io"]`)
+}
+
+func (s *BuildkitdSuite) TestUnknownWorker() {
+	_, err := prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		Worker: "bogus",
+	})
+	s.EqualError(err, "unknown worker: bogus")
+}
+
+func (s *BuildkitdSuite) TestContainerdWorkerRuntime() {
+	_, err := prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		Worker:  prototype.WorkerContainerd,
+		Runtime: "crun",
+	})
+	s.EqualError(err, "runtime cannot be configured for the containerd worker")
+}
+
+func (s *BuildkitdSuite) TestStaleSocket() {
+	var err error
+
+	rootDir := filepath.Join(s.outputsDir, "root")
+	err = os.MkdirAll(rootDir, 0755)
 	s.NoError(err)
 
-	s.Equal(expectedContent, configContent)
+	// nothing is listening on it, as if left behind by a crashed buildkitd
+	err = ioutil.WriteFile(filepath.Join(rootDir, "buildkitd.sock"), nil, 0600)
+	s.NoError(err)
+
+	s.buildkitd, err = prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		RootDir: rootDir,
+	})
+	s.NoError(err)
+}
+
+func (s *BuildkitdSuite) TestOrphanedBuildkitd() {
+	rootDir := filepath.Join(s.outputsDir, "root")
+
+	_, err := prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		RootDir: rootDir,
+	})
+	s.NoError(err)
+
+	orphanPid := s.readPid(filepath.Join(rootDir, "buildkitd.pid"))
+
+	s.buildkitd, err = prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		RootDir: rootDir,
+	})
+	s.NoError(err)
+
+	// the orphan is reaped by whoever spawned it, so only check that it's
+	// gone
+	s.waitForExit(orphanPid)
+}
+
+func (s *BuildkitdSuite) TestCleanupGracePeriod() {
+	var err error
+
+	s.buildkitd, err = prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		RootDir:            filepath.Join(s.outputsDir, "root"),
+		CleanupGracePeriod: time.Nanosecond,
+	})
+	s.NoError(err)
+
+	err = s.buildkitd.Cleanup()
+	s.NoError(err)
+
+	_, err = os.Stat(filepath.Join(s.outputsDir, "root", "buildkitd.pid"))
+	s.True(os.IsNotExist(err))
+
+	s.buildkitd = nil
+}
+
+func (s *BuildkitdSuite) TestCleanupKillsAfterGracePeriod() {
+	// a buildkitd which ignores SIGTERM, and a buildctl that reports it as
+	// ready
+	s.fakeBinaries(map[string]string{
+		"buildkitd":   "trap '' TERM\nexec sleep 60",
+		"rootlesskit": "trap '' TERM\nexec sleep 60",
+		"buildctl":    "exit 0",
+	})
+
+	rootDir := filepath.Join(s.outputsDir, "root")
+
+	buildkitd, err := prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		RootDir:            rootDir,
+		CleanupGracePeriod: 100 * time.Millisecond,
+	})
+	s.NoError(err)
+
+	pidContent, err := ioutil.ReadFile(filepath.Join(rootDir, "buildkitd.pid"))
+	s.NoError(err)
+
+	pid, err := strconv.Atoi(string(pidContent))
+	s.NoError(err)
+
+	started := time.Now()
+
+	err = buildkitd.Cleanup()
+	s.NoError(err)
+
+	s.True(time.Since(started) >= 100*time.Millisecond, "cleanup did not wait for the grace period")
+
+	// it has been killed and reaped
+	err = syscall.Kill(pid, 0)
+	s.Equal(syscall.ESRCH, err)
+}
+
+func (s *BuildkitdSuite) TestProbeFailure() {
+	s.fakeBinaries(map[string]string{
+		"buildkitd":   "exit 1",
+		"rootlesskit": "exit 1",
+		"buildctl":    "exit 1",
+	})
+
+	rootDir := filepath.Join(s.outputsDir, "root")
+
+	_, err := prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		RootDir: rootDir,
+	})
+	s.EqualError(err, "buildkitd exited before it was ready")
+
+	_, err = os.Stat(filepath.Join(rootDir, "buildkitd.pid"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *BuildkitdSuite) TestCleanupAfterExit() {
+	// leaves a child behind in its process group, as rootlesskit would
+	s.fakeBinaries(map[string]string{
+		"buildkitd":   "sleep 60 &\necho $! > \"$2/child.pid\"",
+		"rootlesskit": "sleep 60 &\necho $! > \"$3/child.pid\"",
+		"buildctl":    "exit 0",
+	})
+
+	rootDir := filepath.Join(s.outputsDir, "root")
+
+	buildkitd, err := prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		RootDir: rootDir,
+	})
+	s.NoError(err)
+
+	pid := s.readPid(filepath.Join(rootDir, "buildkitd.pid"))
+	s.waitForExit(pid)
+
+	err = buildkitd.Cleanup()
+	s.NoError(err)
+
+	s.waitForExit(s.readPid(filepath.Join(rootDir, "child.pid")))
+
+	_, err = os.Stat(filepath.Join(rootDir, "buildkitd.pid"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *BuildkitdSuite) readPid(path string) int {
+	content, err := ioutil.ReadFile(path)
+	s.NoError(err)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	s.NoError(err)
+
+	return pid
+}
+
+// waitForExit waits for the process to be gone, or to be a zombie if it was
+// orphaned to a parent which does not reap it.
+func (s *BuildkitdSuite) waitForExit(pid int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for syscall.Kill(pid, 0) != syscall.ESRCH {
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err == nil && strings.Contains(string(stat), ") Z ") {
+			return
+		}
+
+		s.True(time.Now().Before(deadline), "process %d did not exit", pid)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *BuildkitdSuite) fakeBinaries(scripts map[string]string) {
+	binDir := filepath.Join(s.outputsDir, "bin")
+	s.NoError(os.MkdirAll(binDir, 0755))
+
+	for name, script := range scripts {
+		err := ioutil.WriteFile(filepath.Join(binDir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755)
+		s.NoError(err)
+	}
+
+	s.path = os.Getenv("PATH")
+	s.NoError(os.Setenv("PATH", binDir+string(os.PathListSeparator)+s.path))
+}
+
+func (s *BuildkitdSuite) TestTracer() {
+	var err error
+
+	tracer := prototype.NewTracer("some-task")
+
+	s.buildkitd, err = prototype.SpawnBuildkitd(s.ociImage, &prototype.BuildkitdOpts{
+		Tracer: tracer,
+	})
+	s.NoError(err)
+
+	buf := new(bytes.Buffer)
+	s.NoError(tracer.WriteOTLP(buf))
+
+	var trace exportedTrace
+	s.NoError(json.Unmarshal(buf.Bytes(), &trace))
+
+	spans := trace.ResourceSpans[0].ScopeSpans[0].Spans
+	s.Len(spans, 3)
+
+	s.Equal("spawn buildkitd", spans[1].Name)
+	s.Equal(spans[0].SpanID, spans[1].ParentSpanID)
+
+	s.Equal("wait for buildkitd", spans[2].Name)
+	s.Equal(spans[1].SpanID, spans[2].ParentSpanID)
+	s.Equal("polls", spans[2].Attributes[0].Key)
 }
 
 func (s *BuildkitdSuite) configPath(path ...string) string {
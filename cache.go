@@ -0,0 +1,278 @@
+package prototype
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PruneCache garbage-collects the local cache exported into cacheDir.
+//
+// Blobs that are no longer referenced by the index.json of the cache they
+// belong to are removed, along with any leftover partial ingests. If maxSize
+// is non-zero and the cache is still larger than maxSize bytes, whole caches
+// are then removed, least recently exported first, until it fits.
+//
+// The number of bytes reclaimed is returned.
+func PruneCache(cacheDir string, maxSize int64) (int64, error) {
+	layouts, err := localCacheDirs(cacheDir)
+	if err != nil {
+		return 0, fmt.Errorf("find caches: %w", err)
+	}
+
+	var reclaimed int64
+	for _, layout := range layouts {
+		freed, err := pruneLayout(layout)
+		if err != nil {
+			return reclaimed, fmt.Errorf("prune %s: %w", layout, err)
+		}
+
+		reclaimed += freed
+	}
+
+	if maxSize == 0 {
+		return reclaimed, nil
+	}
+
+	size, err := dirSize(cacheDir)
+	if err != nil {
+		return reclaimed, fmt.Errorf("get cache size: %w", err)
+	}
+
+	sort.Slice(layouts, func(i, j int) bool {
+		return modTime(filepath.Join(layouts[i], "index.json")) < modTime(filepath.Join(layouts[j], "index.json"))
+	})
+
+	for _, layout := range layouts {
+		if size <= maxSize {
+			break
+		}
+
+		freed, err := removeLayout(layout)
+		if err != nil {
+			return reclaimed, fmt.Errorf("remove %s: %w", layout, err)
+		}
+
+		if layout != cacheDir {
+			err = os.Remove(layout)
+			if err != nil {
+				return reclaimed, fmt.Errorf("remove %s: %w", layout, err)
+			}
+		}
+
+		size -= freed
+		reclaimed += freed
+	}
+
+	return reclaimed, nil
+}
+
+// ociDescriptor is the subset of an OCI descriptor (or of a manifest or index
+// referring to other descriptors) needed to find referenced blobs.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+
+	Config    *ociDescriptor  `json:"config,omitempty"`
+	Layers    []ociDescriptor `json:"layers,omitempty"`
+	Manifests []ociDescriptor `json:"manifests,omitempty"`
+}
+
+// pruneLayout removes unreferenced blobs and ingests from an OCI image
+// layout.
+func pruneLayout(layout string) (int64, error) {
+	referenced := map[string]bool{}
+
+	var index ociDescriptor
+	err := readJSON(filepath.Join(layout, "index.json"), &index)
+	if err != nil {
+		return 0, err
+	}
+
+	err = markReferenced(layout, index, referenced)
+	if err != nil {
+		return 0, err
+	}
+
+	var reclaimed int64
+
+	blobsDir := filepath.Join(layout, "blobs")
+	err = filepath.Walk(blobsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(blobsDir, path)
+		if err != nil {
+			return err
+		}
+
+		digest := strings.Replace(filepath.ToSlash(rel), "/", ":", 1)
+		if referenced[digest] {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+
+		reclaimed += info.Size()
+
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return reclaimed, err
+	}
+
+	ingestSize, err := dirSize(filepath.Join(layout, "ingest"))
+	if err != nil {
+		return reclaimed, err
+	}
+
+	err = os.RemoveAll(filepath.Join(layout, "ingest"))
+	if err != nil {
+		return reclaimed, err
+	}
+
+	return reclaimed + ingestSize, nil
+}
+
+func markReferenced(layout string, desc ociDescriptor, referenced map[string]bool) error {
+	var children []ociDescriptor
+	children = append(children, desc.Manifests...)
+	children = append(children, desc.Layers...)
+	if desc.Config != nil {
+		children = append(children, *desc.Config)
+	}
+
+	for _, child := range children {
+		if referenced[child.Digest] {
+			continue
+		}
+
+		referenced[child.Digest] = true
+
+		if !isManifestOrIndex(child.MediaType) {
+			continue
+		}
+
+		var manifest ociDescriptor
+		err := readJSON(blobPath(layout, child.Digest), &manifest)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return err
+		}
+
+		err = markReferenced(layout, manifest, referenced)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isManifestOrIndex(mediaType string) bool {
+	switch mediaType {
+	case "application/vnd.oci.image.index.v1+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.docker.distribution.manifest.v2+json":
+		return true
+	default:
+		return false
+	}
+}
+
+// removeLayout removes the contents of an exported cache. The directory itself
+// is left for the caller to remove, as the legacy cache was exported directly
+// into the cache dir.
+func removeLayout(layout string) (int64, error) {
+	var reclaimed int64
+	for _, name := range []string{"index.json", "oci-layout", "blobs", "ingest"} {
+		path := filepath.Join(layout, name)
+
+		size, err := dirSize(path)
+		if err != nil {
+			return reclaimed, err
+		}
+
+		err = os.RemoveAll(path)
+		if err != nil {
+			return reclaimed, err
+		}
+
+		reclaimed += size
+	}
+
+	return reclaimed, nil
+}
+
+func blobPath(layout string, digest string) string {
+	return filepath.Join(layout, "blobs", strings.Replace(digest, ":", string(filepath.Separator), 1))
+}
+
+func readJSON(path string, dest interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, dest)
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func modTime(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return info.ModTime().UnixNano()
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
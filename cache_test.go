@@ -0,0 +1,161 @@
+package prototype_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type CacheSuite struct {
+	suite.Suite
+	*require.Assertions
+
+	cacheDir string
+}
+
+func (s *CacheSuite) SetupTest() {
+	var err error
+	s.cacheDir, err = ioutil.TempDir("", "oci-image-prototype-cache")
+	s.NoError(err)
+}
+
+func (s *CacheSuite) TearDownTest() {
+	err := os.RemoveAll(s.cacheDir)
+	s.NoError(err)
+}
+
+func (s *CacheSuite) TestPruneUnreferencedBlobs() {
+	layout := filepath.Join(s.cacheDir, "image")
+
+	layer := s.writeBlob(layout, []byte("some layer"))
+	cacheConfig := s.writeBlob(layout, []byte(`{"layers":[]}`))
+	orphan := s.writeBlob(layout, []byte("some orphaned layer"))
+
+	index := s.writeJSONBlob(layout, map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []map[string]interface{}{
+			{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": layer},
+			{"mediaType": "application/vnd.buildkit.cacheconfig.v0", "digest": cacheConfig},
+		},
+	})
+
+	s.writeIndex(layout, index)
+
+	err := os.MkdirAll(filepath.Join(layout, "ingest", "some-ingest"), 0755)
+	s.NoError(err)
+	err = ioutil.WriteFile(filepath.Join(layout, "ingest", "some-ingest", "data"), []byte("partial"), 0644)
+	s.NoError(err)
+
+	reclaimed, err := prototype.PruneCache(s.cacheDir, 0)
+	s.NoError(err)
+	s.Equal(int64(len("some orphaned layer")+len("partial")), reclaimed)
+
+	s.FileExists(s.blobPath(layout, layer))
+	s.FileExists(s.blobPath(layout, cacheConfig))
+	s.FileExists(s.blobPath(layout, index))
+	s.NoFileExists(s.blobPath(layout, orphan))
+	s.NoDirExists(filepath.Join(layout, "ingest"))
+}
+
+func (s *CacheSuite) TestPruneMaxSize() {
+	oldLayout := filepath.Join(s.cacheDir, "old-target")
+	newLayout := filepath.Join(s.cacheDir, "image")
+
+	for _, layout := range []string{oldLayout, newLayout} {
+		layer := s.writeBlob(layout, []byte("layer for "+layout))
+		index := s.writeJSONBlob(layout, map[string]interface{}{
+			"schemaVersion": 2,
+			"manifests": []map[string]interface{}{
+				{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": layer},
+			},
+		})
+
+		s.writeIndex(layout, index)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	err := os.Chtimes(filepath.Join(oldLayout, "index.json"), past, past)
+	s.NoError(err)
+
+	newSize := s.dirSize(newLayout)
+
+	reclaimed, err := prototype.PruneCache(s.cacheDir, newSize)
+	s.NoError(err)
+	s.NotZero(reclaimed)
+
+	s.NoDirExists(oldLayout)
+	s.FileExists(filepath.Join(newLayout, "index.json"))
+	s.DirExists(s.cacheDir)
+}
+
+func (s *CacheSuite) TestPruneEmpty() {
+	reclaimed, err := prototype.PruneCache(s.cacheDir, 1)
+	s.NoError(err)
+	s.Zero(reclaimed)
+}
+
+func (s *CacheSuite) writeBlob(layout string, content []byte) string {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+
+	err := os.MkdirAll(filepath.Dir(s.blobPath(layout, digest)), 0755)
+	s.NoError(err)
+
+	err = ioutil.WriteFile(s.blobPath(layout, digest), content, 0644)
+	s.NoError(err)
+
+	return digest
+}
+
+func (s *CacheSuite) writeJSONBlob(layout string, content interface{}) string {
+	payload, err := json.Marshal(content)
+	s.NoError(err)
+
+	return s.writeBlob(layout, payload)
+}
+
+func (s *CacheSuite) writeIndex(layout string, digest string) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []map[string]interface{}{
+			{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": digest},
+		},
+	})
+	s.NoError(err)
+
+	err = ioutil.WriteFile(filepath.Join(layout, "index.json"), payload, 0644)
+	s.NoError(err)
+}
+
+func (s *CacheSuite) blobPath(layout string, digest string) string {
+	return filepath.Join(layout, "blobs", "sha256", digest[len("sha256:"):])
+}
+
+func (s *CacheSuite) dirSize(dir string) int64 {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+
+		return err
+	})
+	s.NoError(err)
+
+	return size
+}
+
+func TestCache(t *testing.T) {
+	suite.Run(t, &CacheSuite{
+		Assertions: require.New(t),
+	})
+}
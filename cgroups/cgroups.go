@@ -0,0 +1,490 @@
+// Package cgroups prepares the cgroup filesystem so that buildkitd can run
+// containers, whether the host uses cgroup v1, v2, or a hybrid of both.
+package cgroups
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Mode is the cgroup hierarchy layout in use.
+type Mode int
+
+const (
+	// Legacy hosts only have cgroup v1 hierarchies.
+	Legacy Mode = iota
+
+	// Hybrid hosts have cgroup v1 hierarchies for the controllers alongside
+	// a cgroup v2 hierarchy (typically mounted at unified/) with no
+	// controllers.
+	Hybrid
+
+	// Unified hosts only have a cgroup v2 hierarchy.
+	Unified
+)
+
+func (mode Mode) String() string {
+	switch mode {
+	case Legacy:
+		return "legacy"
+	case Hybrid:
+		return "hybrid"
+	case Unified:
+		return "unified"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(mode))
+	}
+}
+
+// Mounter performs the mounts. It is an interface so that tests can run
+// against a fake filesystem.
+type Mounter interface {
+	Mount(source, target, fstype, data string) error
+}
+
+type syscallMounter struct{}
+
+func (syscallMounter) Mount(source, target, fstype, data string) error {
+	return syscall.Mount(source, target, fstype, 0, data)
+}
+
+// Setup mounts cgroups relative to Root.
+type Setup struct {
+	// Root contains the proc/ and sys/ trees to inspect and modify.
+	Root string
+
+	Mounter Mounter
+}
+
+// New returns a Setup that operates on the real host.
+func New() Setup {
+	return Setup{
+		Root:    "/",
+		Mounter: syscallMounter{},
+	}
+}
+
+// Run detects the cgroup mode and mounts whatever is missing. On unified
+// hierarchies within a cgroup namespace, all available controllers are
+// delegated to child cgroups so that buildkitd can make use of them.
+//
+// Like the setup-cgroups script it replaces, an existing v1 or hybrid mount
+// at /sys/fs/cgroup is left untouched.
+func (setup Setup) Run() error {
+	mounts, err := setup.mountpoints()
+	if err != nil {
+		return fmt.Errorf("read mountinfo: %w", err)
+	}
+
+	mode, err := setup.DetectMode()
+	if err != nil {
+		return fmt.Errorf("detect mode: %w", err)
+	}
+
+	logrus.Debugf("cgroup mode: %s", mode)
+
+	cgroupDir := setup.cgroupDir()
+
+	if _, mounted := mounts[cgroupDir]; !mounted {
+		if mode == Unified {
+			err = setup.mount("cgroup2", cgroupDir, "cgroup2", "")
+			if err != nil {
+				return err
+			}
+		} else {
+			err = setup.mountLegacy(mode)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if mode == Unified && setup.inRootCgroup() {
+		err = setup.delegateControllers()
+		if err != nil {
+			return fmt.Errorf("delegate controllers: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DetectMode determines the cgroup mode, preferring what is already mounted
+// at /sys/fs/cgroup and otherwise inferring it from the cgroups the current
+// process belongs to.
+func (setup Setup) DetectMode() (Mode, error) {
+	mounts, err := setup.mountpoints()
+	if err != nil {
+		return Legacy, fmt.Errorf("read mountinfo: %w", err)
+	}
+
+	cgroupDir := setup.cgroupDir()
+
+	if fstype, found := mounts[cgroupDir]; found && fstype == "cgroup2" {
+		return Unified, nil
+	}
+
+	if fstype, found := mounts[filepath.Join(cgroupDir, "unified")]; found && fstype == "cgroup2" {
+		return Hybrid, nil
+	}
+
+	for mountpoint, fstype := range mounts {
+		if fstype == "cgroup" && filepath.Dir(mountpoint) == cgroupDir {
+			return Legacy, nil
+		}
+	}
+
+	var hasV1, hasV2 bool
+	err = setup.eachProcCgroup(func(hierarchy, controllers string) {
+		if hierarchy == "0" && controllers == "" {
+			hasV2 = true
+		} else {
+			hasV1 = true
+		}
+	})
+	if err != nil {
+		return Legacy, fmt.Errorf("read process cgroups: %w", err)
+	}
+
+	switch {
+	case hasV2 && !hasV1:
+		return Unified, nil
+	case hasV2 && hasV1:
+		return Hybrid, nil
+	default:
+		return Legacy, nil
+	}
+}
+
+// Status describes the cgroup setup, as inspected without modifying
+// anything.
+type Status struct {
+	Mode Mode
+
+	// Whether anything is mounted at /sys/fs/cgroup yet.
+	Mounted bool
+
+	// The enabled v1 subsystems (legacy and hybrid modes) or the v2
+	// controllers available at the root of the mounted unified hierarchy.
+	Controllers []string
+}
+
+// Status inspects the cgroup setup that Run would work with.
+func (setup Setup) Status() (Status, error) {
+	mounts, err := setup.mountpoints()
+	if err != nil {
+		return Status{}, fmt.Errorf("read mountinfo: %w", err)
+	}
+
+	mode, err := setup.DetectMode()
+	if err != nil {
+		return Status{}, fmt.Errorf("detect mode: %w", err)
+	}
+
+	_, mounted := mounts[setup.cgroupDir()]
+
+	status := Status{
+		Mode:    mode,
+		Mounted: mounted,
+	}
+
+	if mode == Unified {
+		if mounted {
+			controllers, err := ioutil.ReadFile(filepath.Join(setup.cgroupDir(), "cgroup.controllers"))
+			if err != nil {
+				return Status{}, fmt.Errorf("read controllers: %w", err)
+			}
+
+			status.Controllers = strings.Fields(string(controllers))
+		}
+	} else {
+		status.Controllers, err = setup.enabledSubsystems()
+		if err != nil {
+			return Status{}, fmt.Errorf("read subsystems: %w", err)
+		}
+	}
+
+	return status, nil
+}
+
+func (setup Setup) mountLegacy(mode Mode) error {
+	cgroupDir := setup.cgroupDir()
+
+	err := setup.mount("cgroup", cgroupDir, "tmpfs", "uid=0,gid=0,mode=0755")
+	if err != nil {
+		return err
+	}
+
+	groupings := map[string]string{}
+	err = setup.eachProcCgroup(func(hierarchy, controllers string) {
+		for _, sys := range strings.Split(controllers, ",") {
+			groupings[sys] = controllers
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("read process cgroups: %w", err)
+	}
+
+	subsystems, err := setup.enabledSubsystems()
+	if err != nil {
+		return fmt.Errorf("read subsystems: %w", err)
+	}
+
+	mounted := map[string]bool{}
+	for _, sys := range subsystems {
+		grouping, found := groupings[sys]
+		if !found {
+			// subsystem not mounted anywhere; mount it on its own
+			grouping = sys
+		}
+
+		if !mounted[grouping] {
+			err := setup.mount("cgroup", filepath.Join(cgroupDir, grouping), "cgroup", grouping)
+			if err != nil {
+				return err
+			}
+
+			mounted[grouping] = true
+		}
+
+		if grouping != sys {
+			link := filepath.Join(cgroupDir, sys)
+
+			err := os.RemoveAll(link)
+			if err != nil {
+				return fmt.Errorf("remove %s: %w", link, err)
+			}
+
+			err = os.Symlink(grouping, link)
+			if err != nil {
+				return fmt.Errorf("symlink %s: %w", link, err)
+			}
+		}
+	}
+
+	err = setup.mount("none", filepath.Join(cgroupDir, "systemd"), "cgroup", "none,name=systemd")
+	if err != nil {
+		return err
+	}
+
+	if mode == Hybrid {
+		err = setup.mount("cgroup2", filepath.Join(cgroupDir, "unified"), "cgroup2", "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// delegateControllers enables every available controller for child cgroups.
+//
+// cgroup v2 forbids a cgroup from both containing processes and delegating
+// controllers, so any processes in the root cgroup are first moved into a
+// child cgroup named init.
+func (setup Setup) delegateControllers() error {
+	cgroupDir := setup.cgroupDir()
+
+	available, err := ioutil.ReadFile(filepath.Join(cgroupDir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+
+	enabled, err := ioutil.ReadFile(filepath.Join(cgroupDir, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+
+	enabledControllers := map[string]bool{}
+	for _, controller := range strings.Fields(string(enabled)) {
+		enabledControllers[controller] = true
+	}
+
+	var toEnable []string
+	for _, controller := range strings.Fields(string(available)) {
+		if !enabledControllers[controller] {
+			toEnable = append(toEnable, "+"+controller)
+		}
+	}
+
+	if len(toEnable) == 0 {
+		return nil
+	}
+
+	err = setup.evacuateRootCgroup()
+	if err != nil {
+		if isPermissionError(err) {
+			logrus.Warnf("cannot delegate cgroup controllers: %s", err)
+			return nil
+		}
+
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(cgroupDir, "cgroup.subtree_control"), []byte(strings.Join(toEnable, " ")), 0644)
+	if err != nil {
+		if isPermissionError(err) {
+			logrus.Warnf("cannot delegate cgroup controllers: %s", err)
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// inRootCgroup checks whether the current process is in the root of the
+// unified hierarchy, i.e. it has its own cgroup namespace as in a container.
+// Otherwise the hierarchy belongs to the host (e.g. systemd), and delegation
+// is left up to it.
+func (setup Setup) inRootCgroup() bool {
+	var inRoot bool
+	err := eachLine(setup.procPath("self", "cgroup"), func(line string) {
+		if line == "0::/" {
+			inRoot = true
+		}
+	})
+
+	return err == nil && inRoot
+}
+
+func (setup Setup) evacuateRootCgroup() error {
+	cgroupDir := setup.cgroupDir()
+
+	procs, err := ioutil.ReadFile(filepath.Join(cgroupDir, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+
+	pids := strings.Fields(string(procs))
+	if len(pids) == 0 {
+		return nil
+	}
+
+	initDir := filepath.Join(cgroupDir, "init")
+
+	err = os.MkdirAll(initDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, pid := range pids {
+		// each pid must be written on its own; some (i.e. kernel threads)
+		// cannot be moved, which is fine
+		err := ioutil.WriteFile(filepath.Join(initDir, "cgroup.procs"), []byte(pid), 0644)
+		if err != nil {
+			logrus.Debugf("could not move pid %s to init cgroup: %s", pid, err)
+		}
+	}
+
+	return nil
+}
+
+func (setup Setup) mount(source, target, fstype, data string) error {
+	err := os.MkdirAll(target, 0755)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", target, err)
+	}
+
+	err = setup.Mounter.Mount(source, target, fstype, data)
+	if err != nil {
+		return fmt.Errorf("mount %s at %s: %w", fstype, target, err)
+	}
+
+	return nil
+}
+
+func (setup Setup) cgroupDir() string {
+	return filepath.Join(setup.Root, "sys", "fs", "cgroup")
+}
+
+func (setup Setup) procPath(path ...string) string {
+	return filepath.Join(append([]string{setup.Root, "proc"}, path...)...)
+}
+
+// mountpoints maps each mountpoint (relative to Root) to its filesystem type.
+func (setup Setup) mountpoints() (map[string]string, error) {
+	mounts := map[string]string{}
+
+	err := eachLine(setup.procPath("self", "mountinfo"), func(line string) {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		segs := strings.SplitN(line, " - ", 2)
+		if len(segs) != 2 {
+			return
+		}
+
+		fields := strings.Fields(segs[0])
+		optionalFields := strings.Fields(segs[1])
+		if len(fields) < 5 || len(optionalFields) < 1 {
+			return
+		}
+
+		mounts[filepath.Join(setup.Root, fields[4])] = optionalFields[0]
+	})
+
+	return mounts, err
+}
+
+// eachProcCgroup calls fn with the hierarchy ID and controller list of each
+// cgroup the current process belongs to, skipping named hierarchies.
+func (setup Setup) eachProcCgroup(fn func(hierarchy, controllers string)) error {
+	return eachLine(setup.procPath("self", "cgroup"), func(line string) {
+		// 4:cpu,cpuacct:/some/path
+		segs := strings.SplitN(line, ":", 3)
+		if len(segs) != 3 || strings.HasPrefix(segs[1], "name=") {
+			return
+		}
+
+		fn(segs[0], segs[1])
+	})
+}
+
+// enabledSubsystems lists the enabled v1 subsystems from /proc/cgroups.
+func (setup Setup) enabledSubsystems() ([]string, error) {
+	var subsystems []string
+
+	err := eachLine(setup.procPath("cgroups"), func(line string) {
+		// #subsys_name	hierarchy	num_cgroups	enabled
+		if strings.HasPrefix(line, "#") {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[3] != "1" {
+			return
+		}
+
+		subsystems = append(subsystems, fields[0])
+	})
+
+	return subsystems, err
+}
+
+func eachLine(path string, fn func(string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+
+	return scanner.Err()
+}
+
+func isPermissionError(err error) bool {
+	return os.IsPermission(err) || errors.Is(err, syscall.EROFS)
+}
@@ -0,0 +1,252 @@
+package cgroups_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/aoldershaw/oci-image-prototype/cgroups"
+)
+
+type CgroupsSuite struct {
+	suite.Suite
+	*require.Assertions
+
+	root    string
+	mounter *fakeMounter
+}
+
+type mount struct {
+	Source string
+	Target string
+	FSType string
+	Data   string
+}
+
+type fakeMounter struct {
+	mounts []mount
+}
+
+func (m *fakeMounter) Mount(source, target, fstype, data string) error {
+	m.mounts = append(m.mounts, mount{source, target, fstype, data})
+
+	if fstype == "cgroup2" {
+		// pretend to be the kernel
+		files := map[string]string{
+			"cgroup.controllers":     "cpu memory pids\n",
+			"cgroup.subtree_control": "",
+			"cgroup.procs":           "1\n",
+		}
+
+		for name, content := range files {
+			err := ioutil.WriteFile(filepath.Join(target, name), []byte(content), 0644)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *CgroupsSuite) SetupTest() {
+	var err error
+	s.root, err = ioutil.TempDir("", "cgroups-test")
+	s.NoError(err)
+
+	s.mounter = &fakeMounter{}
+}
+
+func (s *CgroupsSuite) TearDownTest() {
+	err := os.RemoveAll(s.root)
+	s.NoError(err)
+}
+
+func (s *CgroupsSuite) TestDetectMode() {
+	for fixture, expected := range map[string]cgroups.Mode{
+		"legacy":          cgroups.Legacy,
+		"legacy-mounted":  cgroups.Legacy,
+		"hybrid":          cgroups.Hybrid,
+		"unified":         cgroups.Unified,
+		"unified-mounted": cgroups.Unified,
+	} {
+		s.loadFixture(fixture)
+
+		mode, err := s.setup().DetectMode()
+		s.NoError(err)
+		s.Equal(expected, mode, fixture)
+	}
+}
+
+func (s *CgroupsSuite) TestLegacy() {
+	s.loadFixture("legacy")
+
+	err := s.setup().Run()
+	s.NoError(err)
+
+	s.Equal([]mount{
+		{"cgroup", s.cgroupPath(), "tmpfs", "uid=0,gid=0,mode=0755"},
+		{"cgroup", s.cgroupPath("cpuset"), "cgroup", "cpuset"},
+		{"cgroup", s.cgroupPath("cpu,cpuacct"), "cgroup", "cpu,cpuacct"},
+		{"cgroup", s.cgroupPath("blkio"), "cgroup", "blkio"},
+		{"cgroup", s.cgroupPath("memory"), "cgroup", "memory"},
+		{"cgroup", s.cgroupPath("devices"), "cgroup", "devices"},
+		{"cgroup", s.cgroupPath("freezer"), "cgroup", "freezer"},
+		{"cgroup", s.cgroupPath("net_cls,net_prio"), "cgroup", "net_cls,net_prio"},
+		{"cgroup", s.cgroupPath("perf_event"), "cgroup", "perf_event"},
+		{"cgroup", s.cgroupPath("pids"), "cgroup", "pids"},
+		{"none", s.cgroupPath("systemd"), "cgroup", "none,name=systemd"},
+	}, s.mounter.mounts)
+
+	for sys, grouping := range map[string]string{
+		"cpu":      "cpu,cpuacct",
+		"cpuacct":  "cpu,cpuacct",
+		"net_cls":  "net_cls,net_prio",
+		"net_prio": "net_cls,net_prio",
+	} {
+		link, err := os.Readlink(s.cgroupPath(sys))
+		s.NoError(err)
+		s.Equal(grouping, link)
+	}
+}
+
+func (s *CgroupsSuite) TestLegacyMounted() {
+	s.loadFixture("legacy-mounted")
+
+	err := s.setup().Run()
+	s.NoError(err)
+
+	s.Empty(s.mounter.mounts)
+}
+
+func (s *CgroupsSuite) TestHybrid() {
+	s.loadFixture("hybrid")
+
+	err := s.setup().Run()
+	s.NoError(err)
+
+	s.Contains(s.mounter.mounts, mount{"cgroup", s.cgroupPath("memory"), "cgroup", "memory"})
+	s.Equal(mount{"cgroup2", s.cgroupPath("unified"), "cgroup2", ""}, s.mounter.mounts[len(s.mounter.mounts)-1])
+}
+
+func (s *CgroupsSuite) TestUnified() {
+	s.loadFixture("unified")
+
+	err := s.setup().Run()
+	s.NoError(err)
+
+	s.Equal([]mount{
+		{"cgroup2", s.cgroupPath(), "cgroup2", ""},
+	}, s.mounter.mounts)
+
+	s.Equal("+cpu +memory +pids", s.readCgroupFile("cgroup.subtree_control"))
+	s.Equal("1", s.readCgroupFile("init", "cgroup.procs"))
+}
+
+func (s *CgroupsSuite) TestUnifiedMounted() {
+	s.loadFixture("unified-mounted")
+
+	err := s.setup().Run()
+	s.NoError(err)
+
+	s.Empty(s.mounter.mounts)
+
+	s.Equal("+cpuset +cpu +io +memory +hugetlb +pids", s.readCgroupFile("cgroup.subtree_control"))
+
+	// pids are written one at a time, so the fake file only has the last one
+	s.Equal("42", s.readCgroupFile("init", "cgroup.procs"))
+}
+
+func (s *CgroupsSuite) TestUnifiedAlreadyDelegated() {
+	s.loadFixture("unified-mounted")
+
+	err := ioutil.WriteFile(s.cgroupPath("cgroup.subtree_control"), []byte("cpuset cpu io memory hugetlb pids\n"), 0644)
+	s.NoError(err)
+
+	err = s.setup().Run()
+	s.NoError(err)
+
+	_, err = os.Stat(s.cgroupPath("init"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *CgroupsSuite) TestUnifiedOutsideNamespace() {
+	s.loadFixture("unified-mounted")
+
+	err := ioutil.WriteFile(filepath.Join(s.root, "proc", "self", "cgroup"), []byte("0::/user.slice/user-1000.slice/session-1.scope\n"), 0644)
+	s.NoError(err)
+
+	err = s.setup().Run()
+	s.NoError(err)
+
+	s.Equal("\n", s.readCgroupFile("cgroup.subtree_control"))
+}
+
+func (s *CgroupsSuite) TestStatus() {
+	s.loadFixture("unified-mounted")
+
+	status, err := s.setup().Status()
+	s.NoError(err)
+	s.Equal(cgroups.Status{
+		Mode:        cgroups.Unified,
+		Mounted:     true,
+		Controllers: []string{"cpuset", "cpu", "io", "memory", "hugetlb", "pids"},
+	}, status)
+
+	s.loadFixture("unified")
+
+	status, err = s.setup().Status()
+	s.NoError(err)
+	s.Equal(cgroups.Status{Mode: cgroups.Unified}, status)
+
+	s.loadFixture("legacy")
+
+	status, err = s.setup().Status()
+	s.NoError(err)
+	s.Equal(cgroups.Legacy, status.Mode)
+	s.False(status.Mounted)
+	s.NotEmpty(status.Controllers)
+	s.Empty(s.mounter.mounts)
+}
+
+func (s *CgroupsSuite) setup() cgroups.Setup {
+	return cgroups.Setup{
+		Root:    s.root,
+		Mounter: s.mounter,
+	}
+}
+
+func (s *CgroupsSuite) loadFixture(name string) {
+	err := os.RemoveAll(s.root)
+	s.NoError(err)
+
+	err = os.MkdirAll(s.root, 0755)
+	s.NoError(err)
+
+	err = exec.Command("cp", "-R", filepath.Join("testdata", name)+"/.", s.root).Run()
+	s.NoError(err)
+
+	s.mounter.mounts = nil
+}
+
+func (s *CgroupsSuite) cgroupPath(path ...string) string {
+	return filepath.Join(append([]string{s.root, "sys", "fs", "cgroup"}, path...)...)
+}
+
+func (s *CgroupsSuite) readCgroupFile(path ...string) string {
+	content, err := ioutil.ReadFile(s.cgroupPath(path...))
+	s.NoError(err)
+
+	return string(content)
+}
+
+func TestCgroups(t *testing.T) {
+	suite.Run(t, &CgroupsSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -0,0 +1,426 @@
+package prototype
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// LocalOpts configures a build run outside of Concourse.
+type LocalOpts struct {
+	// Directory to write outputs to. The image is written to 'image/' (and
+	// each additional target to '<target>/') and the cache to 'cache/'.
+	OutputDir string
+
+	// Address of an already running buildkitd to use instead of spawning
+	// one.
+	BuildkitdAddr string
+
+	// Root dir for the spawned buildkitd. See BuildkitdOpts.
+	BuildkitdRootDir string
+}
+
+// ParseBuildFlags parses the flags for a local build into the OCIImage to
+// build and the LocalOpts to build it with. Parse errors and usage are
+// written to output.
+//
+// Every OCIImage field has a flag, except for those which map Concourse
+// inputs and outputs (Output and ContextInputs).
+func ParseBuildFlags(args []string, output io.Writer) (OCIImage, LocalOpts, error) {
+	img := OCIImage{
+		Output: "image",
+	}
+
+	opts := LocalOpts{}
+
+	gc := GCConfig{}
+	policy := Policy{}
+	var addHosts []string
+
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: prototype build [flags]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Builds an image locally, without Concourse.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&opts.OutputDir, "output", "output", "directory to write the image, per-target images and cache to")
+	fs.StringVar(&opts.BuildkitdAddr, "addr", "", "address of a running buildkitd to use instead of spawning one")
+	fs.StringVar(&opts.BuildkitdRootDir, "buildkitd-root", "", "root dir for the spawned buildkitd")
+
+	fs.BoolVar(&img.Debug, "debug", false, "log debug output, including buildkitd's logs")
+	fs.BoolVar(&img.DryRun, "dry-run", false, "print the build plan instead of building")
+	fs.StringVar(&img.PlanFormat, "plan-format", "", "format of the build plan: text or json (default: text)")
+	fs.StringVar(&img.EventLog, "event-log", "", "write a JSON event log to stderr, or to a `file` in image/")
+	fs.BoolVar(&img.Trace, "trace", false, "write an OTLP JSON trace to image/trace.json")
+	fs.StringVar(&img.TraceEndpoint, "trace-endpoint", "", "OTLP/HTTP `url` to also export the trace to (implies --trace)")
+
+	fs.StringVar(&img.ContextDir, "context", ".", "build context directory or tarball")
+	fs.StringVar(&img.ContextRef, "context-ref", "", "git ref to build the context repository at")
+	fs.StringVar(&img.DockerfilePath, "dockerfile", "", "path to the Dockerfile (default: Dockerfile in the context)")
+	fs.Var(mapFlag{&img.BuildContexts}, "build-context", "named build context, as `name=dir|image.tar|docker-image://ref` (repeatable)")
+
+	fs.StringVar(&img.Target, "target", "", "target stage to build")
+	fs.Var(stringsFlag{&img.AdditionalTargets}, "additional-target", "additional `target` stage to build and output (repeatable)")
+	fs.Var(stringsFlag{&img.BuildArgs}, "build-arg", "build arg, as `key=value` (repeatable)")
+	fs.Var(stringsFlag{&img.Labels}, "label", "image label, as `key=value` (repeatable)")
+	fs.Var(stringsFlag{&img.ImageArgs}, "image-arg", "pre-load an image tarball into a build arg, as `arg=path` (repeatable)")
+	fs.Var(stringsFlag{&addHosts}, "add-host", "add a host to /etc/hosts, as `host=ip` (repeatable)")
+	fs.Var(stringsFlag{&img.RegistryMirrors}, "registry-mirror", "docker.io mirror `host` (repeatable)")
+
+	fs.BoolVar(&img.Cache, "cache", false, "export to and import from the local cache in the output directory")
+	fs.Int64Var(&img.CacheMaxSize, "cache-max-size", 0, "maximum size (in MB) of the local cache")
+	fs.Var(stringsFlag{&img.CacheFrom}, "cache-from", "registry `ref` to import cache from (repeatable)")
+	fs.StringVar(&img.CacheTo, "cache-to", "", "registry ref to export cache to")
+	fs.BoolVar(&img.InlineCache, "inline-cache", false, "embed cache metadata in the image")
+	fs.StringVar(&img.CacheMode, "cache-mode", "", "cache export mode: min or max (default: min)")
+
+	fs.Var(mapFlag{&img.BuildkitSecrets}, "secret", "secret read from a file, as `id=path` (repeatable)")
+	fs.Var(mapFlag{&img.BuildkitSecretEnvs}, "secret-env", "secret read from an environment variable, as `id=VAR` (repeatable)")
+	fs.Var(mapFlag{&img.BuildkitSecretValues}, "secret-value", "inline secret, as `id=value` (repeatable)")
+	fs.Var(multiMapFlag{&img.SSH}, "ssh", "private key to serve over SSH agent, as `id=path` (repeatable)")
+
+	fs.BoolVar(&img.UnpackRootfs, "unpack-rootfs", false, "unpack the image into rootfs/ and metadata.json")
+	fs.BoolVar(&img.SBOM, "sbom", false, "write an SPDX SBOM of each image to sbom.spdx.json")
+	fs.BoolVar(&img.Provenance, "provenance", false, "write SLSA provenance of each image to provenance.json")
+	fs.StringVar(&img.SigningKey, "signing-key", "", "sign each image with the PEM private key at `path`")
+	fs.StringVar(&img.SigningKeyEnv, "signing-key-env", "", "sign each image with the PEM private key in environment variable `VAR`")
+	fs.StringVar(&img.SignatureRepository, "signature-repository", "", "push each signature to this `repository` as cosign does")
+	fs.StringVar(&img.ImageArgsPublicKey, "image-args-public-key", "", "verify image args' signatures with the PEM public key at `path`")
+	fs.StringVar(&img.ProvenanceRepository, "provenance-repository", "", "attach the provenance to the image in this `repository` (implies --provenance)")
+
+	fs.BoolVar(&img.Reproducible, "reproducible", false, "normalize timestamps so that the digest only depends on the content")
+	fs.Var(int64PtrFlag{&img.SourceDateEpoch}, "source-date-epoch", "SOURCE_DATE_EPOCH `seconds` for a reproducible build (default: git commit time)")
+
+	fs.Var(stringsFlag{&policy.AllowedRegistries}, "allowed-registry", "policy: `registry` base images may be pulled from, unless pinned by digest (repeatable)")
+	fs.BoolVar(&policy.NonRootUser, "non-root-user", false, "policy: the image must not run as root")
+	fs.Var(stringsFlag{&policy.RequiredLabels}, "required-label", "policy: `label` the image must set (repeatable)")
+	fs.Int64Var(&policy.MaxSize, "max-size", 0, "policy: maximum compressed size (in MB) of the image")
+	fs.IntVar(&policy.MaxLayers, "max-layers", 0, "policy: maximum number of layers in the image")
+	fs.BoolVar(&policy.NoWorldWritable, "no-world-writable", false, "policy: the image must not contain world-writable files")
+
+	fs.Int64Var(&gc.KeepStorage, "gc-keep-storage", 0, "storage (in MB) for buildkitd to keep after garbage collection")
+	fs.Var(gcPolicyFlag{&gc.Policies}, "gc-policy", "buildkitd garbage collection policy, as `json` (repeatable)")
+	fs.StringVar(&img.Worker, "worker", "", "buildkitd worker: oci or containerd (default: oci)")
+	fs.StringVar(&img.ContainerdAddress, "containerd-address", "", "containerd socket address for the containerd worker")
+	fs.StringVar(&img.Snapshotter, "snapshotter", "", "snapshotter, e.g. overlayfs, native or fuse-overlayfs (default: auto)")
+	fs.StringVar(&img.Runtime, "runtime", "", "OCI runtime binary for the oci worker, e.g. crun (default: runc)")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return OCIImage{}, LocalOpts{}, err
+	}
+
+	if fs.NArg() > 0 {
+		err := fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return OCIImage{}, LocalOpts{}, err
+	}
+
+	img.AddHosts = strings.Join(addHosts, ",")
+
+	if gc.KeepStorage != 0 || len(gc.Policies) > 0 {
+		img.GC = &gc
+	}
+
+	if !reflect.DeepEqual(policy, Policy{}) {
+		img.Policy = &policy
+	}
+
+	return img, opts, nil
+}
+
+// ParseDoctorFlags parses the flags for checking the environment into the
+// OCIImage whose buildkitd configuration is checked for.
+func ParseDoctorFlags(args []string, output io.Writer) (OCIImage, error) {
+	var img OCIImage
+
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: prototype doctor [flags]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Checks the prerequisites for running buildkitd.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&img.Worker, "worker", "", "buildkitd worker: oci or containerd (default: oci)")
+	fs.StringVar(&img.ContainerdAddress, "containerd-address", "", "containerd socket address for the containerd worker")
+	fs.StringVar(&img.Snapshotter, "snapshotter", "", "snapshotter, e.g. overlayfs, native or fuse-overlayfs (default: auto)")
+	fs.StringVar(&img.Runtime, "runtime", "", "OCI runtime binary for the oci worker, e.g. crun (default: runc)")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return OCIImage{}, err
+	}
+
+	if fs.NArg() > 0 {
+		err := fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return OCIImage{}, err
+	}
+
+	return img, nil
+}
+
+// ParseScanFlags parses the flags for scanning locally built images into the
+// OCIImage to scan and the LocalOpts giving the output directory the images
+// were built to.
+func ParseScanFlags(args []string, output io.Writer) (OCIImage, LocalOpts, error) {
+	img := OCIImage{
+		Output: "image",
+	}
+
+	opts := LocalOpts{}
+	scan := VulnerabilityScan{}
+
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: prototype scan [flags]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Scans locally built images for vulnerabilities, without network access.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&opts.OutputDir, "output", "output", "directory the image and per-target images were built to")
+	fs.Var(stringsFlag{&img.AdditionalTargets}, "additional-target", "additional `target` stage to scan (repeatable)")
+	fs.StringVar(&scan.Database, "database", "", "`dir` of OSV advisories to match packages against")
+	fs.StringVar(&scan.FailOn, "fail-on", "", "fail on vulnerabilities of this `severity` or higher: unknown, low, medium, high or critical")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return OCIImage{}, LocalOpts{}, err
+	}
+
+	if fs.NArg() > 0 {
+		err := fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return OCIImage{}, LocalOpts{}, err
+	}
+
+	img.Scan = &scan
+
+	return img, opts, nil
+}
+
+// RunLocalBuild builds the image, spawning buildkitd unless an address is
+// given. For a dry run, the plan is printed to stdout instead.
+func RunLocalBuild(img OCIImage, opts LocalOpts) (err error) {
+	sanitize(&img)
+
+	err = img.Validate()
+	if err != nil {
+		return errors.Wrap(err, "config")
+	}
+
+	outputDirs := []string{filepath.Join(opts.OutputDir, finalOutput)}
+	for _, target := range img.AdditionalTargets {
+		outputDirs = append(outputDirs, filepath.Join(opts.OutputDir, target))
+	}
+
+	if img.Cache {
+		outputDirs = append(outputDirs, filepath.Join(opts.OutputDir, "cache"))
+	}
+
+	if img.DryRun {
+		// plan as if the output dirs had been created
+		plan, err := planBuild(img, opts.OutputDir, func(dir string) bool {
+			return containsString(outputDirs, dir) || dirExists(dir)
+		})
+		if err != nil {
+			return err
+		}
+
+		return plan.Write(os.Stdout, img.PlanFormat)
+	}
+
+	for _, dir := range outputDirs {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return errors.Wrap(err, "create output dir")
+		}
+	}
+
+	events, err := OpenEventLog(img.EventLog, filepath.Join(opts.OutputDir, finalOutput))
+	if err != nil {
+		return errors.Wrap(err, "open event log")
+	}
+
+	defer events.Close()
+
+	tracer := startTrace(img)
+	defer func() {
+		finishTrace(tracer, img, filepath.Join(opts.OutputDir, finalOutput), err)
+	}()
+
+	var buildkitd *Buildkitd
+	if opts.BuildkitdAddr != "" {
+		buildkitd, err = ConnectBuildkitd(opts.BuildkitdAddr, events)
+		if err != nil {
+			return errors.Wrap(err, "connect to buildkitd")
+		}
+
+		buildkitd.tracer = tracer
+	} else {
+		buildkitdOpts := img.buildkitdOpts()
+		buildkitdOpts.RootDir = opts.BuildkitdRootDir
+		buildkitdOpts.Events = events
+		buildkitdOpts.Tracer = tracer
+
+		buildkitd, err = SpawnBuildkitd(img, &buildkitdOpts)
+		if err != nil {
+			return errors.Wrap(err, "start buildkitd")
+		}
+	}
+
+	defer func() {
+		cleanupErr := buildkitd.Cleanup()
+		if cleanupErr == nil {
+			return
+		}
+
+		if err != nil {
+			logrus.Warn("failed to cleanup buildkitd:", cleanupErr)
+			return
+		}
+
+		err = errors.Wrap(cleanupErr, "cleanup buildkitd")
+	}()
+
+	return Build(img, buildkitd, opts.OutputDir)
+}
+
+// RunLocalScan scans the images built to the output directory.
+func RunLocalScan(img OCIImage, opts LocalOpts) error {
+	return Scan(img, opts.OutputDir)
+}
+
+// stringsFlag is a repeatable flag which appends to a slice.
+type stringsFlag struct {
+	values *[]string
+}
+
+func (f stringsFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+
+	return strings.Join(*f.values, ",")
+}
+
+func (f stringsFlag) Set(value string) error {
+	*f.values = append(*f.values, value)
+	return nil
+}
+
+// mapFlag is a repeatable 'key=value' flag which sets a key in a map.
+type mapFlag struct {
+	values *map[string]string
+}
+
+func (f mapFlag) String() string {
+	return ""
+}
+
+func (f mapFlag) Set(value string) error {
+	segs := strings.SplitN(value, "=", 2)
+	if len(segs) != 2 {
+		return fmt.Errorf("expected key=value: %s", value)
+	}
+
+	if *f.values == nil {
+		*f.values = map[string]string{}
+	}
+
+	(*f.values)[segs[0]] = segs[1]
+
+	return nil
+}
+
+// multiMapFlag is a repeatable 'key=value' flag which appends to a key in a
+// map.
+type multiMapFlag struct {
+	values *map[string][]string
+}
+
+func (f multiMapFlag) String() string {
+	return ""
+}
+
+func (f multiMapFlag) Set(value string) error {
+	segs := strings.SplitN(value, "=", 2)
+	if len(segs) != 2 {
+		return fmt.Errorf("expected key=value: %s", value)
+	}
+
+	if *f.values == nil {
+		*f.values = map[string][]string{}
+	}
+
+	(*f.values)[segs[0]] = append((*f.values)[segs[0]], segs[1])
+
+	return nil
+}
+
+// int64PtrFlag is a flag for an optional int64.
+type int64PtrFlag struct {
+	value **int64
+}
+
+func (f int64PtrFlag) String() string {
+	if f.value == nil || *f.value == nil {
+		return ""
+	}
+
+	return strconv.FormatInt(**f.value, 10)
+}
+
+func (f int64PtrFlag) Set(value string) error {
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	*f.value = &i
+
+	return nil
+}
+
+// gcPolicyFlag is a repeatable flag which appends a GCPolicy given as JSON.
+type gcPolicyFlag struct {
+	policies *[]GCPolicy
+}
+
+func (f gcPolicyFlag) String() string {
+	return ""
+}
+
+func (f gcPolicyFlag) Set(value string) error {
+	var policy GCPolicy
+	err := json.Unmarshal([]byte(value), &policy)
+	if err != nil {
+		return err
+	}
+
+	*f.policies = append(*f.policies, policy)
+
+	return nil
+}
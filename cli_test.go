@@ -0,0 +1,176 @@
+package prototype_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type CLISuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *CLISuite) TestParseBuildFlags() {
+	img, opts, err := prototype.ParseBuildFlags([]string{
+		"--context", "testdata/multi-target",
+		"--output", "some-output",
+		"--addr", "unix:///some/buildkitd.sock",
+		"--target", "final",
+		"--additional-target", "first",
+		"--additional-target", "second",
+		"--build-arg", "some_arg=some=value",
+		"--label", "some_label=some_value",
+		"--image-arg", "some_image=some-image.tar",
+		"--add-host", "some-host=10.0.0.1",
+		"--add-host", "other-host=10.0.0.2",
+		"--build-context", "assets=some-assets",
+		"--cache",
+		"--cache-from", "some-registry/cache",
+		"--cache-mode", "max",
+		"--secret", "some_secret=some-file",
+		"--secret-env", "env_secret=SOME_ENV",
+		"--secret-value", "value_secret=hunter2",
+		"--ssh", "default=some-key",
+		"--ssh", "default=other-key",
+		"--reproducible",
+		"--sbom",
+		"--provenance",
+		"--allowed-registry", "docker.io",
+		"--allowed-registry", "registry.example.com",
+		"--non-root-user",
+		"--required-label", "some_label",
+		"--max-size", "512",
+		"--max-layers", "20",
+		"--no-world-writable",
+		"--signing-key", "cosign.key",
+		"--signature-repository", "some-registry/signatures",
+		"--image-args-public-key", "cosign.pub",
+		"--provenance-repository", "some-registry/attestations",
+		"--source-date-epoch", "1234",
+		"--gc-keep-storage", "1024",
+		"--gc-policy", `{"all":true,"keep_bytes":512}`,
+		"--worker", "containerd",
+		"--dry-run",
+		"--plan-format", "json",
+		"--event-log", "stderr",
+		"--trace",
+		"--trace-endpoint", "http://collector:4318",
+	}, ioutil.Discard)
+	s.NoError(err)
+
+	epoch := int64(1234)
+
+	s.Equal(prototype.OCIImage{
+		ContextDir:        "testdata/multi-target",
+		Output:            "image",
+		Target:            "final",
+		AdditionalTargets: []string{"first", "second"},
+		BuildArgs:         []string{"some_arg=some=value"},
+		Labels:            []string{"some_label=some_value"},
+		ImageArgs:         []string{"some_image=some-image.tar"},
+		AddHosts:          "some-host=10.0.0.1,other-host=10.0.0.2",
+		BuildContexts:     map[string]string{"assets": "some-assets"},
+		Cache:             true,
+		CacheFrom:         []string{"some-registry/cache"},
+		CacheMode:         "max",
+		BuildkitSecrets:   map[string]string{"some_secret": "some-file"},
+		BuildkitSecretEnvs: map[string]string{
+			"env_secret": "SOME_ENV",
+		},
+		BuildkitSecretValues: map[string]string{
+			"value_secret": "hunter2",
+		},
+		SSH:             map[string][]string{"default": {"some-key", "other-key"}},
+		Reproducible:    true,
+		SBOM:            true,
+		SourceDateEpoch: &epoch,
+		GC: &prototype.GCConfig{
+			KeepStorage: 1024,
+			Policies:    []prototype.GCPolicy{{All: true, KeepBytes: 512}},
+		},
+		Worker:        prototype.WorkerContainerd,
+		DryRun:        true,
+		PlanFormat:    prototype.PlanFormatJSON,
+		EventLog:      prototype.EventLogStderr,
+		Trace:         true,
+		TraceEndpoint: "http://collector:4318",
+
+		Provenance:           true,
+		ProvenanceRepository: "some-registry/attestations",
+
+		SigningKey:          "cosign.key",
+		SignatureRepository: "some-registry/signatures",
+		ImageArgsPublicKey:  "cosign.pub",
+
+		Policy: &prototype.Policy{
+			AllowedRegistries: []string{"docker.io", "registry.example.com"},
+			NonRootUser:       true,
+			RequiredLabels:    []string{"some_label"},
+			MaxSize:           512,
+			MaxLayers:         20,
+			NoWorldWritable:   true,
+		},
+	}, img)
+
+	s.Equal(prototype.LocalOpts{
+		OutputDir:     "some-output",
+		BuildkitdAddr: "unix:///some/buildkitd.sock",
+	}, opts)
+}
+
+func (s *CLISuite) TestParseBuildFlagsDefaults() {
+	img, opts, err := prototype.ParseBuildFlags(nil, ioutil.Discard)
+	s.NoError(err)
+
+	s.Equal(prototype.OCIImage{
+		ContextDir: ".",
+		Output:     "image",
+	}, img)
+
+	s.Equal(prototype.LocalOpts{
+		OutputDir: "output",
+	}, opts)
+}
+
+func (s *CLISuite) TestParseBuildFlagsInvalid() {
+	_, _, err := prototype.ParseBuildFlags([]string{"--secret", "no-value"}, ioutil.Discard)
+	s.EqualError(err, `invalid value "no-value" for flag -secret: expected key=value: no-value`)
+
+	_, _, err = prototype.ParseBuildFlags([]string{"some-arg"}, ioutil.Discard)
+	s.EqualError(err, "unexpected arguments: some-arg")
+}
+
+func (s *CLISuite) TestParseScanFlags() {
+	img, opts, err := prototype.ParseScanFlags([]string{
+		"--output", "some-output",
+		"--additional-target", "some-target",
+		"--database", "some-osv",
+		"--fail-on", "high",
+	}, ioutil.Discard)
+	s.NoError(err)
+
+	s.Equal(prototype.OCIImage{
+		Output:            "image",
+		AdditionalTargets: []string{"some-target"},
+		Scan: &prototype.VulnerabilityScan{
+			Database: "some-osv",
+			FailOn:   "high",
+		},
+	}, img)
+
+	s.Equal(prototype.LocalOpts{OutputDir: "some-output"}, opts)
+
+	_, _, err = prototype.ParseScanFlags([]string{"some-arg"}, ioutil.Discard)
+	s.EqualError(err, "unexpected arguments: some-arg")
+}
+
+func TestCLI(t *testing.T) {
+	suite.Run(t, &CLISuite{
+		Assertions: require.New(t),
+	})
+}
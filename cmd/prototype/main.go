@@ -1,12 +1,133 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
 	prototype "github.com/aoldershaw/oci-image-prototype"
 	"github.com/sirupsen/logrus"
 )
 
+// exit codes for local builds and checks
+const (
+	exitBuildFailed = 1
+	exitUsage       = 2
+)
+
 func main() {
+	// with flags, or from a terminal, build locally rather than speaking
+	// the prototype protocol over stdin
+	if len(os.Args) > 1 && os.Args[1] == "build" && (len(os.Args) > 2 || isTerminal(os.Stdin)) {
+		os.Exit(buildLocally(os.Args[2:]))
+	}
+
+	// likewise for doctor, which can also be run without any flags from a
+	// terminal
+	if len(os.Args) > 1 && os.Args[1] == "doctor" && (len(os.Args) > 2 || isTerminal(os.Stdin)) {
+		os.Exit(doctorLocally(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "scan" && (len(os.Args) > 2 || isTerminal(os.Stdin)) {
+		os.Exit(scanLocally(os.Args[2:]))
+	}
+
 	if err := prototype.Prototype().Run(); err != nil {
 		logrus.Fatal(err)
 	}
 }
+
+func buildLocally(args []string) int {
+	// a bare run from a terminal has nothing to go on
+	if len(args) == 0 {
+		prototype.ParseBuildFlags([]string{"-help"}, os.Stderr)
+		return exitUsage
+	}
+
+	img, opts, err := prototype.ParseBuildFlags(args, os.Stderr)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+
+		return exitUsage
+	}
+
+	err = prototype.RunLocalBuild(img, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+
+		var validationErr prototype.ValidationError
+		if errors.As(err, &validationErr) {
+			return exitUsage
+		}
+
+		return exitBuildFailed
+	}
+
+	return 0
+}
+
+func scanLocally(args []string) int {
+	// a bare run from a terminal has nothing to go on
+	if len(args) == 0 {
+		prototype.ParseScanFlags([]string{"-help"}, os.Stderr)
+		return exitUsage
+	}
+
+	img, opts, err := prototype.ParseScanFlags(args, os.Stderr)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+
+		return exitUsage
+	}
+
+	err = prototype.RunLocalScan(img, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+
+		var validationErr prototype.ValidationError
+		if errors.As(err, &validationErr) {
+			return exitUsage
+		}
+
+		return exitBuildFailed
+	}
+
+	return 0
+}
+
+func doctorLocally(args []string) int {
+	img, err := prototype.ParseDoctorFlags(args, os.Stderr)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+
+		return exitUsage
+	}
+
+	checks := prototype.NewDoctor().Check(img)
+
+	err = prototype.WriteDoctorChecks(os.Stdout, checks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exitBuildFailed
+	}
+
+	err = prototype.DoctorError(checks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return exitBuildFailed
+	}
+
+	return 0
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
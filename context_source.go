@@ -0,0 +1,117 @@
+package prototype
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// isStreamedContext returns whether the context is streamed to BuildKit over
+// HTTP rather than synced from a directory, i.e. it's a tarball or a git ref.
+func isStreamedContext(img OCIImage) bool {
+	return img.ContextRef != "" || isContextArchive(img.ContextDir)
+}
+
+// isContextArchive returns whether the context is a tarball to be streamed
+// to BuildKit rather than a directory.
+func isContextArchive(path string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveContext serves the context over HTTP so that BuildKit fetches and
+// unpacks it itself, and returns the URL to pass as the 'context' frontend
+// option. Nothing is extracted to disk: a tarball is streamed as-is, and a
+// git ref is streamed from 'git archive', which excludes .git.
+//
+// It is served until the returned closer is closed.
+func serveContext(img OCIImage) (string, io.Closer, error) {
+	var handler http.Handler
+	if img.ContextRef != "" {
+		commit, err := resolveCommit(img.ContextDir, img.ContextRef)
+		if err != nil {
+			return "", nil, err
+		}
+
+		logrus.Infof("building %s at %s", img.ContextDir, commit)
+
+		handler = gitArchiveHandler(img.ContextDir, commit)
+	} else {
+		archive := img.ContextDir
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, archive)
+		})
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("listen: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/context", handler)
+
+	go http.Serve(listener, mux)
+
+	return "http://" + listener.Addr().String() + "/context", listener, nil
+}
+
+// resolveCommit resolves the ref to a commit in the repository at repoDir.
+func resolveCommit(repoDir string, ref string) (string, error) {
+	buf := new(bytes.Buffer)
+	errBuf := new(bytes.Buffer)
+
+	cmd := exec.Command("git", "-C", repoDir, "rev-parse", "--verify", ref+"^{commit}")
+	cmd.Stdout = buf
+	cmd.Stderr = errBuf
+
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("resolve ref %s in %s: %w: %s", ref, repoDir, err, strings.TrimSpace(errBuf.String()))
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func gitArchiveHandler(repoDir string, commit string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-tar")
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		errBuf := new(bytes.Buffer)
+
+		cmd := exec.Command("git", "-C", repoDir, "archive", "--format=tar", commit)
+		cmd.Stdout = w
+		cmd.Stderr = errBuf
+
+		err := cmd.Run()
+		if err != nil {
+			logrus.Errorf("git archive %s: %s: %s", commit, err, strings.TrimSpace(errBuf.String()))
+			return
+		}
+	})
+}
+
+// contextInputName is the name of the input the context is read from.
+func contextInputName(img OCIImage) string {
+	if isContextArchive(img.ContextDir) {
+		return inputName(filepath.Dir(img.ContextDir))
+	}
+
+	return img.ContextDir
+}
@@ -0,0 +1,106 @@
+package prototype
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	prototype "github.com/aoldershaw/prototype-sdk-go"
+)
+
+// dockerImagePrefix marks a build context which refers to an image in a
+// registry.
+const dockerImagePrefix = "docker-image://"
+
+// namedContextArgs returns the buildctl flags for passing each named build
+// context to the dockerfile frontend as a 'context:<name>' option.
+//
+// Directories are passed as locals, 'docker-image://' refs are passed as-is,
+// and OCI image tarballs are referred to in the local registry listening on
+// the given port, which serves namedContextImages.
+func namedContextArgs(contexts map[string]string, port string) ([]string, error) {
+	var args []string
+	for _, name := range sortedKeys(contexts) {
+		src := contexts[name]
+
+		switch {
+		case name == "context" || name == "dockerfile":
+			return nil, fmt.Errorf("build context name is reserved: %s", name)
+
+		case strings.HasPrefix(src, dockerImagePrefix):
+			args = append(args, "--opt", "context:"+name+"="+src)
+
+		case isImageTarball(src):
+			args = append(args,
+				"--opt", fmt.Sprintf("context:%s=%slocalhost:%s/%s", name, dockerImagePrefix, port, namedContextImage(name)),
+			)
+
+		default:
+			args = append(args,
+				"--local", name+"="+src,
+				"--opt", "context:"+name+"=local:"+name,
+			)
+		}
+	}
+
+	return args, nil
+}
+
+// namedContextImages returns the paths of the image tarballs among the named
+// build contexts, keyed by the name they are served under.
+func namedContextImages(contexts map[string]string) map[string]string {
+	imagePaths := map[string]string{}
+	for name, src := range contexts {
+		if isImageTarball(src) {
+			imagePaths[namedContextImage(name)] = src
+		}
+	}
+
+	return imagePaths
+}
+
+// namedContextInputs returns the inputs that the named build contexts are
+// read from, i.e. the first path segment of each directory or tarball.
+func namedContextInputs(contexts map[string]string) []prototype.Input {
+	var inputs []prototype.Input
+
+	seen := map[string]bool{}
+	for _, name := range sortedKeys(contexts) {
+		src := contexts[name]
+		if strings.HasPrefix(src, dockerImagePrefix) {
+			continue
+		}
+
+		input := inputName(src)
+		if input == "" || seen[input] {
+			continue
+		}
+
+		seen[input] = true
+
+		inputs = append(inputs, prototype.Input{Name: input})
+	}
+
+	return inputs
+}
+
+// inputName is the name of the input containing the given relative path, or
+// "" if the path is not within an input.
+func inputName(path string) string {
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || path == "." || strings.HasPrefix(path, "..") {
+		return ""
+	}
+
+	return strings.SplitN(filepath.ToSlash(path), "/", 2)[0]
+}
+
+func isImageTarball(path string) bool {
+	return strings.HasSuffix(path, ".tar")
+}
+
+// namedContextImage is the name under which the image tarball for a named
+// context is served by the local registry.
+func namedContextImage(name string) string {
+	return "context-" + strings.ToLower(name)
+}
@@ -0,0 +1,448 @@
+package prototype
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/aoldershaw/oci-image-prototype/cgroups"
+	prototype "github.com/aoldershaw/prototype-sdk-go"
+)
+
+// Statuses of a DoctorCheck.
+const (
+	CheckPass = "pass"
+	CheckFail = "fail"
+
+	// The check could not be verified, typically for lack of privileges.
+	CheckSkip = "skip"
+)
+
+// DoctorCheck is the result of checking a single prerequisite.
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+
+	// How to fix a failed check.
+	Hint string `json:"hint,omitempty"`
+}
+
+// Doctor checks the prerequisites for spawning buildkitd and setting up
+// cgroups. Checks which need privileges (i.e. mounting) are skipped when
+// unprivileged.
+type Doctor struct {
+	// Root of the filesystem to inspect (proc/, sys/, etc/ and scratch/).
+	Root string
+
+	// PATH to look for binaries in.
+	Path string
+
+	// Whether running as root, which is required to mount anything and
+	// determines whether buildkitd runs rootless.
+	Privileged bool
+
+	// Name of the current user, for looking up subordinate IDs.
+	Username string
+}
+
+// NewDoctor returns a Doctor for the current environment.
+func NewDoctor() Doctor {
+	username := ""
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	return Doctor{
+		Root:       "/",
+		Path:       os.Getenv("PATH"),
+		Privileged: os.Getuid() == 0,
+		Username:   username,
+	}
+}
+
+// DoctorConfig is the config for the doctor message, which needs no inputs
+// or outputs.
+func DoctorConfig(img OCIImage) prototype.Config {
+	return prototype.Config{}
+}
+
+// RunDoctor checks the environment, printing the results to stdout, and
+// fails if any check failed.
+func RunDoctor(img OCIImage) ([]prototype.MessageResponse, error) {
+	checks := NewDoctor().Check(img)
+
+	err := WriteDoctorChecks(os.Stdout, checks)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, DoctorError(checks)
+}
+
+// DoctorError returns an error if any of the checks failed.
+func DoctorError(checks []DoctorCheck) error {
+	var failed []string
+	for _, check := range checks {
+		if check.Status == CheckFail {
+			failed = append(failed, check.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d checks failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// WriteDoctorChecks writes a table of the checks, with a hint below each
+// that failed.
+func WriteDoctorChecks(out io.Writer, checks []DoctorCheck) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	for _, check := range checks {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(check.Status), check.Name, check.Detail)
+
+		if check.Status == CheckFail && check.Hint != "" {
+			fmt.Fprintf(w, "\t\thint: %s\n", check.Hint)
+		}
+	}
+
+	return w.Flush()
+}
+
+// Check runs every check for spawning buildkitd as configured by img.
+func (doctor Doctor) Check(img OCIImage) []DoctorCheck {
+	var checks []DoctorCheck
+
+	checks = append(checks,
+		doctor.checkBinary("buildctl", true, "install buildctl from a BuildKit release (https://github.com/moby/buildkit/releases)"),
+		doctor.checkBinary("buildkitd", true, "install buildkitd from a BuildKit release (https://github.com/moby/buildkit/releases)"),
+		doctor.checkBinary("rootlesskit", !doctor.Privileged, "install rootlesskit (https://github.com/rootless-containers/rootlesskit), or run as root"),
+		doctor.checkBinary("newuidmap", !doctor.Privileged, "install the uidmap package, which provides setuid newuidmap and newgidmap, or run as root"),
+		doctor.checkBinary("newgidmap", !doctor.Privileged, "install the uidmap package, which provides setuid newuidmap and newgidmap, or run as root"),
+		doctor.checkSubordinateIDs("subuid"),
+		doctor.checkSubordinateIDs("subgid"),
+	)
+
+	if img.Worker == WorkerContainerd {
+		checks = append(checks, doctor.checkContainerd(img.ContainerdAddress))
+	} else {
+		runtime := img.Runtime
+		if runtime == "" {
+			runtime = "runc"
+		}
+
+		checks = append(checks, doctor.checkBinary(runtime, true, "install the "+runtime+" OCI runtime, or configure another runtime"))
+	}
+
+	checks = append(checks,
+		doctor.checkCgroups(),
+		doctor.checkOverlay(img),
+		doctor.checkScratch(),
+	)
+
+	return checks
+}
+
+func (doctor Doctor) checkBinary(name string, required bool, hint string) DoctorCheck {
+	check := DoctorCheck{
+		Name: name,
+		Hint: hint,
+	}
+
+	path, err := doctor.lookPath(name)
+	switch {
+	case err == nil:
+		check.Status = CheckPass
+		check.Detail = path
+	case required:
+		check.Status = CheckFail
+		check.Detail = "not found in PATH"
+	default:
+		check.Status = CheckSkip
+		check.Detail = "not found in PATH; only needed when not running as root"
+	}
+
+	return check
+}
+
+// lookPath finds an executable in the doctor's PATH.
+func (doctor Doctor) lookPath(name string) (string, error) {
+	for _, dir := range filepath.SplitList(doctor.Path) {
+		if dir == "" {
+			dir = "."
+		}
+
+		path := filepath.Join(dir, name)
+
+		info, err := os.Stat(path)
+		if err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s not found", name)
+}
+
+// checkSubordinateIDs checks that the user has subordinate IDs to map into
+// rootlesskit's user namespace.
+func (doctor Doctor) checkSubordinateIDs(file string) DoctorCheck {
+	check := DoctorCheck{
+		Name: "/etc/" + file,
+		Hint: fmt.Sprintf("add a range for %s to /etc/%s, e.g. '%s:100000:65536'", doctor.Username, file, doctor.Username),
+	}
+
+	if doctor.Privileged {
+		check.Status = CheckSkip
+		check.Detail = "only needed when not running as root"
+		return check
+	}
+
+	ranges, err := doctor.subordinateIDs(file)
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = err.Error()
+		return check
+	}
+
+	if len(ranges) == 0 {
+		check.Status = CheckFail
+		check.Detail = "no range for " + doctor.Username
+		return check
+	}
+
+	check.Status = CheckPass
+	check.Detail = strings.Join(ranges, ", ")
+
+	return check
+}
+
+func (doctor Doctor) subordinateIDs(file string) ([]string, error) {
+	f, err := os.Open(filepath.Join(doctor.Root, "etc", file))
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var ranges []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// user:start:count
+		segs := strings.SplitN(scanner.Text(), ":", 2)
+		if len(segs) == 2 && segs[0] == doctor.Username {
+			ranges = append(ranges, segs[1])
+		}
+	}
+
+	return ranges, scanner.Err()
+}
+
+func (doctor Doctor) checkContainerd(addr string) DoctorCheck {
+	if addr == "" {
+		addr = "/run/containerd/containerd.sock"
+	}
+
+	check := DoctorCheck{
+		Name: "containerd",
+		Hint: "start containerd, or configure its address with containerd_address",
+	}
+
+	info, err := os.Stat(filepath.Join(doctor.Root, strings.TrimPrefix(addr, "unix://")))
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = err.Error()
+		return check
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		check.Status = CheckFail
+		check.Detail = addr + " is not a socket"
+		return check
+	}
+
+	check.Status = CheckPass
+	check.Detail = addr
+
+	return check
+}
+
+func (doctor Doctor) checkCgroups() DoctorCheck {
+	check := DoctorCheck{
+		Name: "cgroups",
+		Hint: "run privileged, so that cgroups can be mounted at /sys/fs/cgroup",
+	}
+
+	setup := cgroups.New()
+	setup.Root = doctor.Root
+
+	status, err := setup.Status()
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = err.Error()
+		return check
+	}
+
+	controllers := strings.Join(status.Controllers, ",")
+	if controllers == "" {
+		controllers = "none"
+	}
+
+	if status.Mounted {
+		check.Status = CheckPass
+		check.Detail = fmt.Sprintf("%s mode, mounted (controllers: %s)", status.Mode, controllers)
+		return check
+	}
+
+	if !doctor.Privileged || doctor.Root != "/" {
+		check.Status = CheckSkip
+		check.Detail = fmt.Sprintf("%s mode, not mounted; mounting can only be verified as root", status.Mode)
+		return check
+	}
+
+	fstype := "cgroup2"
+	if status.Mode != cgroups.Unified {
+		fstype = "tmpfs"
+	}
+
+	err = probeMount(fstype)
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("%s mode, cannot mount %s: %s", status.Mode, fstype, err)
+		return check
+	}
+
+	check.Status = CheckPass
+	check.Detail = fmt.Sprintf("%s mode, mountable", status.Mode)
+
+	return check
+}
+
+func (doctor Doctor) checkOverlay(img OCIImage) DoctorCheck {
+	check := DoctorCheck{
+		Name: "overlayfs",
+		Hint: "configure the native or fuse-overlayfs snapshotter; with the default snapshotter, buildkitd falls back to one of these automatically",
+	}
+
+	if img.Worker == WorkerContainerd {
+		check.Status = CheckSkip
+		check.Detail = "snapshotter is managed by containerd"
+		return check
+	}
+
+	if img.Snapshotter != "" && img.Snapshotter != "auto" && img.Snapshotter != "overlayfs" {
+		check.Status = CheckSkip
+		check.Detail = "not needed with the " + img.Snapshotter + " snapshotter"
+		return check
+	}
+
+	supported, err := doctor.kernelSupports("overlay")
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = err.Error()
+		return check
+	}
+
+	if !supported {
+		check.Status = CheckFail
+		check.Detail = "overlay is not listed in /proc/filesystems"
+		return check
+	}
+
+	if !doctor.Privileged || doctor.Root != "/" {
+		check.Status = CheckSkip
+		check.Detail = "supported by the kernel; mounting can only be verified as root"
+		return check
+	}
+
+	dir := os.TempDir()
+	if _, err := os.Stat("/scratch"); err == nil {
+		dir = "/scratch"
+	}
+
+	err = probeOverlay(dir)
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("cannot mount in %s: %s", dir, err)
+		return check
+	}
+
+	check.Status = CheckPass
+	check.Detail = "mountable in " + dir
+
+	return check
+}
+
+// kernelSupports checks whether the filesystem type is listed in
+// /proc/filesystems.
+func (doctor Doctor) kernelSupports(fstype string) (bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(doctor.Root, "proc", "filesystems"))
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == fstype {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (doctor Doctor) checkScratch() DoctorCheck {
+	scratchDir := filepath.Join(doctor.Root, "scratch")
+
+	check := DoctorCheck{
+		Name: "/scratch",
+		Hint: "mount a writable volume at /scratch",
+	}
+
+	if _, err := os.Stat(scratchDir); err != nil {
+		check.Status = CheckSkip
+		check.Detail = "not present; buildkitd state will not persist across builds"
+		return check
+	}
+
+	probe, err := ioutil.TempFile(scratchDir, "doctor")
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = err.Error()
+		return check
+	}
+
+	probe.Close()
+	os.Remove(probe.Name())
+
+	check.Status = CheckPass
+	check.Detail = "writable"
+
+	return check
+}
+
+func probeMount(fstype string) error {
+	dir, err := ioutil.TempDir("", "mount-probe")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = syscall.Mount(fstype, dir, fstype, 0, "")
+	if err != nil {
+		return err
+	}
+
+	return syscall.Unmount(dir, 0)
+}
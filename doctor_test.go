@@ -0,0 +1,165 @@
+package prototype_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type DoctorSuite struct {
+	suite.Suite
+	*require.Assertions
+
+	root     string
+	binDir   string
+	ociImage prototype.OCIImage
+}
+
+func (s *DoctorSuite) SetupTest() {
+	var err error
+	s.root, err = ioutil.TempDir("", "doctor-root")
+	s.NoError(err)
+
+	err = exec.Command("cp", "-R", "cgroups/testdata/unified-mounted/.", s.root).Run()
+	s.NoError(err)
+
+	s.writeFile("proc/filesystems", "nodev\ttmpfs\nnodev\tcgroup2\nnodev\toverlay\n")
+	s.writeFile("etc/subuid", "other:100000:65536\nsome-user:165536:65536\n")
+	s.writeFile("etc/subgid", "other:100000:65536\n")
+
+	s.binDir = filepath.Join(s.root, "bin")
+	for _, name := range []string{"buildctl", "buildkitd", "rootlesskit", "newuidmap", "runc"} {
+		s.writeFile(filepath.Join("bin", name), "#!/bin/sh\n")
+		s.NoError(os.Chmod(filepath.Join(s.binDir, name), 0755))
+	}
+
+	s.ociImage = prototype.OCIImage{}
+}
+
+func (s *DoctorSuite) TearDownTest() {
+	os.RemoveAll(s.root)
+}
+
+func (s *DoctorSuite) TestUnprivileged() {
+	checks := s.doctor().Check(s.ociImage)
+
+	s.Equal([]prototype.DoctorCheck{
+		s.pass("buildctl", filepath.Join(s.binDir, "buildctl")),
+		s.pass("buildkitd", filepath.Join(s.binDir, "buildkitd")),
+		s.pass("rootlesskit", filepath.Join(s.binDir, "rootlesskit")),
+		s.pass("newuidmap", filepath.Join(s.binDir, "newuidmap")),
+		s.fail("newgidmap", "not found in PATH"),
+		s.pass("/etc/subuid", "165536:65536"),
+		s.fail("/etc/subgid", "no range for some-user"),
+		s.pass("runc", filepath.Join(s.binDir, "runc")),
+		s.pass("cgroups", "unified mode, mounted (controllers: cpuset,cpu,io,memory,hugetlb,pids)"),
+		s.skip("overlayfs", "supported by the kernel; mounting can only be verified as root"),
+		s.skip("/scratch", "not present; buildkitd state will not persist across builds"),
+	}, withoutHints(checks))
+
+	s.EqualError(prototype.DoctorError(checks), "2 checks failed: newgidmap, /etc/subgid")
+}
+
+func (s *DoctorSuite) TestPrivileged() {
+	doctor := s.doctor()
+	doctor.Privileged = true
+
+	s.NoError(os.Remove(filepath.Join(s.binDir, "rootlesskit")))
+	s.NoError(os.Mkdir(filepath.Join(s.root, "scratch"), 0755))
+
+	s.ociImage.Runtime = "crun"
+	s.ociImage.Snapshotter = "native"
+
+	checks := doctor.Check(s.ociImage)
+
+	s.Equal([]prototype.DoctorCheck{
+		s.pass("buildctl", filepath.Join(s.binDir, "buildctl")),
+		s.pass("buildkitd", filepath.Join(s.binDir, "buildkitd")),
+		s.skip("rootlesskit", "not found in PATH; only needed when not running as root"),
+		s.pass("newuidmap", filepath.Join(s.binDir, "newuidmap")),
+		s.skip("newgidmap", "not found in PATH; only needed when not running as root"),
+		s.skip("/etc/subuid", "only needed when not running as root"),
+		s.skip("/etc/subgid", "only needed when not running as root"),
+		s.fail("crun", "not found in PATH"),
+		s.pass("cgroups", "unified mode, mounted (controllers: cpuset,cpu,io,memory,hugetlb,pids)"),
+		s.skip("overlayfs", "not needed with the native snapshotter"),
+		s.pass("/scratch", "writable"),
+	}, withoutHints(checks))
+}
+
+func (s *DoctorSuite) TestContainerdWorker() {
+	s.ociImage.Worker = prototype.WorkerContainerd
+	s.ociImage.ContainerdAddress = "/run/containerd/containerd.sock"
+
+	checks := s.doctor().Check(s.ociImage)
+	s.Contains(withoutHints(checks), s.fail("containerd", "stat "+filepath.Join(s.root, "run/containerd/containerd.sock")+": no such file or directory"))
+	s.Contains(withoutHints(checks), s.skip("overlayfs", "snapshotter is managed by containerd"))
+}
+
+func (s *DoctorSuite) TestWriteDoctorChecks() {
+	buf := new(bytes.Buffer)
+	err := prototype.WriteDoctorChecks(buf, []prototype.DoctorCheck{
+		{Name: "buildctl", Status: prototype.CheckPass, Detail: "/usr/bin/buildctl", Hint: "install it"},
+		{Name: "runc", Status: prototype.CheckFail, Detail: "not found in PATH", Hint: "install it"},
+		{Name: "/scratch", Status: prototype.CheckSkip, Detail: "not present"},
+	})
+	s.NoError(err)
+
+	s.Equal(`PASS  buildctl  /usr/bin/buildctl
+FAIL  runc      not found in PATH
+                hint: install it
+SKIP  /scratch  not present
+`, buf.String())
+}
+
+func (s *DoctorSuite) doctor() prototype.Doctor {
+	return prototype.Doctor{
+		Root:     s.root,
+		Path:     s.binDir,
+		Username: "some-user",
+	}
+}
+
+func (s *DoctorSuite) writeFile(path string, content string) {
+	err := os.MkdirAll(filepath.Dir(filepath.Join(s.root, path)), 0755)
+	s.NoError(err)
+
+	err = ioutil.WriteFile(filepath.Join(s.root, path), []byte(content), 0644)
+	s.NoError(err)
+}
+
+func (s *DoctorSuite) pass(name, detail string) prototype.DoctorCheck {
+	return prototype.DoctorCheck{Name: name, Status: prototype.CheckPass, Detail: detail}
+}
+
+func (s *DoctorSuite) fail(name, detail string) prototype.DoctorCheck {
+	return prototype.DoctorCheck{Name: name, Status: prototype.CheckFail, Detail: detail}
+}
+
+func (s *DoctorSuite) skip(name, detail string) prototype.DoctorCheck {
+	return prototype.DoctorCheck{Name: name, Status: prototype.CheckSkip, Detail: detail}
+}
+
+func withoutHints(checks []prototype.DoctorCheck) []prototype.DoctorCheck {
+	var stripped []prototype.DoctorCheck
+	for _, check := range checks {
+		check.Hint = ""
+		stripped = append(stripped, check)
+	}
+
+	return stripped
+}
+
+func TestDoctor(t *testing.T) {
+	suite.Run(t, &DoctorSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -0,0 +1,142 @@
+package prototype
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EventLogStderr configures the event log to be written to stderr rather
+// than to a file in the output.
+const EventLogStderr = "stderr"
+
+// Types of Event.
+const (
+	EventBuildkitdStarted = "buildkitd_started"
+	EventTargetStarted    = "target_started"
+	EventStepCompleted    = "step_completed"
+	EventTargetFinished   = "target_finished"
+	EventUnpackLayer      = "unpack_layer"
+	EventDigestWritten    = "digest_written"
+)
+
+// Event is a single line of the event log. Fields which don't apply to the
+// event's type are omitted.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Output name of the target the event belongs to, e.g. "image", as in
+	// build-stats.json.
+	Target string `json:"target,omitempty"`
+
+	// Wall time in seconds of whatever the event marks the end of.
+	Duration float64 `json:"duration,omitempty"`
+
+	// buildkitd_started: the address buildkitd is listening on.
+	Addr string `json:"addr,omitempty"`
+
+	// step_completed: the Dockerfile instruction.
+	Step   string `json:"step,omitempty"`
+	Cached bool   `json:"cached,omitempty"`
+
+	// target_finished: the step counts, as in build-stats.json.
+	CachedSteps   int `json:"cached_steps,omitempty"`
+	ExecutedSteps int `json:"executed_steps,omitempty"`
+
+	// unpack_layer: the layer's digest and compressed size.
+	Layer string `json:"layer,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+
+	// digest_written: the image digest and the file it was written to.
+	Digest string `json:"digest,omitempty"`
+	Path   string `json:"path,omitempty"`
+
+	// step_completed and target_finished: what went wrong.
+	Error string `json:"error,omitempty"`
+}
+
+// EventLog writes events as a stream of JSON objects, one per line. A nil
+// EventLog discards every event.
+type EventLog struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+// NewEventLog returns an EventLog writing to w.
+func NewEventLog(w io.Writer) *EventLog {
+	return &EventLog{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// OpenEventLog opens the event log configured by dest: nothing when empty,
+// stderr for EventLogStderr, or otherwise a file of that name in outputDir.
+func OpenEventLog(dest string, outputDir string) (*EventLog, error) {
+	switch dest {
+	case "":
+		return nil, nil
+	case EventLogStderr:
+		return NewEventLog(os.Stderr), nil
+	}
+
+	file, err := os.Create(filepath.Join(outputDir, dest))
+	if err != nil {
+		return nil, err
+	}
+
+	log := NewEventLog(file)
+	log.closer = file
+
+	return log, nil
+}
+
+// Emit writes the event, stamping it with the current time unless it has
+// one. Failing to write is only warned about; the event log is not worth
+// failing the build over.
+func (log *EventLog) Emit(event Event) {
+	if log == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	event.Time = event.Time.UTC()
+
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	err := log.encoder.Encode(event)
+	if err != nil {
+		logrus.Warn("failed to write event:", err)
+	}
+}
+
+// Close closes the event log's file, if it has one.
+func (log *EventLog) Close() error {
+	if log == nil || log.closer == nil {
+		return nil
+	}
+
+	return log.closer.Close()
+}
+
+// isOutputFile returns whether the build writes a file of this name to a
+// target's output, which the event log must not clobber.
+func isOutputFile(name string) bool {
+	for _, file := range []string{"image.tar", "digest", "build-stats.json", "rootfs", "metadata.json", TraceFile, SBOMFile, ProvenanceFile, SignatureFile, SignaturePayloadFile} {
+		if name == file {
+			return true
+		}
+	}
+
+	return false
+}
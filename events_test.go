@@ -0,0 +1,93 @@
+package prototype_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type EventsSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *EventsSuite) TestEmit() {
+	buf := new(bytes.Buffer)
+
+	events := prototype.NewEventLog(buf)
+
+	events.Emit(prototype.Event{
+		Type:     prototype.EventBuildkitdStarted,
+		Time:     time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		Duration: 1.5,
+		Addr:     "unix:///some/buildkitd.sock",
+	})
+
+	events.Emit(prototype.Event{
+		Type:   prototype.EventStepCompleted,
+		Time:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600)),
+		Target: "image",
+		Step:   "[1/1] COPY Dockerfile /",
+		Cached: true,
+	})
+
+	s.Equal(`{"type":"buildkitd_started","time":"2021-01-01T00:00:00Z","duration":1.5,"addr":"unix:///some/buildkitd.sock"}
+{"type":"step_completed","time":"2021-01-01T00:00:00Z","target":"image","step":"[1/1] COPY Dockerfile /","cached":true}
+`, buf.String())
+}
+
+func (s *EventsSuite) TestEmitStampsTime() {
+	buf := new(bytes.Buffer)
+
+	before := time.Now()
+
+	prototype.NewEventLog(buf).Emit(prototype.Event{
+		Type:   prototype.EventTargetStarted,
+		Target: "image",
+	})
+
+	var event prototype.Event
+	s.NoError(json.Unmarshal(buf.Bytes(), &event))
+	s.False(event.Time.Before(before))
+}
+
+func (s *EventsSuite) TestNilEventLog() {
+	events, err := prototype.OpenEventLog("", "does-not-exist")
+	s.NoError(err)
+	s.Nil(events)
+
+	events.Emit(prototype.Event{Type: prototype.EventTargetStarted})
+	s.NoError(events.Close())
+}
+
+func (s *EventsSuite) TestOpenEventLog() {
+	dir, err := ioutil.TempDir("", "event-log")
+	s.NoError(err)
+
+	defer os.RemoveAll(dir)
+
+	events, err := prototype.OpenEventLog("events.json", dir)
+	s.NoError(err)
+
+	events.Emit(prototype.Event{Type: prototype.EventTargetStarted, Target: "image"})
+	s.NoError(events.Close())
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "events.json"))
+	s.NoError(err)
+	s.Contains(string(content), `"type":"target_started"`)
+}
+
+func TestEvents(t *testing.T) {
+	suite.Run(t, &EventsSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -0,0 +1,502 @@
+package prototype
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Severities of a vulnerability, from least to most severe. A vulnerability
+// whose advisory has no severity (or only one that cannot be rated) is
+// "unknown".
+const (
+	SeverityUnknown  = "unknown"
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+var severityRanks = map[string]int{
+	SeverityUnknown:  0,
+	SeverityLow:      1,
+	SeverityMedium:   2,
+	SeverityHigh:     3,
+	SeverityCritical: 4,
+}
+
+// OSVEntry is an advisory in the OSV format, see
+// https://ossf.github.io/osv-schema/. Only the fields used for matching and
+// reporting are decoded.
+type OSVEntry struct {
+	ID        string        `json:"id"`
+	Aliases   []string      `json:"aliases,omitempty"`
+	Summary   string        `json:"summary,omitempty"`
+	Details   string        `json:"details,omitempty"`
+	Withdrawn string        `json:"withdrawn,omitempty"`
+	Severity  []OSVSeverity `json:"severity,omitempty"`
+	Affected  []OSVAffected `json:"affected"`
+
+	DatabaseSpecific struct {
+		Severity string `json:"severity,omitempty"`
+	} `json:"database_specific"`
+}
+
+type OSVSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+type OSVAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+
+	Ranges   []OSVRange `json:"ranges,omitempty"`
+	Versions []string   `json:"versions,omitempty"`
+
+	Severity []OSVSeverity `json:"severity,omitempty"`
+
+	EcosystemSpecific struct {
+		Severity string `json:"severity,omitempty"`
+	} `json:"ecosystem_specific"`
+
+	DatabaseSpecific struct {
+		Severity string `json:"severity,omitempty"`
+	} `json:"database_specific"`
+}
+
+type OSVRange struct {
+	Type   string     `json:"type"`
+	Events []OSVEvent `json:"events"`
+}
+
+type OSVEvent struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+}
+
+// VulnerabilityDB is a set of OSV advisories, indexed by the packages they
+// affect.
+type VulnerabilityDB struct {
+	byPackage map[string][]*OSVEntry
+}
+
+// LoadVulnerabilityDB reads every .json file within dir (recursively) as an
+// OSV advisory, e.g. an extracted export of https://osv.dev's database for
+// each ecosystem. Withdrawn advisories are skipped.
+func LoadVulnerabilityDB(dir string) (VulnerabilityDB, error) {
+	db := VulnerabilityDB{byPackage: map[string][]*OSVEntry{}}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+
+		payload, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var entry OSVEntry
+		err = json.Unmarshal(payload, &entry)
+		if err != nil {
+			return errors.Wrapf(err, "parse %s", path)
+		}
+
+		if entry.ID == "" || entry.Withdrawn != "" {
+			return nil
+		}
+
+		for _, affected := range entry.Affected {
+			key := osvPackageKey(osvEcosystemBase(affected.Package.Ecosystem), affected.Package.Name)
+			db.byPackage[key] = append(db.byPackage[key], &entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return VulnerabilityDB{}, err
+	}
+
+	return db, nil
+}
+
+// Len returns the number of advisories, counting each affected package.
+func (db VulnerabilityDB) Len() int {
+	var n int
+	for _, entries := range db.byPackage {
+		n += len(entries)
+	}
+
+	return n
+}
+
+func osvPackageKey(ecosystem string, name string) string {
+	return ecosystem + "/" + name
+}
+
+// osvEcosystemBase strips the release from an ecosystem, e.g. 'Debian:11'.
+func osvEcosystemBase(ecosystem string) string {
+	return strings.SplitN(ecosystem, ":", 2)[0]
+}
+
+// packageEcosystem returns the OSV ecosystem of a package, and the release
+// an affected ecosystem must have (if any), e.g. "Debian" and "11".
+func packageEcosystem(pkg Package, distroID string, distroVersion string) (string, string) {
+	switch pkg.Type {
+	case PackageTypeDeb:
+		if distroID == "ubuntu" {
+			return "Ubuntu", distroVersion
+		}
+
+		return "Debian", strings.SplitN(distroVersion, ".", 2)[0]
+	case PackageTypeApk:
+		// advisories are per branch, e.g. 'Alpine:v3.15' for 3.15.4
+		parts := strings.SplitN(distroVersion, ".", 3)
+		if distroVersion == "" || len(parts) < 2 {
+			return "Alpine", ""
+		}
+
+		return "Alpine", "v" + parts[0] + "." + parts[1]
+	case PackageTypeGolang:
+		return "Go", ""
+	default:
+		return "", ""
+	}
+}
+
+// Vulnerability is an advisory that a package in the image is affected by.
+type Vulnerability struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Summary  string   `json:"summary,omitempty"`
+	Severity string   `json:"severity"`
+
+	// CVSS v3 base score, if the advisory has a vector.
+	Score float64 `json:"score,omitempty"`
+
+	Package Package `json:"package"`
+
+	// Earliest version which fixes the vulnerability, if there is one.
+	FixedVersion string `json:"fixed_version,omitempty"`
+}
+
+// Match returns the advisories affecting the packages, ordered by package
+// and then advisory ID.
+func (db VulnerabilityDB) Match(scan PackageScan) []Vulnerability {
+	var vulns []Vulnerability
+
+	for _, pkg := range scan.Packages {
+		ecosystem, release := packageEcosystem(pkg, scan.DistroID, scan.DistroVersion)
+		if ecosystem == "" {
+			continue
+		}
+
+		names := []string{pkg.Name}
+		if pkg.Origin != "" && pkg.Origin != pkg.Name {
+			names = append(names, pkg.Origin)
+		}
+
+		seen := map[string]bool{}
+		for _, name := range names {
+			for _, entry := range db.byPackage[osvPackageKey(ecosystem, name)] {
+				if seen[entry.ID] {
+					continue
+				}
+
+				for _, affected := range entry.Affected {
+					if affected.Package.Name != name || !ecosystemMatches(affected.Package.Ecosystem, ecosystem, release) {
+						continue
+					}
+
+					fixed, vulnerable := affectedVersion(pkg, affected)
+					if !vulnerable {
+						continue
+					}
+
+					seen[entry.ID] = true
+
+					severity, score := entrySeverity(entry, affected)
+
+					vulns = append(vulns, Vulnerability{
+						ID:           entry.ID,
+						Aliases:      entry.Aliases,
+						Summary:      entry.Summary,
+						Severity:     severity,
+						Score:        score,
+						Package:      pkg,
+						FixedVersion: fixed,
+					})
+
+					break
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(vulns, func(i, j int) bool {
+		if vulns[i].Package.Name != vulns[j].Package.Name {
+			return vulns[i].Package.Name < vulns[j].Package.Name
+		}
+
+		return vulns[i].ID < vulns[j].ID
+	})
+
+	return vulns
+}
+
+// ecosystemMatches returns whether an advisory's ecosystem, e.g.
+// 'Debian:11' or 'Ubuntu:22.04:LTS', is for the package's ecosystem and
+// release. Advisories without a release apply to every release.
+func ecosystemMatches(affected string, ecosystem string, release string) bool {
+	if affected == ecosystem {
+		return true
+	}
+
+	if release == "" || !strings.HasPrefix(affected, ecosystem+":") {
+		return release == "" && strings.HasPrefix(affected, ecosystem+":")
+	}
+
+	rest := strings.TrimPrefix(affected, ecosystem+":")
+
+	return rest == release || strings.HasPrefix(rest, release+":")
+}
+
+// affectedVersion returns whether the package's version is affected, and
+// the version which fixes it.
+func affectedVersion(pkg Package, affected OSVAffected) (string, bool) {
+	for _, version := range affected.Versions {
+		if CompareVersions(pkg.Type, version, pkg.Version) == 0 {
+			return fixedVersion(pkg, affected), true
+		}
+	}
+
+	for _, r := range affected.Ranges {
+		if r.Type != "ECOSYSTEM" && r.Type != "SEMVER" {
+			continue
+		}
+
+		if versionInRange(pkg, r.Events) {
+			return fixedVersion(pkg, affected), true
+		}
+	}
+
+	return "", false
+}
+
+// versionInRange evaluates a range's events: the version is affected if it is
+// at or after an introduced version, and before the first fixed version (or
+// at or before the first last_affected version) after it.
+func versionInRange(pkg Package, events []OSVEvent) bool {
+	compare := func(a, b string) int {
+		return CompareVersions(pkg.Type, a, b)
+	}
+
+	for _, event := range events {
+		if event.Introduced == "" {
+			continue
+		}
+
+		if event.Introduced != "0" && compare(pkg.Version, event.Introduced) < 0 {
+			continue
+		}
+
+		var fixed, lastAffected string
+		for _, limit := range events {
+			if limit.Fixed != "" && (event.Introduced == "0" || compare(limit.Fixed, event.Introduced) > 0) {
+				if fixed == "" || compare(limit.Fixed, fixed) < 0 {
+					fixed = limit.Fixed
+				}
+			}
+
+			if limit.LastAffected != "" && (event.Introduced == "0" || compare(limit.LastAffected, event.Introduced) >= 0) {
+				if lastAffected == "" || compare(limit.LastAffected, lastAffected) < 0 {
+					lastAffected = limit.LastAffected
+				}
+			}
+		}
+
+		switch {
+		case fixed != "" && compare(pkg.Version, fixed) >= 0:
+		case lastAffected != "" && compare(pkg.Version, lastAffected) > 0:
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// fixedVersion returns the earliest fixed version after the package's
+// version.
+func fixedVersion(pkg Package, affected OSVAffected) string {
+	var fixed string
+	for _, r := range affected.Ranges {
+		for _, event := range r.Events {
+			if event.Fixed == "" || CompareVersions(pkg.Type, event.Fixed, pkg.Version) <= 0 {
+				continue
+			}
+
+			if fixed == "" || CompareVersions(pkg.Type, event.Fixed, fixed) < 0 {
+				fixed = event.Fixed
+			}
+		}
+	}
+
+	return fixed
+}
+
+// entrySeverity rates an advisory from a CVSS v3 vector, or failing that,
+// the severity given by the ecosystem or database (e.g. GitHub's
+// 'MODERATE').
+func entrySeverity(entry *OSVEntry, affected OSVAffected) (string, float64) {
+	for _, severity := range append(append([]OSVSeverity{}, affected.Severity...), entry.Severity...) {
+		if severity.Type != "CVSS_V3" {
+			continue
+		}
+
+		score, err := CVSSv3BaseScore(severity.Score)
+		if err == nil {
+			return cvssRating(score), score
+		}
+	}
+
+	for _, severity := range []string{
+		affected.EcosystemSpecific.Severity,
+		affected.DatabaseSpecific.Severity,
+		entry.DatabaseSpecific.Severity,
+	} {
+		switch strings.ToLower(severity) {
+		case "low", "negligible", "unimportant":
+			return SeverityLow, 0
+		case "medium", "moderate":
+			return SeverityMedium, 0
+		case "high", "important":
+			return SeverityHigh, 0
+		case "critical":
+			return SeverityCritical, 0
+		}
+	}
+
+	return SeverityUnknown, 0
+}
+
+func cvssRating(score float64) string {
+	switch {
+	case score >= 9:
+		return SeverityCritical
+	case score >= 7:
+		return SeverityHigh
+	case score >= 4:
+		return SeverityMedium
+	case score > 0:
+		return SeverityLow
+	default:
+		return SeverityUnknown
+	}
+}
+
+var cvssWeights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// CVSSv3BaseScore calculates the base score of a CVSS v3.0 or v3.1 vector,
+// e.g. 'CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H'.
+func CVSSv3BaseScore(vector string) (float64, error) {
+	parts := strings.Split(vector, "/")
+	if len(parts) == 0 || !strings.HasPrefix(parts[0], "CVSS:3.") {
+		return 0, fmt.Errorf("not a CVSS v3 vector: %s", vector)
+	}
+
+	metrics := map[string]string{}
+	for _, part := range parts[1:] {
+		segs := strings.SplitN(part, ":", 2)
+		if len(segs) != 2 {
+			return 0, fmt.Errorf("invalid metric %q in %s", part, vector)
+		}
+
+		metrics[segs[0]] = segs[1]
+	}
+
+	weights := map[string]float64{}
+	for _, metric := range []string{"AV", "AC", "UI", "C", "I", "A"} {
+		weight, found := cvssWeights[metric][metrics[metric]]
+		if !found {
+			return 0, fmt.Errorf("invalid or missing %s in %s", metric, vector)
+		}
+
+		weights[metric] = weight
+	}
+
+	changed := metrics["S"] == "C"
+	if !changed && metrics["S"] != "U" {
+		return 0, fmt.Errorf("invalid or missing S in %s", vector)
+	}
+
+	var pr float64
+	switch metrics["PR"] {
+	case "N":
+		pr = 0.85
+	case "L":
+		pr = 0.62
+		if changed {
+			pr = 0.68
+		}
+	case "H":
+		pr = 0.27
+		if changed {
+			pr = 0.5
+		}
+	default:
+		return 0, fmt.Errorf("invalid or missing PR in %s", vector)
+	}
+
+	iss := 1 - (1-weights["C"])*(1-weights["I"])*(1-weights["A"])
+
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+
+	if impact <= 0 {
+		return 0, nil
+	}
+
+	exploitability := 8.22 * weights["AV"] * weights["AC"] * pr * weights["UI"]
+
+	if changed {
+		return cvssRoundUp(math.Min(1.08*(impact+exploitability), 10)), nil
+	}
+
+	return cvssRoundUp(math.Min(impact+exploitability, 10)), nil
+}
+
+// cvssRoundUp rounds up to one decimal place, as specified by CVSS v3.1 to
+// avoid floating point errors.
+func cvssRoundUp(x float64) float64 {
+	i := int64(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+
+	return float64(i/10000+1) / 10
+}
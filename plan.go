@@ -0,0 +1,490 @@
+package prototype
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// finalOutput is the output the final target is written to.
+const finalOutput = "image"
+
+// Plan formats for dry runs.
+const (
+	PlanFormatText = "text"
+	PlanFormatJSON = "json"
+)
+
+// BuildPlan is everything Build will do for an OCIImage, as determined by
+// its configuration and by which outputs and caches exist.
+type BuildPlan struct {
+	// The context, which is either a "directory", a "tarball" or a "git" ref
+	// in a repository.
+	Context     string `json:"context"`
+	ContextType string `json:"context_type"`
+	ContextRef  string `json:"context_ref,omitempty"`
+
+	// Path to the Dockerfile, or empty when it is read from the context.
+	Dockerfile string `json:"dockerfile,omitempty"`
+
+	// Options passed to the dockerfile frontend for every target.
+	FrontendOpts []string `json:"frontend_opts,omitempty"`
+
+	// Image tarballs served from a local registry, by build arg.
+	ImageArgs map[string]string `json:"image_args,omitempty"`
+
+	// Public key the image args' signatures are verified with.
+	ImageArgsPublicKey string `json:"image_args_public_key,omitempty"`
+
+	BuildContexts map[string]string `json:"build_contexts,omitempty"`
+
+	Secrets []SecretPlan        `json:"secrets,omitempty"`
+	SSH     map[string][]string `json:"ssh,omitempty"`
+
+	// Targets in the order they are built.
+	Targets []TargetPlan `json:"targets"`
+
+	// Local cache dir to prune after building, or empty if it is not
+	// exported to.
+	PruneCacheDir string `json:"prune_cache_dir,omitempty"`
+	CacheMaxSize  int64  `json:"cache_max_size,omitempty"`
+
+	// Timestamp to normalize the image to, if reproducible.
+	SourceDateEpoch *int64 `json:"source_date_epoch,omitempty"`
+
+	UnpackRootfs bool `json:"unpack_rootfs,omitempty"`
+	SBOM         bool `json:"sbom,omitempty"`
+
+	Provenance           bool   `json:"provenance,omitempty"`
+	ProvenanceRepository string `json:"provenance_repository,omitempty"`
+
+	Policy *Policy `json:"policy,omitempty"`
+
+	Sign                bool   `json:"sign,omitempty"`
+	SignatureRepository string `json:"signature_repository,omitempty"`
+
+	// Configuration which will be ignored.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// TargetPlan is a single build of a target.
+type TargetPlan struct {
+	// Output the target is written to.
+	Output string `json:"output"`
+
+	// Stage to build, or empty for the last stage.
+	Target string `json:"target,omitempty"`
+
+	// Path to write the image to, or empty if the output does not exist.
+	ImagePath string `json:"image_path,omitempty"`
+
+	FrontendOpts []string `json:"frontend_opts,omitempty"`
+	CacheImports []string `json:"cache_imports,omitempty"`
+	CacheExport  string   `json:"cache_export,omitempty"`
+}
+
+// SecretPlan is a secret passed to the build. Only the file path or
+// environment variable name is shown; values are redacted.
+type SecretPlan struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+	Value  string `json:"value"`
+}
+
+// PlanBuild validates the configuration and determines what Build would do
+// when writing to outputsDir, without starting anything.
+func PlanBuild(img OCIImage, outputsDir string) (BuildPlan, error) {
+	return planBuild(img, outputsDir, dirExists)
+}
+
+func planBuild(img OCIImage, outputsDir string, exists func(string) bool) (BuildPlan, error) {
+	sanitize(&img)
+
+	err := img.Validate()
+	if err != nil {
+		return BuildPlan{}, errors.Wrap(err, "config")
+	}
+
+	plan := BuildPlan{
+		Context:       img.ContextDir,
+		ContextType:   "directory",
+		ContextRef:    img.ContextRef,
+		Dockerfile:    img.DockerfilePath,
+		BuildContexts: img.BuildContexts,
+		SSH:           img.SSH,
+		UnpackRootfs:  img.UnpackRootfs,
+		SBOM:          img.SBOM,
+
+		Provenance:           img.Provenance || img.ProvenanceRepository != "",
+		ProvenanceRepository: img.ProvenanceRepository,
+
+		Policy: img.Policy,
+
+		Sign:                img.SigningKey != "" || img.SigningKeyEnv != "",
+		SignatureRepository: img.SignatureRepository,
+	}
+
+	if img.ContextRef != "" {
+		plan.ContextType = "git"
+	} else if isContextArchive(img.ContextDir) {
+		plan.ContextType = "tarball"
+	}
+
+	for _, arg := range img.Labels {
+		plan.FrontendOpts = append(plan.FrontendOpts, "label:"+arg)
+	}
+
+	for _, arg := range img.BuildArgs {
+		plan.FrontendOpts = append(plan.FrontendOpts, "build-arg:"+arg)
+	}
+
+	if img.Reproducible {
+		epoch, err := sourceDateEpoch(img)
+		if err != nil {
+			return BuildPlan{}, errors.Wrap(err, "determine SOURCE_DATE_EPOCH")
+		}
+
+		plan.SourceDateEpoch = &epoch
+		plan.FrontendOpts = append(plan.FrontendOpts, fmt.Sprintf("build-arg:SOURCE_DATE_EPOCH=%d", epoch))
+	}
+
+	if len(img.ImageArgs) > 0 {
+		plan.ImageArgs = map[string]string{}
+		for _, arg := range img.ImageArgs {
+			segs := strings.SplitN(arg, "=", 2)
+			plan.ImageArgs[segs[0]] = segs[1]
+		}
+
+		plan.ImageArgsPublicKey = img.ImageArgsPublicKey
+	}
+
+	for _, id := range sortedKeys(img.BuildkitSecrets) {
+		plan.Secrets = append(plan.Secrets, SecretPlan{ID: id, Source: "file", Value: img.BuildkitSecrets[id]})
+	}
+
+	for _, id := range sortedKeys(img.BuildkitSecretEnvs) {
+		plan.Secrets = append(plan.Secrets, SecretPlan{ID: id, Source: "env", Value: img.BuildkitSecretEnvs[id]})
+	}
+
+	for _, id := range sortedKeys(img.BuildkitSecretValues) {
+		plan.Secrets = append(plan.Secrets, SecretPlan{ID: id, Source: "value", Value: secretMask})
+	}
+
+	// buildkit only supports a single cache export
+	var sharedCacheExport string
+	if img.CacheTo != "" {
+		sharedCacheExport = "type=registry,mode=" + img.CacheMode + ",ref=" + img.CacheTo
+	} else if img.InlineCache {
+		sharedCacheExport = "type=inline"
+	}
+
+	cacheDir := filepath.Join(outputsDir, "cache")
+
+	var exportLocalCache bool
+	if exists(cacheDir) {
+		if sharedCacheExport != "" {
+			plan.Warnings = append(plan.Warnings, "not exporting to local cache; only one cache export is supported")
+		} else {
+			exportLocalCache = true
+			plan.PruneCacheDir = cacheDir
+			plan.CacheMaxSize = img.CacheMaxSize
+		}
+	}
+
+	localCaches, err := localCacheDirs(cacheDir)
+	if err != nil {
+		return BuildPlan{}, errors.Wrap(err, "find local caches")
+	}
+
+	targets := []TargetPlan{}
+	for _, t := range img.AdditionalTargets {
+		targets = append(targets, TargetPlan{Output: t, Target: t})
+	}
+
+	targets = append(targets, TargetPlan{Output: finalOutput, Target: img.Target})
+
+	for _, target := range targets {
+		if target.Target != "" {
+			target.FrontendOpts = append(target.FrontendOpts, "target="+target.Target)
+		}
+
+		// extra hosts are only passed to the final build
+		if target.Output == finalOutput && img.AddHosts != "" {
+			target.FrontendOpts = append(target.FrontendOpts, "add-hosts="+img.AddHosts)
+		}
+
+		if exists(filepath.Join(outputsDir, target.Output)) {
+			target.ImagePath = filepath.Join(outputsDir, target.Output, "image.tar")
+		}
+
+		for _, dir := range localCaches {
+			target.CacheImports = append(target.CacheImports, "type=local,src="+dir)
+		}
+
+		for _, ref := range img.CacheFrom {
+			target.CacheImports = append(target.CacheImports, "type=registry,ref="+ref)
+		}
+
+		target.CacheExport = sharedCacheExport
+
+		// each target exports its cache separately, as each export would
+		// otherwise overwrite the index written by the previous one; later
+		// targets can use the caches of earlier ones
+		if exportLocalCache {
+			dir := filepath.Join(cacheDir, target.Output)
+			target.CacheExport = "type=local,mode=" + img.CacheMode + ",dest=" + dir
+
+			if !containsString(localCaches, dir) {
+				localCaches = append(localCaches, dir)
+			}
+		}
+
+		plan.Targets = append(plan.Targets, target)
+	}
+
+	return plan, nil
+}
+
+// buildctlArgs are the buildctl flags for building the target which are
+// known up front, i.e. excluding anything served for the duration of the
+// build.
+func (plan BuildPlan) buildctlArgs(target TargetPlan) []string {
+	args := []string{
+		"build",
+		"--progress", "plain",
+		"--frontend", "dockerfile.v0",
+	}
+
+	if plan.ContextType == "directory" {
+		args = append(args, "--local", "context="+plan.Context)
+	}
+
+	if plan.Dockerfile != "" {
+		args = append(args,
+			"--local", "dockerfile="+filepath.Dir(plan.Dockerfile),
+			"--opt", "filename="+filepath.Base(plan.Dockerfile),
+		)
+
+		// a streamed context would otherwise provide the Dockerfile
+		if plan.ContextType != "directory" {
+			args = append(args, "--opt", "dockerfilekey=dockerfile")
+		}
+	}
+
+	for _, opt := range plan.FrontendOpts {
+		args = append(args, "--opt", opt)
+	}
+
+	for _, secret := range plan.Secrets {
+		if secret.Source == "file" {
+			args = append(args, "--secret", "id="+secret.ID+",src="+secret.Value)
+		}
+	}
+
+	for _, opt := range target.FrontendOpts {
+		args = append(args, "--opt", opt)
+	}
+
+	if target.ImagePath != "" {
+		args = append(args, "--output", "type=docker,dest="+target.ImagePath)
+	}
+
+	if target.CacheExport != "" {
+		args = append(args, "--export-cache", target.CacheExport)
+	}
+
+	for _, src := range target.CacheImports {
+		args = append(args, "--import-cache", src)
+	}
+
+	return args
+}
+
+// Write writes the plan in the given format: PlanFormatText (the default)
+// or PlanFormatJSON.
+func (plan BuildPlan) Write(out io.Writer, format string) error {
+	switch format {
+	case "", PlanFormatText:
+		return plan.writeText(out)
+	case PlanFormatJSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	default:
+		return fmt.Errorf("unknown plan format: %s", format)
+	}
+}
+
+func (plan BuildPlan) writeText(out io.Writer) error {
+	w := &planWriter{out: out}
+
+	context := plan.Context
+	if plan.ContextRef != "" {
+		context += " at " + plan.ContextRef
+	}
+
+	w.line(0, "context: %s (%s)", context, plan.ContextType)
+
+	if plan.Dockerfile != "" {
+		w.line(0, "dockerfile: %s", plan.Dockerfile)
+	} else {
+		w.line(0, "dockerfile: Dockerfile in the context")
+	}
+
+	w.list("frontend options:", plan.FrontendOpts)
+
+	if len(plan.ImageArgs) > 0 {
+		w.line(0, "image args (served from a local registry):")
+		for _, arg := range sortedKeys(plan.ImageArgs) {
+			w.line(1, "%s=%s", arg, plan.ImageArgs[arg])
+		}
+
+		if plan.ImageArgsPublicKey != "" {
+			w.line(1, "(signatures verified with %s)", plan.ImageArgsPublicKey)
+		}
+	}
+
+	if len(plan.BuildContexts) > 0 {
+		w.line(0, "build contexts:")
+		for _, name := range sortedKeys(plan.BuildContexts) {
+			w.line(1, "%s=%s", name, plan.BuildContexts[name])
+		}
+	}
+
+	if len(plan.Secrets) > 0 {
+		w.line(0, "secrets:")
+		for _, secret := range plan.Secrets {
+			w.line(1, "%s (%s: %s)", secret.ID, secret.Source, secret.Value)
+		}
+	}
+
+	if len(plan.SSH) > 0 {
+		w.line(0, "ssh:")
+		for _, id := range sortedSSHKeys(plan.SSH) {
+			w.line(1, "%s: %s", id, strings.Join(plan.SSH[id], ", "))
+		}
+	}
+
+	if plan.Policy != nil && len(plan.Policy.AllowedRegistries) > 0 {
+		w.line(0, "base images allowed from: %s (or pinned by digest)", strings.Join(plan.Policy.AllowedRegistries, ", "))
+	}
+
+	w.line(0, "targets:")
+	for _, target := range plan.Targets {
+		stage := target.Target
+		if stage == "" {
+			stage = "last stage"
+		}
+
+		w.line(1, "%s (%s):", target.Output, stage)
+
+		output := target.ImagePath
+		if output == "" {
+			output = "none (output does not exist)"
+		}
+
+		w.line(2, "output: %s", output)
+
+		if target.CacheExport != "" {
+			w.line(2, "cache export: %s", target.CacheExport)
+		}
+
+		if len(target.CacheImports) > 0 {
+			w.line(2, "cache imports:")
+			for _, src := range target.CacheImports {
+				w.line(3, "%s", src)
+			}
+		}
+	}
+
+	var after []string
+	if plan.PruneCacheDir != "" {
+		prune := "prune " + plan.PruneCacheDir
+		if plan.CacheMaxSize > 0 {
+			prune += fmt.Sprintf(" to %d MB", plan.CacheMaxSize)
+		}
+
+		after = append(after, prune)
+	}
+
+	if plan.SourceDateEpoch != nil {
+		after = append(after, fmt.Sprintf("normalize timestamps to %d", *plan.SourceDateEpoch))
+	}
+
+	after = append(after, "write digest")
+
+	if plan.Policy != nil {
+		after = append(after, "check image against policy")
+	}
+
+	if plan.SBOM {
+		after = append(after, "generate sbom")
+	}
+
+	if plan.ProvenanceRepository != "" {
+		after = append(after, "write provenance and attach it in "+plan.ProvenanceRepository)
+	} else if plan.Provenance {
+		after = append(after, "write provenance")
+	}
+
+	if plan.SignatureRepository != "" {
+		after = append(after, "sign and push the signature to "+plan.SignatureRepository)
+	} else if plan.Sign {
+		after = append(after, "sign")
+	}
+
+	if plan.UnpackRootfs {
+		after = append(after, "unpack rootfs")
+	}
+
+	w.list("after building:", after)
+
+	w.list("warnings:", plan.Warnings)
+
+	return w.err
+}
+
+// planWriter writes indented lines, keeping the first error.
+type planWriter struct {
+	out io.Writer
+	err error
+}
+
+func (w *planWriter) line(indent int, format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+
+	_, w.err = fmt.Fprintf(w.out, strings.Repeat("  ", indent)+format+"\n", args...)
+}
+
+func (w *planWriter) list(header string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+
+	w.line(0, "%s", header)
+	for _, item := range items {
+		w.line(1, "%s", item)
+	}
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,255 @@
+package prototype_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type PlanSuite struct {
+	suite.Suite
+	*require.Assertions
+
+	outputsDir string
+}
+
+func (s *PlanSuite) SetupTest() {
+	var err error
+	s.outputsDir, err = ioutil.TempDir("", "oci-image-prototype-plan")
+	s.NoError(err)
+}
+
+func (s *PlanSuite) TearDownTest() {
+	os.RemoveAll(s.outputsDir)
+}
+
+func (s *PlanSuite) TestPlanMultiTarget() {
+	s.mkdir("image")
+	s.mkdir("first")
+	s.mkdir("cache")
+
+	plan, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir:        "testdata/multi-target",
+		AdditionalTargets: []string{"first"},
+		BuildArgs:         []string{"some_arg=some_value"},
+		ImageArgs:         []string{"first_image=testdata/build-stats/trace.json"},
+		CacheFrom:         []string{"some-registry/cache"},
+		BuildkitSecrets: map[string]string{
+			"file_secret": "testdata/buildkit-secret/secret",
+		},
+		BuildkitSecretValues: map[string]string{
+			"value_secret": "hunter2",
+		},
+	}, s.outputsDir)
+	s.NoError(err)
+
+	s.Equal(prototype.BuildPlan{
+		Context:      "testdata/multi-target",
+		ContextType:  "directory",
+		Dockerfile:   "testdata/multi-target/Dockerfile",
+		FrontendOpts: []string{"build-arg:some_arg=some_value"},
+		ImageArgs: map[string]string{
+			"first_image": "testdata/build-stats/trace.json",
+		},
+		Secrets: []prototype.SecretPlan{
+			{ID: "file_secret", Source: "file", Value: "testdata/buildkit-secret/secret"},
+			{ID: "value_secret", Source: "value", Value: "***"},
+		},
+		Targets: []prototype.TargetPlan{
+			{
+				Output:       "first",
+				Target:       "first",
+				ImagePath:    s.outputPath("first", "image.tar"),
+				FrontendOpts: []string{"target=first"},
+				CacheImports: []string{"type=registry,ref=some-registry/cache"},
+				CacheExport:  "type=local,mode=min,dest=" + s.outputPath("cache", "first"),
+			},
+			{
+				Output:    "image",
+				ImagePath: s.outputPath("image", "image.tar"),
+				CacheImports: []string{
+					"type=local,src=" + s.outputPath("cache", "first"),
+					"type=registry,ref=some-registry/cache",
+				},
+				CacheExport: "type=local,mode=min,dest=" + s.outputPath("cache", "image"),
+			},
+		},
+		PruneCacheDir: s.outputPath("cache"),
+	}, plan)
+}
+
+func (s *PlanSuite) TestPlanWithoutOutputs() {
+	plan, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir:  "testdata/basic",
+		InlineCache: true,
+	}, s.outputsDir)
+	s.NoError(err)
+
+	s.Equal([]prototype.TargetPlan{
+		{Output: "image", CacheExport: "type=inline"},
+	}, plan.Targets)
+	s.Empty(plan.PruneCacheDir)
+}
+
+func (s *PlanSuite) TestPlanAddHosts() {
+	plan, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir:        "testdata/multi-target",
+		AdditionalTargets: []string{"first"},
+		AddHosts:          "some-host=10.0.0.1",
+	}, s.outputsDir)
+	s.NoError(err)
+
+	s.Empty(plan.FrontendOpts)
+	s.Equal([]string{"target=first"}, plan.Targets[0].FrontendOpts)
+	s.Equal([]string{"add-hosts=some-host=10.0.0.1"}, plan.Targets[1].FrontendOpts)
+}
+
+func (s *PlanSuite) TestPlanSingleCacheExport() {
+	s.mkdir("cache")
+
+	plan, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		CacheTo:    "some-registry/cache",
+	}, s.outputsDir)
+	s.NoError(err)
+
+	s.Equal("type=registry,mode=min,ref=some-registry/cache", plan.Targets[0].CacheExport)
+	s.Empty(plan.PruneCacheDir)
+	s.Equal([]string{"not exporting to local cache; only one cache export is supported"}, plan.Warnings)
+}
+
+func (s *PlanSuite) TestPlanProvenance() {
+	plan, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir:           "testdata/basic",
+		ProvenanceRepository: "some-registry/attestations",
+	}, s.outputsDir)
+	s.NoError(err)
+
+	s.True(plan.Provenance)
+	s.Equal("some-registry/attestations", plan.ProvenanceRepository)
+
+	buf := new(bytes.Buffer)
+	err = plan.Write(buf, prototype.PlanFormatText)
+	s.NoError(err)
+
+	s.Contains(buf.String(), "  write provenance and attach it in some-registry/attestations\n")
+}
+
+func (s *PlanSuite) TestPlanSigning() {
+	plan, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir:          "testdata/basic",
+		SigningKey:          "testdata/basic/Dockerfile",
+		SignatureRepository: "some-registry/signatures",
+		ImageArgs:           []string{"base_image=testdata/basic/Dockerfile"},
+		ImageArgsPublicKey:  "testdata/basic/Dockerfile",
+	}, s.outputsDir)
+	s.NoError(err)
+
+	s.True(plan.Sign)
+	s.Equal("testdata/basic/Dockerfile", plan.ImageArgsPublicKey)
+
+	buf := new(bytes.Buffer)
+	err = plan.Write(buf, prototype.PlanFormatText)
+	s.NoError(err)
+
+	s.Contains(buf.String(), "  (signatures verified with testdata/basic/Dockerfile)\n")
+	s.Contains(buf.String(), "  sign and push the signature to some-registry/signatures\n")
+}
+
+func (s *PlanSuite) TestPlanPolicy() {
+	plan, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		Policy: &prototype.Policy{
+			AllowedRegistries: []string{"docker.io", "registry.example.com"},
+			NonRootUser:       true,
+		},
+	}, s.outputsDir)
+	s.NoError(err)
+
+	buf := new(bytes.Buffer)
+	err = plan.Write(buf, prototype.PlanFormatText)
+	s.NoError(err)
+
+	s.Contains(buf.String(), "base images allowed from: docker.io, registry.example.com (or pinned by digest)\n")
+	s.Contains(buf.String(), "  check image against policy\n")
+}
+
+func (s *PlanSuite) TestPlanInvalid() {
+	_, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		BuildArgs:  []string{"no_value"},
+	}, s.outputsDir)
+	s.EqualError(err, "config: invalid configuration:\n  - build_args[0]: expected key=value: no_value")
+}
+
+func (s *PlanSuite) TestWriteText() {
+	s.mkdir("image")
+
+	plan, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		Target:     "some-stage",
+		BuildkitSecretValues: map[string]string{
+			"value_secret": "hunter2",
+		},
+	}, s.outputsDir)
+	s.NoError(err)
+
+	buf := new(bytes.Buffer)
+	err = plan.Write(buf, prototype.PlanFormatText)
+	s.NoError(err)
+
+	s.Equal(`context: testdata/basic (directory)
+dockerfile: testdata/basic/Dockerfile
+secrets:
+  value_secret (value: ***)
+targets:
+  image (some-stage):
+    output: `+s.outputPath("image", "image.tar")+`
+after building:
+  write digest
+`, buf.String())
+	s.NotContains(buf.String(), "hunter2")
+}
+
+func (s *PlanSuite) TestWriteJSON() {
+	plan, err := prototype.PlanBuild(prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		BuildkitSecretValues: map[string]string{
+			"value_secret": "hunter2",
+		},
+	}, s.outputsDir)
+	s.NoError(err)
+
+	buf := new(bytes.Buffer)
+	err = plan.Write(buf, prototype.PlanFormatJSON)
+	s.NoError(err)
+	s.NotContains(buf.String(), "hunter2")
+
+	var decoded prototype.BuildPlan
+	err = json.Unmarshal(buf.Bytes(), &decoded)
+	s.NoError(err)
+	s.Equal(plan, decoded)
+}
+
+func (s *PlanSuite) mkdir(path ...string) {
+	err := os.MkdirAll(s.outputPath(path...), 0755)
+	s.NoError(err)
+}
+
+func (s *PlanSuite) outputPath(path ...string) string {
+	return filepath.Join(append([]string{s.outputsDir}, path...)...)
+}
+
+func TestPlan(t *testing.T) {
+	suite.Run(t, &PlanSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -0,0 +1,531 @@
+package prototype
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/pkg/errors"
+)
+
+// PolicyViolation is a rule that a base image or built image broke.
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError reports every violation found in the base images or in a
+// target's image.
+type PolicyError struct {
+	// The output whose image was checked, or empty for the base images.
+	Target     string
+	Violations []PolicyViolation
+}
+
+func (err PolicyError) Error() string {
+	msg := "base images violate policy:"
+	if err.Target != "" {
+		msg = fmt.Sprintf("image '%s' violates policy:", err.Target)
+	}
+
+	for _, violation := range err.Violations {
+		msg += "\n  - " + violation.Rule + ": " + violation.Message
+	}
+
+	return msg
+}
+
+// maxReportedFiles limits how many world-writable files are listed.
+const maxReportedFiles = 10
+
+// BaseImage is an image referred to by a FROM instruction.
+type BaseImage struct {
+	Line int
+
+	// The image after substituting args.
+	Ref string
+}
+
+var (
+	dockerfileArg   = regexp.MustCompile(`\$(?:\{([A-Za-z_][A-Za-z0-9_]*)(?::?-([^}]*))?\}|([A-Za-z_][A-Za-z0-9_]*))`)
+	parserDirective = regexp.MustCompile(`^#\s*([A-Za-z]+)\s*=\s*(\S+)$`)
+)
+
+// DockerfileBaseImages returns the images which FROM instructions refer to,
+// after substituting the args declared before the first FROM (overridden by
+// buildArgs). 'scratch' and references to earlier stages are skipped.
+func DockerfileBaseImages(dockerfile io.Reader, buildArgs map[string]string) ([]BaseImage, error) {
+	args := map[string]string{}
+	stages := map[string]bool{}
+	seenFrom := false
+
+	var images []BaseImage
+
+	err := dockerfileInstructions(dockerfile, func(line int, instruction string, operands []string) error {
+		switch instruction {
+		case "ARG":
+			if seenFrom {
+				return nil
+			}
+
+			for _, operand := range operands {
+				segs := strings.SplitN(operand, "=", 2)
+
+				value, found := buildArgs[segs[0]]
+				if !found && len(segs) == 2 {
+					value = strings.Trim(expandArgs(segs[1], args), `"'`)
+				} else if !found {
+					// declared without a value, so it stays unset
+					continue
+				}
+
+				args[segs[0]] = value
+			}
+		case "FROM":
+			seenFrom = true
+
+			var positional []string
+			for _, operand := range operands {
+				if !strings.HasPrefix(operand, "--") {
+					positional = append(positional, operand)
+				}
+			}
+
+			if len(positional) == 0 {
+				return fmt.Errorf("line %d: FROM requires an image", line)
+			}
+
+			ref := expandArgs(positional[0], args)
+			if ref != "scratch" && !stages[strings.ToLower(ref)] {
+				images = append(images, BaseImage{Line: line, Ref: ref})
+			}
+
+			if len(positional) == 3 && strings.EqualFold(positional[1], "AS") {
+				stages[strings.ToLower(positional[2])] = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// dockerfileInstructions calls fn with each instruction in the Dockerfile,
+// joining continuation lines and skipping comments.
+func dockerfileInstructions(dockerfile io.Reader, fn func(line int, instruction string, operands []string) error) error {
+	scanner := bufio.NewScanner(dockerfile)
+
+	var current string
+	start, lineNum := 0, 0
+	escape := `\`
+	directives := true
+
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if directives {
+			directive := parserDirective.FindStringSubmatch(trimmed)
+			if directive != nil {
+				if strings.EqualFold(directive[1], "escape") {
+					escape = directive[2]
+				}
+
+				continue
+			}
+		}
+
+		directives = false
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if current == "" {
+			start = lineNum
+		}
+
+		if strings.HasSuffix(trimmed, escape) {
+			current += strings.TrimSuffix(trimmed, escape) + " "
+			continue
+		}
+
+		current += trimmed
+
+		fields := strings.Fields(current)
+		current = ""
+
+		err := fn(start, strings.ToUpper(fields[0]), fields[1:])
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// expandArgs substitutes $VAR, ${VAR}, ${VAR:-default} and ${VAR-default}
+// with the args' values.
+func expandArgs(s string, args map[string]string) string {
+	return dockerfileArg.ReplaceAllStringFunc(s, func(match string) string {
+		segs := dockerfileArg.FindStringSubmatch(match)
+
+		arg := segs[1]
+		if arg == "" {
+			arg = segs[3]
+		}
+
+		// ${VAR:-default} applies the default if VAR is unset or empty,
+		// ${VAR-default} only if it is unset
+		value, set := args[arg]
+		switch rest := strings.TrimPrefix(match, "${"+arg); {
+		case strings.HasPrefix(rest, ":-") && value == "":
+			value = segs[2]
+		case strings.HasPrefix(rest, "-") && !set:
+			value = segs[2]
+		}
+
+		return value
+	})
+}
+
+// readDockerfile reads the Dockerfile that will be built: the configured
+// file, or the Dockerfile at the root of a tarball or git ref context.
+func readDockerfile(img OCIImage) ([]byte, error) {
+	switch {
+	case img.DockerfilePath != "":
+		return ioutil.ReadFile(img.DockerfilePath)
+	case img.ContextRef != "":
+		buf := new(bytes.Buffer)
+
+		cmd := exec.Command("git", "-C", img.ContextDir, "show", img.ContextRef+":Dockerfile")
+		cmd.Stdout = buf
+		cmd.Stderr = os.Stderr
+
+		err := cmd.Run()
+		if err != nil {
+			return nil, errors.Wrap(err, "git show")
+		}
+
+		return buf.Bytes(), nil
+	default:
+		return readArchiveDockerfile(img.ContextDir)
+	}
+}
+
+func readArchiveDockerfile(archive string) ([]byte, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var r io.Reader = file
+	if !strings.HasSuffix(archive, ".tar") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+
+		defer gz.Close()
+
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no Dockerfile in %s", archive)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if path.Clean(header.Name) == "Dockerfile" {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// CheckBaseImages checks that each base image comes from an allowed
+// registry or is pinned by digest. Refs which are build contexts are
+// resolved to their images, and only 'docker-image://' build contexts are
+// checked.
+//
+// Image args, like local build contexts, are treated as pinned: they are
+// tarballs from the build's inputs, served as-is rather than pulled, so
+// their source is not checked.
+func (policy Policy) CheckBaseImages(images []BaseImage, imageArgs map[string]string, buildContexts map[string]string) []PolicyViolation {
+	if len(policy.AllowedRegistries) == 0 {
+		return nil
+	}
+
+	var violations []PolicyViolation
+	for _, image := range images {
+		ref := image.Ref
+
+		if _, found := imageArgs[ref]; found {
+			continue
+		}
+
+		if src, found := buildContexts[ref]; found {
+			if !strings.HasPrefix(src, dockerImagePrefix) {
+				continue
+			}
+
+			ref = strings.TrimPrefix(src, dockerImagePrefix)
+		}
+
+		parsed, err := name.ParseReference(ref)
+		if err != nil {
+			violations = append(violations, PolicyViolation{
+				Rule:    "allowed_registries",
+				Message: fmt.Sprintf("line %d: invalid image %s: %s", image.Line, ref, err),
+			})
+
+			continue
+		}
+
+		if _, pinned := parsed.(name.Digest); pinned {
+			continue
+		}
+
+		if !policy.allowsRepository(parsed.Context()) {
+			violations = append(violations, PolicyViolation{
+				Rule:    "allowed_registries",
+				Message: fmt.Sprintf("line %d: %s is not from an allowed registry and is not pinned by digest", image.Line, ref),
+			})
+		}
+	}
+
+	return violations
+}
+
+func (policy Policy) allowsRepository(repo name.Repository) bool {
+	for _, allowed := range policy.AllowedRegistries {
+		segs := strings.SplitN(strings.TrimSuffix(allowed, "/"), "/", 2)
+
+		registry, err := name.NewRegistry(segs[0])
+		if err != nil {
+			continue
+		}
+
+		if registry.Name() != repo.RegistryStr() {
+			continue
+		}
+
+		if len(segs) == 1 {
+			return true
+		}
+
+		repoPath := repo.RepositoryStr()
+		if repoPath == segs[1] || strings.HasPrefix(repoPath, segs[1]+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckImage checks the built image's config, size, layers and files.
+func (policy Policy) CheckImage(image v1.Image) ([]PolicyViolation, error) {
+	var violations []PolicyViolation
+
+	config, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "get config")
+	}
+
+	if policy.NonRootUser && isRootUser(config.Config.User) {
+		user := config.Config.User
+		if user == "" {
+			user = "root (by default)"
+		}
+
+		violations = append(violations, PolicyViolation{
+			Rule:    "non_root_user",
+			Message: "runs as " + user,
+		})
+	}
+
+	for _, label := range policy.RequiredLabels {
+		if _, found := config.Config.Labels[label]; !found {
+			violations = append(violations, PolicyViolation{
+				Rule:    "required_labels",
+				Message: "missing label " + label,
+			})
+		}
+	}
+
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "get layers")
+	}
+
+	if policy.MaxLayers > 0 && len(layers) > policy.MaxLayers {
+		violations = append(violations, PolicyViolation{
+			Rule:    "max_layers",
+			Message: fmt.Sprintf("has %d layers, more than %d", len(layers), policy.MaxLayers),
+		})
+	}
+
+	if policy.MaxSize > 0 {
+		var size int64
+		for _, layer := range layers {
+			layerSize, err := layer.Size()
+			if err != nil {
+				return nil, errors.Wrap(err, "get layer size")
+			}
+
+			size += layerSize
+		}
+
+		if size > policy.MaxSize*1024*1024 {
+			violations = append(violations, PolicyViolation{
+				Rule:    "max_size",
+				Message: fmt.Sprintf("is %s, more than %d MB", formatBytes(size), policy.MaxSize),
+			})
+		}
+	}
+
+	if policy.NoWorldWritable {
+		files, err := worldWritableFiles(image)
+		if err != nil {
+			return nil, errors.Wrap(err, "find world-writable files")
+		}
+
+		for i, file := range files {
+			if i == maxReportedFiles {
+				violations = append(violations, PolicyViolation{
+					Rule:    "no_world_writable",
+					Message: fmt.Sprintf("...and %d more world-writable files", len(files)-maxReportedFiles),
+				})
+
+				break
+			}
+
+			violations = append(violations, PolicyViolation{
+				Rule:    "no_world_writable",
+				Message: file + " is world-writable",
+			})
+		}
+	}
+
+	return violations, nil
+}
+
+func isRootUser(user string) bool {
+	uid := strings.SplitN(user, ":", 2)[0]
+	return uid == "" || uid == "root" || uid == "0"
+}
+
+// worldWritableFiles walks the image's flattened filesystem, as unpacking
+// it would, for files and directories writable by anyone. Symlinks and
+// sticky directories are skipped.
+func worldWritableFiles(image v1.Image) ([]string, error) {
+	rc := mutate.Extract(image)
+	defer rc.Close()
+
+	var files []string
+
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		mode := header.FileInfo().Mode()
+		if mode&os.ModeSymlink != 0 || (mode.IsDir() && mode&os.ModeSticky != 0) {
+			continue
+		}
+
+		if mode.Perm()&0002 != 0 {
+			files = append(files, "/"+strings.TrimPrefix(path.Clean(header.Name), "/"))
+		}
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// checkBaseImagePolicy checks the FROM instructions of the Dockerfile that
+// will be built against the policy.
+func checkBaseImagePolicy(img OCIImage, plan BuildPlan) error {
+	if img.Policy == nil || len(img.Policy.AllowedRegistries) == 0 {
+		return nil
+	}
+
+	dockerfile, err := readDockerfile(img)
+	if err != nil {
+		return errors.Wrap(err, "read dockerfile")
+	}
+
+	buildArgs := map[string]string{}
+	for _, arg := range img.BuildArgs {
+		segs := strings.SplitN(arg, "=", 2)
+		buildArgs[segs[0]] = segs[1]
+	}
+
+	// image args are set to the image served from the local registry, so
+	// are identified by their build arg's name
+	for arg := range plan.ImageArgs {
+		buildArgs[arg] = arg
+	}
+
+	images, err := DockerfileBaseImages(bytes.NewReader(dockerfile), buildArgs)
+	if err != nil {
+		return errors.Wrap(err, "parse dockerfile")
+	}
+
+	violations := img.Policy.CheckBaseImages(images, plan.ImageArgs, plan.BuildContexts)
+	if len(violations) > 0 {
+		return PolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// checkImagePolicy checks a target's built image against the policy.
+func checkImagePolicy(policy *Policy, output string, image v1.Image) error {
+	if policy == nil {
+		return nil
+	}
+
+	violations, err := policy.CheckImage(image)
+	if err != nil {
+		return err
+	}
+
+	if len(violations) > 0 {
+		return PolicyError{Target: output, Violations: violations}
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package prototype_test
+
+import (
+	"archive/tar"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type PolicySuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *PolicySuite) TestDockerfileBaseImages() {
+	dockerfile := `# syntax=docker/dockerfile:1.4
+ARG registry=docker.io
+ARG tag="3.15"
+ARG base_image
+
+FROM --platform=$BUILDPLATFORM ${registry}/library/golang:1.17 AS builder
+ARG tag=ignored-within-a-stage
+RUN go build
+
+# comments are skipped
+FROM builder AS tested
+FROM ${base_image}
+FROM scratch AS empty
+from \
+  alpine:${tag}@sha256:abcd
+FROM ${missing:-busybox}
+COPY --from=builder /app /app
+`
+
+	images, err := prototype.DockerfileBaseImages(strings.NewReader(dockerfile), map[string]string{
+		"registry":   "registry.example.com",
+		"base_image": "base_image",
+	})
+	s.NoError(err)
+
+	s.Equal([]prototype.BaseImage{
+		{Line: 6, Ref: "registry.example.com/library/golang:1.17"},
+		{Line: 12, Ref: "base_image"},
+		{Line: 14, Ref: "alpine:3.15@sha256:abcd"},
+		{Line: 16, Ref: "busybox"},
+	}, images)
+}
+
+func (s *PolicySuite) TestDockerfileBaseImagesDefaults() {
+	dockerfile := `ARG empty=""
+ARG unset
+FROM busybox${empty-:latest}
+FROM busybox${empty:-:latest}
+FROM busybox${unset-:latest}
+FROM busybox${missing-:latest}
+`
+
+	images, err := prototype.DockerfileBaseImages(strings.NewReader(dockerfile), nil)
+	s.NoError(err)
+
+	s.Equal([]prototype.BaseImage{
+		{Line: 3, Ref: "busybox"},
+		{Line: 4, Ref: "busybox:latest"},
+		{Line: 5, Ref: "busybox:latest"},
+		{Line: 6, Ref: "busybox:latest"},
+	}, images)
+}
+
+func (s *PolicySuite) TestDockerfileBaseImagesEscapeDirective() {
+	dockerfile := "# escape=`\nFROM `\n  busybox\n"
+
+	images, err := prototype.DockerfileBaseImages(strings.NewReader(dockerfile), nil)
+	s.NoError(err)
+
+	s.Equal([]prototype.BaseImage{{Line: 2, Ref: "busybox"}}, images)
+}
+
+func (s *PolicySuite) TestCheckBaseImages() {
+	policy := prototype.Policy{
+		AllowedRegistries: []string{"docker.io/library", "registry.example.com/team/"},
+	}
+
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	violations := policy.CheckBaseImages([]prototype.BaseImage{
+		{Line: 1, Ref: "busybox"},
+		{Line: 2, Ref: "registry.example.com/team/base:latest"},
+		{Line: 3, Ref: "registry.example.com/teammate/base"},
+		{Line: 4, Ref: "quay.io/some/image@" + digest},
+		{Line: 5, Ref: "quay.io/some/image:latest"},
+		{Line: 6, Ref: "some_image"},
+		{Line: 7, Ref: "deps"},
+		{Line: 8, Ref: "assets"},
+		{Line: 9, Ref: "Not An Image"},
+	}, map[string]string{
+		"some_image": "some-image.tar",
+	}, map[string]string{
+		"deps":   "docker-image://docker.io/someone/deps:latest",
+		"assets": "some-assets",
+	})
+
+	s.Equal([]prototype.PolicyViolation{
+		{Rule: "allowed_registries", Message: "line 3: registry.example.com/teammate/base is not from an allowed registry and is not pinned by digest"},
+		{Rule: "allowed_registries", Message: "line 5: quay.io/some/image:latest is not from an allowed registry and is not pinned by digest"},
+		{Rule: "allowed_registries", Message: "line 7: docker.io/someone/deps:latest is not from an allowed registry and is not pinned by digest"},
+		{Rule: "allowed_registries", Message: "line 9: invalid image Not An Image: could not parse reference: Not An Image"},
+	}, violations)
+
+	s.Empty(prototype.Policy{}.CheckBaseImages([]prototype.BaseImage{{Line: 1, Ref: "quay.io/anything"}}, nil, nil))
+}
+
+func (s *PolicySuite) TestCheckImage() {
+	image := craftImage(s.Assertions,
+		[]fileEntry{
+			{name: "tmp", typeflag: tar.TypeDir, mode: 01777},
+			{name: "etc/shared", content: "anyone can write me", mode: 0666},
+			{name: "etc/private", content: "only root can write me", mode: 0644},
+			{name: "lib/link", typeflag: tar.TypeSymlink, mode: 0777},
+		},
+		[]fileEntry{
+			{name: "var/cache", typeflag: tar.TypeDir, mode: 0777},
+		},
+	)
+
+	image = s.withConfig(image, func(config *v1.Config) {
+		config.Labels = map[string]string{"org.opencontainers.image.source": "some-repo"}
+	})
+
+	violations, err := prototype.Policy{
+		NonRootUser:     true,
+		RequiredLabels:  []string{"org.opencontainers.image.source", "org.opencontainers.image.revision"},
+		MaxLayers:       1,
+		MaxSize:         1,
+		NoWorldWritable: true,
+	}.CheckImage(image)
+	s.NoError(err)
+
+	s.Equal([]prototype.PolicyViolation{
+		{Rule: "non_root_user", Message: "runs as root (by default)"},
+		{Rule: "required_labels", Message: "missing label org.opencontainers.image.revision"},
+		{Rule: "max_layers", Message: "has 2 layers, more than 1"},
+		{Rule: "no_world_writable", Message: "/etc/shared is world-writable"},
+		{Rule: "no_world_writable", Message: "/var/cache is world-writable"},
+	}, violations)
+}
+
+func (s *PolicySuite) TestCheckImageUser() {
+	for user, root := range map[string]bool{
+		"":           true,
+		"root":       true,
+		"0":          true,
+		"0:1000":     true,
+		"1000":       false,
+		"nobody":     false,
+		"1000:0":     false,
+		"someone:0":  false,
+		"root:staff": true,
+	} {
+		image := s.withConfig(craftImage(s.Assertions), func(config *v1.Config) {
+			config.User = user
+		})
+
+		violations, err := prototype.Policy{NonRootUser: true}.CheckImage(image)
+		s.NoError(err)
+
+		if root {
+			s.Len(violations, 1, user)
+		} else {
+			s.Empty(violations, user)
+		}
+	}
+}
+
+func (s *PolicySuite) TestPolicyError() {
+	err := prototype.PolicyError{
+		Target: "image",
+		Violations: []prototype.PolicyViolation{
+			{Rule: "non_root_user", Message: "runs as root"},
+			{Rule: "max_layers", Message: "has 2 layers, more than 1"},
+		},
+	}
+	s.EqualError(err, "image 'image' violates policy:\n  - non_root_user: runs as root\n  - max_layers: has 2 layers, more than 1")
+
+	err = prototype.PolicyError{
+		Violations: []prototype.PolicyViolation{
+			{Rule: "allowed_registries", Message: "line 1: busybox is not from an allowed registry and is not pinned by digest"},
+		},
+	}
+	s.EqualError(err, "base images violate policy:\n  - allowed_registries: line 1: busybox is not from an allowed registry and is not pinned by digest")
+}
+
+func (s *PolicySuite) withConfig(image v1.Image, update func(*v1.Config)) v1.Image {
+	configFile, err := image.ConfigFile()
+	s.NoError(err)
+
+	config := configFile.Config
+	update(&config)
+
+	image, err = mutate.Config(image, config)
+	s.NoError(err)
+
+	return image
+}
+
+func TestPolicy(t *testing.T) {
+	suite.Run(t, &PolicySuite{
+		Assertions: require.New(t),
+	})
+}
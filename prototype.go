@@ -9,6 +9,8 @@ func Prototype() prototype.Prototype {
 		prototype.WithIcon("mdi:oci"),
 		prototype.WithObject(OCIImage{},
 			prototype.WithMessage("build", RunBuild, BuildConfig),
+			prototype.WithMessage("doctor", RunDoctor, DoctorConfig),
+			prototype.WithMessage("scan", RunScan, ScanConfig),
 		),
 	)
 }
@@ -0,0 +1,407 @@
+package prototype
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ProvenanceFile is the file next to image.tar which the provenance
+// statement is written to.
+const ProvenanceFile = "provenance.json"
+
+const (
+	inTotoStatementType  = "https://in-toto.io/Statement/v0.1"
+	slsaProvenanceType   = "https://slsa.dev/provenance/v0.2"
+	provenanceBuilderID  = "https://github.com/aoldershaw/oci-image-prototype"
+	provenanceBuildType  = "https://github.com/aoldershaw/oci-image-prototype/build@v1"
+	inTotoMediaType      = types.MediaType("application/vnd.in-toto+json")
+	provenanceAttachment = "att"
+)
+
+// ProvenanceStatement is an in-toto statement of SLSA provenance for an
+// image.
+type ProvenanceStatement struct {
+	Type          string              `json:"_type"`
+	PredicateType string              `json:"predicateType"`
+	Subject       []ProvenanceSubject `json:"subject"`
+	Predicate     ProvenancePredicate `json:"predicate"`
+}
+
+// ProvenanceSubject is the image the provenance is for, named after the
+// output it was built to.
+type ProvenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// ProvenancePredicate is a SLSA v0.2 provenance predicate.
+type ProvenancePredicate struct {
+	Builder    ProvenanceBuilder    `json:"builder"`
+	BuildType  string               `json:"buildType"`
+	Invocation ProvenanceInvocation `json:"invocation"`
+	Metadata   ProvenanceMetadata   `json:"metadata"`
+	Materials  []ProvenanceMaterial `json:"materials"`
+}
+
+type ProvenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type ProvenanceInvocation struct {
+	// The configuration, with inline secret values redacted.
+	Parameters OCIImage `json:"parameters"`
+
+	// The target that was built, and the output it was written to.
+	Environment map[string]string `json:"environment"`
+}
+
+type ProvenanceMetadata struct {
+	BuildStartedOn  time.Time `json:"buildStartedOn"`
+	BuildFinishedOn time.Time `json:"buildFinishedOn"`
+	Reproducible    bool      `json:"reproducible"`
+}
+
+// ProvenanceMaterial is an input to the build: the context, Dockerfile,
+// context inputs, build contexts and base images.
+//
+// Local files are identified as 'file:<path>', with directories digested
+// with TreeDigest, and image tarballs by their manifest digest. Images pulled
+// from a registry are identified as 'docker-image://<repository>'.
+type ProvenanceMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// builtTarget is what happened while building a target, for its provenance.
+type builtTarget struct {
+	started  time.Time
+	finished time.Time
+
+	// The local inputs, followed by the base images the target resolved.
+	materials []ProvenanceMaterial
+}
+
+// fromInstruction matches a FROM vertex with the digest BuildKit resolved
+// the image to, e.g. '[stage-0 1/2] FROM docker.io/library/alpine@sha256:...'.
+var fromInstruction = regexp.MustCompile(`\] FROM (\S+)@sha256:([0-9a-f]+)$`)
+
+// ParseBaseImages reads the images that FROM instructions were resolved to
+// from the stream of solve statuses written by buildctl's --trace flag.
+//
+// Images served from localhost (i.e. image args and build contexts) are
+// skipped; ProvenanceMaterials identifies them by their tarballs instead.
+func ParseBaseImages(trace io.Reader) ([]ProvenanceMaterial, error) {
+	var materials []ProvenanceMaterial
+	seen := map[string]bool{}
+
+	decoder := json.NewDecoder(trace)
+	for {
+		var status solveStatus
+		err := decoder.Decode(&status)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decode solve status: %w", err)
+		}
+
+		for _, vertex := range status.Vertexes {
+			match := fromInstruction.FindStringSubmatch(vertex.Name)
+			if match == nil || strings.HasPrefix(match[1], "localhost:") {
+				continue
+			}
+
+			uri := dockerImagePrefix + match[1]
+			if seen[uri+match[2]] {
+				continue
+			}
+
+			seen[uri+match[2]] = true
+
+			materials = append(materials, ProvenanceMaterial{
+				URI:    uri,
+				Digest: map[string]string{"sha256": match[2]},
+			})
+		}
+	}
+
+	return materials, nil
+}
+
+func readBaseImages(tracePath string) ([]ProvenanceMaterial, error) {
+	trace, err := os.Open(tracePath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer trace.Close()
+
+	return ParseBaseImages(trace)
+}
+
+// ProvenanceMaterials digests the local inputs to the build: the context
+// (or the commit of a git ref), the Dockerfile, each context input and build
+// context, and the image args' tarballs.
+func ProvenanceMaterials(img OCIImage) ([]ProvenanceMaterial, error) {
+	sanitize(&img)
+
+	var materials []ProvenanceMaterial
+
+	add := func(path string, digest func(string) (string, error)) error {
+		sum, err := digest(path)
+		if err != nil {
+			return errors.Wrapf(err, "digest %s", path)
+		}
+
+		materials = append(materials, ProvenanceMaterial{
+			URI:    "file:" + filepath.ToSlash(path),
+			Digest: map[string]string{"sha256": sum},
+		})
+
+		return nil
+	}
+
+	switch {
+	case img.ContextRef != "":
+		commit, err := resolveCommit(img.ContextDir, img.ContextRef)
+		if err != nil {
+			return nil, err
+		}
+
+		materials = append(materials, ProvenanceMaterial{
+			URI:    "git+file:" + filepath.ToSlash(img.ContextDir),
+			Digest: map[string]string{"sha1": commit},
+		})
+	case isContextArchive(img.ContextDir):
+		err := add(img.ContextDir, FileDigest)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		err := add(img.ContextDir, TreeDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if img.DockerfilePath != "" {
+		err := add(img.DockerfilePath, FileDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, input := range sortedKeys(img.ContextInputs) {
+		err := add(filepath.Join(img.ContextDir, img.ContextInputs[input]), TreeDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, contextName := range sortedKeys(img.BuildContexts) {
+		src := img.BuildContexts[contextName]
+
+		var err error
+		switch {
+		case strings.HasPrefix(src, dockerImagePrefix):
+			materials = append(materials, ProvenanceMaterial{URI: src})
+		case isImageTarball(src):
+			err = add(src, imageTarballDigest)
+		default:
+			err = add(src, TreeDigest)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, arg := range img.ImageArgs {
+		err := add(strings.SplitN(arg, "=", 2)[1], imageTarballDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return materials, nil
+}
+
+// FileDigest returns the hex sha256 of a file's content.
+func FileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// TreeDigest returns a hex sha256 of a directory which only depends on the
+// path, type, permissions and content (or symlink target) of every file
+// within it.
+func TreeDigest(dir string) (string, error) {
+	hash := sha256.New()
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		var content string
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			content, err = os.Readlink(path)
+		case info.Mode().IsRegular():
+			content, err = FileDigest(path)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\n", filepath.ToSlash(rel), info.Mode(), content)
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func imageTarballDigest(path string) (string, error) {
+	image, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	return digest.Hex, nil
+}
+
+// newProvenance describes how a target's image was built from the
+// materials.
+func newProvenance(img OCIImage, target TargetPlan, image v1.Image, built builtTarget) (ProvenanceStatement, error) {
+	digest, err := image.Digest()
+	if err != nil {
+		return ProvenanceStatement{}, errors.Wrap(err, "get manifest digest")
+	}
+
+	return ProvenanceStatement{
+		Type:          inTotoStatementType,
+		PredicateType: slsaProvenanceType,
+		Subject: []ProvenanceSubject{
+			{
+				Name:   target.Output,
+				Digest: map[string]string{digest.Algorithm: digest.Hex},
+			},
+		},
+		Predicate: ProvenancePredicate{
+			Builder:   ProvenanceBuilder{ID: provenanceBuilderID},
+			BuildType: provenanceBuildType,
+			Invocation: ProvenanceInvocation{
+				Parameters: redactSecretValues(img),
+				Environment: map[string]string{
+					"output": target.Output,
+					"target": target.Target,
+				},
+			},
+			Metadata: ProvenanceMetadata{
+				BuildStartedOn:  built.started.UTC(),
+				BuildFinishedOn: built.finished.UTC(),
+				Reproducible:    img.Reproducible,
+			},
+			Materials: built.materials,
+		},
+	}, nil
+}
+
+// redactSecretValues returns a copy of img with the values of inline
+// secrets masked.
+func redactSecretValues(img OCIImage) OCIImage {
+	if len(img.BuildkitSecretValues) == 0 {
+		return img
+	}
+
+	redacted := map[string]string{}
+	for id := range img.BuildkitSecretValues {
+		redacted[id] = secretMask
+	}
+
+	img.BuildkitSecretValues = redacted
+
+	return img
+}
+
+// writeProvenance writes the statement to provenance.json in outputDir, and
+// attaches it to the image in the repository if one is configured.
+func writeProvenance(outputDir string, image v1.Image, statement ProvenanceStatement, repository string) error {
+	payload, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(outputDir, ProvenanceFile), append(payload, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	if repository == "" {
+		return nil
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		return errors.Wrap(err, "get manifest digest")
+	}
+
+	ref, err := AttachArtifact(repository, digest, provenanceAttachment, Artifact{
+		MediaType: inTotoMediaType,
+		Payload:   payload,
+		Annotations: map[string]string{
+			"predicateType": slsaProvenanceType,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "attach provenance")
+	}
+
+	logrus.Infof("attached provenance as %s", ref)
+
+	return nil
+}
@@ -0,0 +1,194 @@
+package prototype_test
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type ProvenanceSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *ProvenanceSuite) TestParseBaseImages() {
+	trace, err := os.Open("testdata/build-stats/trace.json")
+	s.NoError(err)
+
+	defer trace.Close()
+
+	baseImages, err := prototype.ParseBaseImages(trace)
+	s.NoError(err)
+
+	s.Equal([]prototype.ProvenanceMaterial{
+		{
+			URI:    "docker-image://docker.io/library/busybox",
+			Digest: map[string]string{"sha256": "abcd"},
+		},
+	}, baseImages)
+}
+
+func (s *ProvenanceSuite) TestParseBaseImagesSkipsLocalImages() {
+	trace := strings.NewReader(`{"Vertexes":[{"Name":"[stage-0 1/1] FROM localhost:1234/first_image@sha256:abcd"}]}` + "\n" +
+		`{"Vertexes":[{"Name":"[stage-1 1/1] FROM docker.io/library/alpine:3.15@sha256:ef01"}]}` + "\n")
+
+	baseImages, err := prototype.ParseBaseImages(trace)
+	s.NoError(err)
+
+	s.Equal([]prototype.ProvenanceMaterial{
+		{
+			URI:    "docker-image://docker.io/library/alpine:3.15",
+			Digest: map[string]string{"sha256": "ef01"},
+		},
+	}, baseImages)
+}
+
+func (s *ProvenanceSuite) TestProvenanceMaterials() {
+	dir, err := ioutil.TempDir("", "provenance-materials")
+	s.NoError(err)
+
+	defer os.RemoveAll(dir)
+
+	contextDir := filepath.Join(dir, "context")
+	s.NoError(os.MkdirAll(filepath.Join(contextDir, "input"), 0755))
+	s.NoError(ioutil.WriteFile(filepath.Join(contextDir, "Dockerfile"), []byte("FROM scratch\n"), 0644))
+	s.NoError(ioutil.WriteFile(filepath.Join(contextDir, "input", "file"), []byte("hello"), 0644))
+
+	image, err := random.Image(1024, 1)
+	s.NoError(err)
+
+	imagePath := filepath.Join(dir, "image.tar")
+	s.NoError(tarball.WriteToFile(imagePath, nil, image))
+
+	imageDigest, err := image.Digest()
+	s.NoError(err)
+
+	materials, err := prototype.ProvenanceMaterials(prototype.OCIImage{
+		ContextDir:    contextDir,
+		ContextInputs: map[string]string{"some-input": "input"},
+		BuildContexts: map[string]string{
+			"base": "docker-image://docker.io/library/alpine:3.15",
+		},
+		ImageArgs: []string{"base_image=" + imagePath},
+	})
+	s.NoError(err)
+
+	contextDigest, err := prototype.TreeDigest(contextDir)
+	s.NoError(err)
+
+	dockerfileDigest, err := prototype.FileDigest(filepath.Join(contextDir, "Dockerfile"))
+	s.NoError(err)
+
+	inputDigest, err := prototype.TreeDigest(filepath.Join(contextDir, "input"))
+	s.NoError(err)
+
+	s.Equal([]prototype.ProvenanceMaterial{
+		{URI: "file:" + contextDir, Digest: map[string]string{"sha256": contextDigest}},
+		{URI: "file:" + filepath.Join(contextDir, "Dockerfile"), Digest: map[string]string{"sha256": dockerfileDigest}},
+		{URI: "file:" + filepath.Join(contextDir, "input"), Digest: map[string]string{"sha256": inputDigest}},
+		{URI: "docker-image://docker.io/library/alpine:3.15"},
+		{URI: "file:" + imagePath, Digest: map[string]string{"sha256": imageDigest.Hex}},
+	}, materials)
+}
+
+func (s *ProvenanceSuite) TestTreeDigest() {
+	dir, err := ioutil.TempDir("", "tree-digest")
+	s.NoError(err)
+
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	s.NoError(ioutil.WriteFile(file, []byte("hello"), 0644))
+
+	digest, err := prototype.TreeDigest(dir)
+	s.NoError(err)
+
+	// the content, permissions and names of files all change the digest
+	digests := map[string]bool{digest: true}
+	for _, change := range []func() error{
+		func() error { return ioutil.WriteFile(file, []byte("goodbye"), 0644) },
+		func() error { return os.Chmod(file, 0755) },
+		func() error { return os.Rename(file, filepath.Join(dir, "renamed")) },
+		func() error { return os.Symlink("renamed", file) },
+	} {
+		s.NoError(change())
+
+		digest, err := prototype.TreeDigest(dir)
+		s.NoError(err)
+		s.NotContains(digests, digest)
+
+		digests[digest] = true
+	}
+
+	again, err := prototype.TreeDigest(dir)
+	s.NoError(err)
+	s.Contains(digests, again)
+}
+
+func (s *ProvenanceSuite) TestAttachArtifact() {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer server.Close()
+
+	repository := strings.TrimPrefix(server.URL, "http://") + "/some-image"
+
+	subject := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("ab", 32)}
+
+	ref, err := prototype.AttachArtifact(repository, subject, "att", prototype.Artifact{
+		MediaType:   "application/vnd.in-toto+json",
+		Payload:     []byte(`{"some":"statement"}`),
+		Annotations: map[string]string{"some-key": "some-value"},
+	})
+	s.NoError(err)
+
+	s.Equal(repository+":sha256-"+subject.Hex+".att", ref.String())
+
+	tag, err := name.NewTag(ref.String())
+	s.NoError(err)
+
+	pulled, err := remote.Image(tag)
+	s.NoError(err)
+
+	mediaType, err := pulled.MediaType()
+	s.NoError(err)
+	s.Equal("application/vnd.oci.image.manifest.v1+json", string(mediaType))
+
+	manifest, err := pulled.Manifest()
+	s.NoError(err)
+
+	s.Len(manifest.Layers, 1)
+	s.Equal("application/vnd.in-toto+json", string(manifest.Layers[0].MediaType))
+	s.Equal(map[string]string{"some-key": "some-value"}, manifest.Layers[0].Annotations)
+
+	layers, err := pulled.Layers()
+	s.NoError(err)
+
+	content, err := layers[0].Compressed()
+	s.NoError(err)
+
+	defer content.Close()
+
+	payload, err := ioutil.ReadAll(content)
+	s.NoError(err)
+	s.Equal(`{"some":"statement"}`, string(payload))
+}
+
+func TestProvenance(t *testing.T) {
+	suite.Run(t, &ProvenanceSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -28,7 +28,9 @@ func LoadRegistry(imagePaths map[string]string) (LocalRegistry, error) {
 	return images, nil
 }
 
-func ServeRegistry(reg LocalRegistry) (string, error) {
+// ServeRegistry serves the registry on a random port until the returned
+// closer is closed.
+func ServeRegistry(reg LocalRegistry) (string, io.Closer, error) {
 	router := httprouter.New()
 	router.GET("/v2/:name/manifests/:ref", reg.GetManifest)
 	router.GET("/v2/:name/blobs/:digest", reg.GetBlob)
@@ -42,17 +44,18 @@ func ServeRegistry(reg LocalRegistry) (string, error) {
 
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
-		return "", fmt.Errorf("listen: %w", err)
+		return "", nil, fmt.Errorf("listen: %w", err)
 	}
 
 	go http.Serve(listener, router)
 
 	_, port, err := net.SplitHostPort(listener.Addr().String())
 	if err != nil {
-		return "", fmt.Errorf("split registry host/port: %w", err)
+		listener.Close()
+		return "", nil, fmt.Errorf("split registry host/port: %w", err)
 	}
 
-	return port, nil
+	return port, listener, nil
 }
 
 func (registry LocalRegistry) BuildArgs(port string) []string {
@@ -0,0 +1,194 @@
+package prototype
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// sourceDateEpoch determines the SOURCE_DATE_EPOCH for a reproducible build,
+// defaulting to the commit time of the context's git HEAD (or ContextRef).
+func sourceDateEpoch(img OCIImage) (int64, error) {
+	if img.SourceDateEpoch != nil {
+		return *img.SourceDateEpoch, nil
+	}
+
+	buf := new(bytes.Buffer)
+
+	args := []string{"-C", img.ContextDir, "log", "-1", "--format=%ct"}
+	if img.ContextRef != "" {
+		args = append(args, img.ContextRef)
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+
+	err := cmd.Run()
+	if err != nil {
+		return 0, fmt.Errorf("get commit time of %s: %w: %s", img.ContextDir, err, strings.TrimSpace(buf.String()))
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(buf.String()), 10, 64)
+}
+
+// normalizeTimestamps rewrites the image at imagePath so that its digest only
+// depends on its content: file mtimes newer than epoch are clamped to it,
+// access and change times are dropped, and the config's creation time and
+// history are set to epoch.
+func normalizeTimestamps(imagePath string, epoch time.Time) error {
+	image, err := tarball.ImageFromPath(imagePath, nil)
+	if err != nil {
+		return fmt.Errorf("open image: %w", err)
+	}
+
+	layers, err := image.Layers()
+	if err != nil {
+		return fmt.Errorf("get layers: %w", err)
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(imagePath), "normalize")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	normalized := empty.Image
+	for i, layer := range layers {
+		layerPath := filepath.Join(tmpDir, fmt.Sprintf("layer-%d.tar", i))
+
+		err := normalizeLayer(layerPath, layer, epoch)
+		if err != nil {
+			return fmt.Errorf("normalize layer %d: %w", i, err)
+		}
+
+		normalizedLayer, err := tarball.LayerFromFile(layerPath)
+		if err != nil {
+			return fmt.Errorf("load normalized layer %d: %w", i, err)
+		}
+
+		normalized, err = mutate.AppendLayers(normalized, normalizedLayer)
+		if err != nil {
+			return fmt.Errorf("append layer %d: %w", i, err)
+		}
+	}
+
+	originalConfig, err := image.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("get config: %w", err)
+	}
+
+	normalizedConfig, err := normalized.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("get normalized config: %w", err)
+	}
+
+	config := originalConfig.DeepCopy()
+	config.RootFS.DiffIDs = normalizedConfig.RootFS.DiffIDs
+	config.Created = v1.Time{Time: epoch}
+
+	for i := range config.History {
+		config.History[i].Created = v1.Time{Time: epoch}
+	}
+
+	normalized, err = mutate.ConfigFile(normalized, config)
+	if err != nil {
+		return fmt.Errorf("set config: %w", err)
+	}
+
+	digest, err := normalized.Digest()
+	if err != nil {
+		return fmt.Errorf("get digest: %w", err)
+	}
+
+	// a digest reference results in an untagged image, like the one exported
+	// by buildkit
+	ref, err := name.NewDigest("image@" + digest.String())
+	if err != nil {
+		return err
+	}
+
+	// the original image is read lazily from imagePath, so it can't be
+	// overwritten in place
+	tmpPath := filepath.Join(tmpDir, "image.tar")
+
+	err = tarball.WriteToFile(tmpPath, ref, normalized)
+	if err != nil {
+		return fmt.Errorf("write image: %w", err)
+	}
+
+	return os.Rename(tmpPath, imagePath)
+}
+
+func normalizeLayer(dest string, layer v1.Layer, epoch time.Time) error {
+	r, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(f)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if hdr.ModTime.After(epoch) {
+			hdr.ModTime = epoch
+		}
+
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+
+		for _, key := range []string{"atime", "ctime", "mtime"} {
+			delete(hdr.PAXRecords, key)
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,230 @@
+package prototype
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Constants of rpm's NDB database format (Packages.db), as used by SUSE. See
+// rpm's lib/backend/ndb/rpmpkg.c.
+const (
+	ndbHeaderMagic = 'R' | 'p'<<8 | 'm'<<16 | 'P'<<24
+	ndbSlotMagic   = 'S' | 'l'<<8 | 'o'<<16 | 't'<<24
+	ndbBlobMagic   = 'B' | 'l'<<8 | 'b'<<16 | 'S'<<24
+
+	ndbVersion  = 0
+	ndbPageSize = 4096
+	ndbSlotSize = 16
+	ndbBlkSize  = 16
+
+	// sanity limit on the number of slot pages, i.e. 512k packages
+	ndbMaxSlotPages = 2048
+)
+
+// ndbHeader takes up the first two slots of the first page.
+type ndbHeader struct {
+	Magic      uint32
+	Version    uint32
+	Generation uint32
+	SlotNPages uint32
+	Unused     [4]uint32
+}
+
+type ndbSlot struct {
+	Magic     uint32
+	PkgIndex  uint32
+	BlkOffset uint32
+	BlkCount  uint32
+}
+
+type ndbBlobHeader struct {
+	Magic    uint32
+	PkgIndex uint32
+	Checksum uint32
+	Length   uint32
+}
+
+// rpm header tags and types which are read.
+const (
+	rpmTagName      = 1000
+	rpmTagVersion   = 1001
+	rpmTagRelease   = 1002
+	rpmTagEpoch     = 1003
+	rpmTagLicense   = 1014
+	rpmTagArch      = 1022
+	rpmTagSourceRPM = 1044
+
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeI18NString  = 9
+	rpmHeaderEntrySize = 16
+)
+
+// parseRpmNDB lists the packages in an rpm NDB database. Each slot points at
+// a blob holding the package's rpm header.
+func parseRpmNDB(r io.ReaderAt, source string) ([]Package, error) {
+	var header ndbHeader
+	err := binary.Read(io.NewSectionReader(r, 0, ndbPageSize), binary.LittleEndian, &header)
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	if header.Magic != ndbHeaderMagic || header.Version != ndbVersion {
+		return nil, fmt.Errorf("not an NDB database")
+	}
+
+	if header.SlotNPages == 0 || header.SlotNPages > ndbMaxSlotPages {
+		return nil, fmt.Errorf("invalid number of slot pages: %d", header.SlotNPages)
+	}
+
+	// the header takes up the first two slots
+	slots := make([]ndbSlot, int(header.SlotNPages)*ndbPageSize/ndbSlotSize-2)
+	err = binary.Read(io.NewSectionReader(r, 2*ndbSlotSize, int64(len(slots))*ndbSlotSize), binary.LittleEndian, slots)
+	if err != nil {
+		return nil, fmt.Errorf("read slots: %w", err)
+	}
+
+	var pkgs []Package
+	for _, slot := range slots {
+		if slot.Magic != ndbSlotMagic {
+			return nil, fmt.Errorf("invalid slot")
+		}
+
+		// free slot
+		if slot.PkgIndex == 0 {
+			continue
+		}
+
+		offset := int64(slot.BlkOffset) * ndbBlkSize
+
+		var blobHeader ndbBlobHeader
+		err := binary.Read(io.NewSectionReader(r, offset, ndbBlkSize), binary.LittleEndian, &blobHeader)
+		if err != nil {
+			return nil, fmt.Errorf("read blob of package %d: %w", slot.PkgIndex, err)
+		}
+
+		if blobHeader.Magic != ndbBlobMagic || blobHeader.PkgIndex != slot.PkgIndex {
+			return nil, fmt.Errorf("invalid blob for package %d", slot.PkgIndex)
+		}
+
+		if int64(blobHeader.Length)+ndbBlkSize > int64(slot.BlkCount)*ndbBlkSize {
+			return nil, fmt.Errorf("blob of package %d overflows its blocks", slot.PkgIndex)
+		}
+
+		blob := make([]byte, blobHeader.Length)
+		_, err = r.ReadAt(blob, offset+ndbBlkSize)
+		if err != nil {
+			return nil, fmt.Errorf("read blob of package %d: %w", slot.PkgIndex, err)
+		}
+
+		pkg, err := parseRpmHeader(blob)
+		if err != nil {
+			return nil, fmt.Errorf("package %d: %w", slot.PkgIndex, err)
+		}
+
+		// imported signing keys are recorded as packages
+		if pkg.Name == "gpg-pubkey" {
+			continue
+		}
+
+		pkg.Source = "/" + source
+
+		pkgs = append(pkgs, pkg)
+	}
+
+	return pkgs, nil
+}
+
+// parseRpmHeader reads a package from an rpm header blob: a count of index
+// entries and the length of the data they point into (big-endian), followed
+// by the entries and the data.
+func parseRpmHeader(blob []byte) (Package, error) {
+	if len(blob) < 8 {
+		return Package{}, fmt.Errorf("header too short")
+	}
+
+	entries := int(binary.BigEndian.Uint32(blob[0:]))
+	dataLen := int(binary.BigEndian.Uint32(blob[4:]))
+
+	dataStart := 8 + entries*rpmHeaderEntrySize
+	if entries < 0 || dataLen < 0 || dataStart+dataLen > len(blob) || dataStart < 8 {
+		return Package{}, fmt.Errorf("header overflows its blob")
+	}
+
+	data := blob[dataStart : dataStart+dataLen]
+
+	strs := map[int]string{}
+	epoch := -1
+
+	for i := 0; i < entries; i++ {
+		entry := blob[8+i*rpmHeaderEntrySize:]
+
+		tag := int(binary.BigEndian.Uint32(entry[0:]))
+		typ := binary.BigEndian.Uint32(entry[4:])
+		offset := int(int32(binary.BigEndian.Uint32(entry[8:])))
+
+		if offset < 0 || offset >= len(data) {
+			continue
+		}
+
+		switch {
+		case typ == rpmTypeInt32 && tag == rpmTagEpoch && offset+4 <= len(data):
+			epoch = int(binary.BigEndian.Uint32(data[offset:]))
+		case typ == rpmTypeString || typ == rpmTypeI18NString:
+			str := data[offset:]
+			if end := bytes.IndexByte(str, 0); end >= 0 {
+				str = str[:end]
+			}
+
+			strs[tag] = string(str)
+		}
+	}
+
+	if strs[rpmTagName] == "" {
+		return Package{}, fmt.Errorf("header has no name")
+	}
+
+	version := strs[rpmTagVersion]
+	if strs[rpmTagRelease] != "" {
+		version += "-" + strs[rpmTagRelease]
+	}
+
+	if epoch >= 0 {
+		version = strconv.Itoa(epoch) + ":" + version
+	}
+
+	origin := rpmSourceName(strs[rpmTagSourceRPM])
+	if origin == strs[rpmTagName] {
+		origin = ""
+	}
+
+	return Package{
+		Type:    PackageTypeRPM,
+		Name:    strs[rpmTagName],
+		Version: version,
+		Arch:    strs[rpmTagArch],
+		License: strs[rpmTagLicense],
+		Origin:  origin,
+	}, nil
+}
+
+// rpmSourceName returns the name of a source rpm, e.g. 'bash' for
+// 'bash-5.1-2.1.src.rpm'.
+func rpmSourceName(sourceRPM string) string {
+	name := strings.TrimSuffix(sourceRPM, ".src.rpm")
+
+	for i := 0; i < 2; i++ {
+		sep := strings.LastIndex(name, "-")
+		if sep < 0 {
+			return ""
+		}
+
+		name = name[:sep]
+	}
+
+	return name
+}
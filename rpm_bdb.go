@@ -0,0 +1,157 @@
+package prototype
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Constants of BerkeleyDB's hash database format, as used by rpm's Packages
+// database up to RHEL 8. See BerkeleyDB's dbinc/db_page.h.
+const (
+	bdbHashMagic = 0x061561
+
+	bdbMetaSize       = 72
+	bdbPageHeaderSize = 26
+
+	bdbPageTypeHashUnsorted = 2
+	bdbPageTypeOverflow     = 7
+	bdbPageTypeHash         = 13
+
+	// a hash entry whose data is stored in a chain of overflow pages
+	bdbEntryOffPage = 3
+
+	// sanity limit on the size of a package's header
+	bdbMaxBlobSize = 64 * 1024 * 1024
+)
+
+// parseRpmBDB lists the packages in an rpm BerkeleyDB hash database. Each
+// hash page holds pairs of entries: a package's index as the key, and its rpm
+// header as the value, which is too large to fit in the page so is stored in
+// overflow pages.
+//
+// The file is in the byte order of the host that wrote it, so both are
+// accepted.
+func parseRpmBDB(r io.ReaderAt, source string) ([]Package, error) {
+	meta := make([]byte, bdbMetaSize)
+	_, err := r.ReadAt(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf("read metadata: %w", err)
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(meta[12:]) != bdbHashMagic {
+		order = binary.BigEndian
+	}
+
+	if order.Uint32(meta[12:]) != bdbHashMagic {
+		return nil, fmt.Errorf("not a BerkeleyDB hash database")
+	}
+
+	pageSize := int(order.Uint32(meta[20:]))
+	if pageSize < 512 || pageSize > 64*1024 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid page size: %d", pageSize)
+	}
+
+	if meta[24] != 0 {
+		return nil, fmt.Errorf("encrypted databases are not supported")
+	}
+
+	lastPage := order.Uint32(meta[32:])
+
+	var pkgs []Package
+
+	page := make([]byte, pageSize)
+	for pgno := uint32(1); pgno <= lastPage; pgno++ {
+		_, err := r.ReadAt(page, int64(pgno)*int64(pageSize))
+		if err != nil {
+			return nil, fmt.Errorf("read page %d: %w", pgno, err)
+		}
+
+		if page[25] != bdbPageTypeHash && page[25] != bdbPageTypeHashUnsorted {
+			continue
+		}
+
+		entries := int(order.Uint16(page[20:]))
+		if bdbPageHeaderSize+entries*2 > pageSize {
+			return nil, fmt.Errorf("page %d overflows", pgno)
+		}
+
+		// entries alternate between keys and values
+		for i := 1; i < entries; i += 2 {
+			offset := int(order.Uint16(page[bdbPageHeaderSize+i*2:]))
+			if offset+12 > pageSize {
+				return nil, fmt.Errorf("entry %d of page %d overflows", i, pgno)
+			}
+
+			if page[offset] != bdbEntryOffPage {
+				continue
+			}
+
+			blob, err := readBDBOverflow(r, order, pageSize, lastPage, order.Uint32(page[offset+4:]), order.Uint32(page[offset+8:]))
+			if err != nil {
+				return nil, fmt.Errorf("entry %d of page %d: %w", i, pgno, err)
+			}
+
+			pkg, err := parseRpmHeader(blob)
+			if err != nil {
+				return nil, fmt.Errorf("entry %d of page %d: %w", i, pgno, err)
+			}
+
+			if pkg.Name == "gpg-pubkey" {
+				continue
+			}
+
+			pkg.Source = "/" + source
+
+			pkgs = append(pkgs, pkg)
+		}
+	}
+
+	return pkgs, nil
+}
+
+// readBDBOverflow reads an entry's data from the chain of overflow pages
+// starting at pgno.
+func readBDBOverflow(r io.ReaderAt, order binary.ByteOrder, pageSize int, lastPage uint32, pgno uint32, length uint32) ([]byte, error) {
+	if length > bdbMaxBlobSize {
+		return nil, fmt.Errorf("data too large: %d bytes", length)
+	}
+
+	blob := make([]byte, 0, length)
+
+	page := make([]byte, pageSize)
+
+	// a chain can't be longer than the database, so bound it in case it
+	// loops
+	for pages := uint32(0); len(blob) < int(length); pages++ {
+		if pgno == 0 || pgno > lastPage || pages > lastPage {
+			return nil, fmt.Errorf("data truncated at %d of %d bytes", len(blob), length)
+		}
+
+		_, err := r.ReadAt(page, int64(pgno)*int64(pageSize))
+		if err != nil {
+			return nil, fmt.Errorf("read overflow page %d: %w", pgno, err)
+		}
+
+		if page[25] != bdbPageTypeOverflow {
+			return nil, fmt.Errorf("page %d is not an overflow page", pgno)
+		}
+
+		// the offset field holds the length of the data on overflow pages
+		n := int(order.Uint16(page[22:]))
+		if bdbPageHeaderSize+n > pageSize {
+			return nil, fmt.Errorf("overflow page %d overflows", pgno)
+		}
+
+		blob = append(blob, page[bdbPageHeaderSize:bdbPageHeaderSize+n]...)
+
+		pgno = order.Uint32(page[16:])
+	}
+
+	if len(blob) != int(length) {
+		return nil, fmt.Errorf("data overran %d bytes", length)
+	}
+
+	return blob, nil
+}
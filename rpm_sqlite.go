@@ -0,0 +1,415 @@
+package prototype
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Constants of SQLite's file format, as used by rpm's rpmdb.sqlite database
+// from Fedora 33 and RHEL 9. See https://www.sqlite.org/fileformat.html.
+const (
+	sqliteMagic      = "SQLite format 3\x00"
+	sqliteHeaderSize = 100
+
+	sqlitePageTypeTableInterior = 0x05
+	sqlitePageTypeTableLeaf     = 0x0d
+
+	// sanity limit on the size of a row
+	sqliteMaxPayloadSize = 64 * 1024 * 1024
+)
+
+// sqliteDB reads tables from an SQLite database file. Only what's needed to
+// read rpm's Packages table is supported: rows are read by walking a table's
+// b-tree, and a write-ahead log is not read.
+type sqliteDB struct {
+	r io.ReaderAt
+
+	pageSize   int
+	usableSize int
+	pageCount  uint32
+}
+
+// parseRpmSQLite lists the packages in an rpm SQLite database. Each row of
+// the Packages table holds a package's rpm header in its 'blob' column.
+func parseRpmSQLite(r io.ReaderAt, source string) ([]Package, error) {
+	db, err := openSQLite(r)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := db.tableRoot("Packages")
+	if err != nil {
+		return nil, err
+	}
+
+	var pkgs []Package
+	err = db.walkTable(root, func(rowid int64, values []interface{}) error {
+		// the columns are hnum, which is the rowid, and blob
+		if len(values) < 2 {
+			return fmt.Errorf("row %d: expected 2 columns, got %d", rowid, len(values))
+		}
+
+		blob, ok := values[1].([]byte)
+		if !ok {
+			return fmt.Errorf("row %d: blob is not a blob", rowid)
+		}
+
+		pkg, err := parseRpmHeader(blob)
+		if err != nil {
+			return fmt.Errorf("row %d: %w", rowid, err)
+		}
+
+		if pkg.Name == "gpg-pubkey" {
+			return nil
+		}
+
+		pkg.Source = "/" + source
+
+		pkgs = append(pkgs, pkg)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pkgs, nil
+}
+
+func openSQLite(r io.ReaderAt) (*sqliteDB, error) {
+	header := make([]byte, sqliteHeaderSize)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	if string(header[:len(sqliteMagic)]) != sqliteMagic {
+		return nil, fmt.Errorf("not an SQLite database")
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(header[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid page size: %d", pageSize)
+	}
+
+	usableSize := pageSize - int(header[20])
+	if usableSize < 480 {
+		return nil, fmt.Errorf("invalid reserved space: %d", header[20])
+	}
+
+	if encoding := binary.BigEndian.Uint32(header[56:]); encoding > 1 {
+		return nil, fmt.Errorf("unsupported text encoding: %d", encoding)
+	}
+
+	return &sqliteDB{
+		r:          r,
+		pageSize:   pageSize,
+		usableSize: usableSize,
+		pageCount:  binary.BigEndian.Uint32(header[28:]),
+	}, nil
+}
+
+// tableRoot finds the root page of a table in the schema table, which is
+// rooted at the first page.
+func (db *sqliteDB) tableRoot(name string) (uint32, error) {
+	var root uint32
+	err := db.walkTable(1, func(_ int64, values []interface{}) error {
+		// the columns are type, name, tbl_name, rootpage and sql
+		if len(values) < 4 || values[0] != "table" || values[1] != name {
+			return nil
+		}
+
+		page, ok := values[3].(int64)
+		if !ok || page <= 0 {
+			return fmt.Errorf("table %s has an invalid root page", name)
+		}
+
+		root = uint32(page)
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("read schema: %w", err)
+	}
+
+	if root == 0 {
+		return 0, fmt.Errorf("no %s table", name)
+	}
+
+	return root, nil
+}
+
+// walkTable calls fn with the rowid and values of each row of the table
+// rooted at the given page, in rowid order.
+func (db *sqliteDB) walkTable(root uint32, fn func(int64, []interface{}) error) error {
+	visited := map[uint32]bool{}
+
+	var walk func(pgno uint32) error
+	walk = func(pgno uint32) error {
+		if visited[pgno] {
+			return fmt.Errorf("page %d is referenced more than once", pgno)
+		}
+
+		visited[pgno] = true
+
+		page, err := db.readPage(pgno)
+		if err != nil {
+			return err
+		}
+
+		// the first page starts with the database header
+		start := 0
+		if pgno == 1 {
+			start = sqliteHeaderSize
+		}
+
+		pageType := page[start]
+
+		headerSize := 8
+		if pageType == sqlitePageTypeTableInterior {
+			headerSize = 12
+		} else if pageType != sqlitePageTypeTableLeaf {
+			return fmt.Errorf("page %d is not a table page", pgno)
+		}
+
+		cells := int(binary.BigEndian.Uint16(page[start+3:]))
+		if start+headerSize+cells*2 > len(page) {
+			return fmt.Errorf("page %d overflows", pgno)
+		}
+
+		for i := 0; i < cells; i++ {
+			offset := int(binary.BigEndian.Uint16(page[start+headerSize+i*2:]))
+			if offset >= db.usableSize {
+				return fmt.Errorf("cell %d of page %d overflows", i, pgno)
+			}
+
+			cell := page[offset:db.usableSize]
+
+			if pageType == sqlitePageTypeTableInterior {
+				if len(cell) < 4 {
+					return fmt.Errorf("cell %d of page %d overflows", i, pgno)
+				}
+
+				err := walk(binary.BigEndian.Uint32(cell))
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			rowid, payload, err := db.readLeafCell(cell)
+			if err != nil {
+				return fmt.Errorf("cell %d of page %d: %w", i, pgno, err)
+			}
+
+			values, err := parseSQLiteRecord(payload)
+			if err != nil {
+				return fmt.Errorf("row %d: %w", rowid, err)
+			}
+
+			err = fn(rowid, values)
+			if err != nil {
+				return err
+			}
+		}
+
+		if pageType == sqlitePageTypeTableInterior {
+			return walk(binary.BigEndian.Uint32(page[start+8:]))
+		}
+
+		return nil
+	}
+
+	return walk(root)
+}
+
+func (db *sqliteDB) readPage(pgno uint32) ([]byte, error) {
+	if pgno == 0 || pgno > db.pageCount {
+		return nil, fmt.Errorf("page %d is out of range", pgno)
+	}
+
+	page := make([]byte, db.pageSize)
+	_, err := db.r.ReadAt(page, int64(pgno-1)*int64(db.pageSize))
+	if err != nil {
+		return nil, fmt.Errorf("read page %d: %w", pgno, err)
+	}
+
+	return page, nil
+}
+
+// readLeafCell reads the rowid and payload of a table leaf cell, following
+// its overflow pages if the payload does not fit on the page.
+func (db *sqliteDB) readLeafCell(cell []byte) (int64, []byte, error) {
+	size, n := sqliteVarint(cell)
+	if n == 0 {
+		return 0, nil, fmt.Errorf("truncated payload size")
+	}
+
+	cell = cell[n:]
+
+	rowid, n := sqliteVarint(cell)
+	if n == 0 {
+		return 0, nil, fmt.Errorf("truncated rowid")
+	}
+
+	cell = cell[n:]
+
+	if size > sqliteMaxPayloadSize {
+		return 0, nil, fmt.Errorf("payload too large: %d bytes", size)
+	}
+
+	local := db.localPayloadSize(int(size))
+	if local > len(cell) || (local < int(size) && local+4 > len(cell)) {
+		return 0, nil, fmt.Errorf("payload overflows its page")
+	}
+
+	payload := make([]byte, 0, size)
+	payload = append(payload, cell[:local]...)
+
+	if local == int(size) {
+		return int64(rowid), payload, nil
+	}
+
+	next := binary.BigEndian.Uint32(cell[local:])
+	for pages := uint32(0); len(payload) < int(size); pages++ {
+		if next == 0 || pages > db.pageCount {
+			return 0, nil, fmt.Errorf("payload truncated at %d of %d bytes", len(payload), size)
+		}
+
+		page, err := db.readPage(next)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		n := db.usableSize - 4
+		if remaining := int(size) - len(payload); n > remaining {
+			n = remaining
+		}
+
+		payload = append(payload, page[4:4+n]...)
+		next = binary.BigEndian.Uint32(page)
+	}
+
+	return int64(rowid), payload, nil
+}
+
+// localPayloadSize is how much of a table leaf cell's payload is stored on
+// the page itself, with the rest in overflow pages.
+func (db *sqliteDB) localPayloadSize(size int) int {
+	maxLocal := db.usableSize - 35
+	if size <= maxLocal {
+		return size
+	}
+
+	minLocal := (db.usableSize-12)*32/255 - 23
+
+	local := minLocal + (size-minLocal)%(db.usableSize-4)
+	if local > maxLocal {
+		return minLocal
+	}
+
+	return local
+}
+
+// parseSQLiteRecord decodes a record's values as nil, int64, float64, string
+// or []byte.
+func parseSQLiteRecord(record []byte) ([]interface{}, error) {
+	headerSize, n := sqliteVarint(record)
+	if n == 0 || headerSize > uint64(len(record)) {
+		return nil, fmt.Errorf("invalid record header")
+	}
+
+	header := record[n:headerSize]
+	body := record[headerSize:]
+
+	var values []interface{}
+	for len(header) > 0 {
+		serialType, n := sqliteVarint(header)
+		if n == 0 {
+			return nil, fmt.Errorf("invalid record header")
+		}
+
+		header = header[n:]
+
+		var size int
+		switch {
+		case serialType <= 4:
+			size = int(serialType)
+		case serialType == 5:
+			size = 6
+		case serialType == 6 || serialType == 7:
+			size = 8
+		case serialType == 8 || serialType == 9:
+			size = 0
+		case serialType >= 12:
+			size = int((serialType - 12) / 2)
+		default:
+			return nil, fmt.Errorf("invalid serial type: %d", serialType)
+		}
+
+		if size > len(body) {
+			return nil, fmt.Errorf("record overflows")
+		}
+
+		field := body[:size]
+		body = body[size:]
+
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType <= 6:
+			// big-endian two's complement
+			var v int64
+			if size > 0 && field[0]&0x80 != 0 {
+				v = -1
+			}
+
+			for _, b := range field {
+				v = v<<8 | int64(b)
+			}
+
+			values = append(values, v)
+		case serialType == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(field)))
+		case serialType == 8:
+			values = append(values, int64(0))
+		case serialType == 9:
+			values = append(values, int64(1))
+		case serialType%2 == 0:
+			values = append(values, append([]byte(nil), field...))
+		default:
+			values = append(values, string(field))
+		}
+	}
+
+	return values, nil
+}
+
+// sqliteVarint decodes a big-endian varint of up to 9 bytes, returning the
+// number of bytes read, or 0 if it is truncated.
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+
+	return v, 9
+}
@@ -0,0 +1,676 @@
+package prototype
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/pkg/errors"
+)
+
+// SBOMFile is the file next to image.tar which the SBOM is written to.
+const SBOMFile = "sbom.spdx.json"
+
+// Types of Package.
+const (
+	PackageTypeDeb    = "deb"
+	PackageTypeApk    = "apk"
+	PackageTypeGolang = "golang"
+	PackageTypeRPM    = "rpm"
+)
+
+// Package is a package found in an image.
+type Package struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch,omitempty"`
+
+	// License as declared by the package manager, if it records one.
+	License string `json:"license,omitempty"`
+
+	// Source package that dpkg, apk or rpm packages were built from, if it is
+	// named differently, e.g. 'glibc' for 'libc6'. Security advisories for
+	// distros usually refer to source packages.
+	Origin string `json:"origin,omitempty"`
+
+	// Path within the image of the database or binary the package was found
+	// in.
+	Source string `json:"source"`
+
+	// Package URL, see https://github.com/package-url/purl-spec.
+	PURL string `json:"purl"`
+}
+
+// PackageScan is the result of scanning an image's filesystem for packages.
+type PackageScan struct {
+	Packages []Package
+
+	// Distro the image is based on, from /etc/os-release, e.g. "debian" and
+	// "11". Empty if there is no os-release.
+	DistroID      string
+	DistroVersion string
+
+	// Problems with package databases which could not be read fully, e.g. an
+	// rpm database's write-ahead log.
+	Warnings []string
+}
+
+// Paths within the image, without a leading slash as in layer tarballs.
+const (
+	dpkgStatusPath   = "var/lib/dpkg/status"
+	dpkgStatusDir    = "var/lib/dpkg/status.d/"
+	apkInstalledPath = "lib/apk/db/installed"
+)
+
+var (
+	osReleasePaths = []string{"etc/os-release", "usr/lib/os-release"}
+
+	// rpm's NDB databases, as used by SUSE.
+	rpmNDBPaths = []string{
+		"var/lib/rpm/Packages.db",
+		"usr/lib/sysimage/rpm/Packages.db",
+	}
+
+	// rpm's BerkeleyDB databases, as used by RHEL 8 and older.
+	rpmBDBPaths = []string{
+		"var/lib/rpm/Packages",
+	}
+
+	// rpm's SQLite databases, as used by RHEL 9 and Fedora 33+.
+	rpmSQLitePaths = []string{
+		"var/lib/rpm/rpmdb.sqlite",
+		"usr/lib/sysimage/rpm/rpmdb.sqlite",
+	}
+)
+
+var elfMagic = []byte("\x7fELF")
+
+// ScanPackages walks the image's filesystem, as of its last layer, for
+// packages installed by dpkg, apk and rpm (NDB, BerkeleyDB and SQLite
+// databases), and for Go binaries' modules.
+//
+// Unlike unpackImage, nothing is written to disk: mutate.Extract streams the
+// flattened filesystem with whiteouts already applied, so each package
+// database is read once, from the layer that last wrote it.
+func ScanPackages(image v1.Image) (PackageScan, error) {
+	var scan PackageScan
+	var osRelease map[string]string
+
+	fs := mutate.Extract(image)
+	defer fs.Close()
+
+	tr := tar.NewReader(fs)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return PackageScan{}, errors.Wrap(err, "read image filesystem")
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+
+		switch {
+		case name == dpkgStatusPath,
+			strings.HasPrefix(name, dpkgStatusDir) && !strings.HasSuffix(name, ".md5sums"):
+			pkgs, err := parseDpkgStatus(tr, name)
+			if err != nil {
+				return PackageScan{}, errors.Wrapf(err, "parse %s", name)
+			}
+
+			scan.Packages = append(scan.Packages, pkgs...)
+
+		case name == apkInstalledPath:
+			pkgs, err := parseApkInstalled(tr, name)
+			if err != nil {
+				return PackageScan{}, errors.Wrapf(err, "parse %s", name)
+			}
+
+			scan.Packages = append(scan.Packages, pkgs...)
+
+		case containsString(osReleasePaths, name):
+			// /etc/os-release takes precedence; it's usually a symlink anyway
+			if osRelease != nil && name != osReleasePaths[0] {
+				continue
+			}
+
+			osRelease, err = parseOSRelease(tr)
+			if err != nil {
+				return PackageScan{}, errors.Wrapf(err, "parse %s", name)
+			}
+
+		case containsString(rpmNDBPaths, name):
+			// slots point at package headers anywhere in the file
+			var pkgs []Package
+			err := withSpooledFile(tr, func(file *os.File) error {
+				var parseErr error
+				pkgs, parseErr = parseRpmNDB(file, name)
+				return parseErr
+			})
+			if err != nil {
+				return PackageScan{}, errors.Wrapf(err, "parse %s", name)
+			}
+
+			scan.Packages = append(scan.Packages, pkgs...)
+
+		case containsString(rpmBDBPaths, name):
+			var pkgs []Package
+			err := withSpooledFile(tr, func(file *os.File) error {
+				var parseErr error
+				pkgs, parseErr = parseRpmBDB(file, name)
+				return parseErr
+			})
+			if err != nil {
+				return PackageScan{}, errors.Wrapf(err, "parse %s", name)
+			}
+
+			scan.Packages = append(scan.Packages, pkgs...)
+
+		case containsString(rpmSQLitePaths, name):
+			var pkgs []Package
+			err := withSpooledFile(tr, func(file *os.File) error {
+				var parseErr error
+				pkgs, parseErr = parseRpmSQLite(file, name)
+				return parseErr
+			})
+			if err != nil {
+				return PackageScan{}, errors.Wrapf(err, "parse %s", name)
+			}
+
+			scan.Packages = append(scan.Packages, pkgs...)
+
+		case hdr.Size > 0 && containsString(rpmSQLitePaths, strings.TrimSuffix(name, "-wal")):
+			// SQLite checkpoints the log into the database when it's
+			// closed, so this is only left behind by an interrupted rpm
+			scan.Warnings = append(scan.Warnings, fmt.Sprintf("rpm database write-ahead log /%s is not read; its packages may be out of date", name))
+
+		case hdr.Mode&0111 != 0 && hdr.Size > int64(len(elfMagic)):
+			pkgs, err := parseGoBinary(tr, name)
+			if err != nil {
+				return PackageScan{}, errors.Wrapf(err, "read %s", name)
+			}
+
+			scan.Packages = append(scan.Packages, pkgs...)
+		}
+	}
+
+	scan.DistroID = osRelease["ID"]
+	scan.DistroVersion = osRelease["VERSION_ID"]
+
+	for i, pkg := range scan.Packages {
+		scan.Packages[i].PURL = packageURL(pkg, scan.DistroID, scan.DistroVersion)
+	}
+
+	sort.SliceStable(scan.Packages, func(i, j int) bool {
+		a, b := scan.Packages[i], scan.Packages[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+
+		return a.Source < b.Source
+	})
+
+	return scan, nil
+}
+
+// parseDpkgStatus parses dpkg's status database, or one of the per-package
+// files in status.d/ used by distroless images, which omit the Status field.
+func parseDpkgStatus(r io.Reader, source string) ([]Package, error) {
+	var pkgs []Package
+
+	err := parseStanzas(r, ": ", func(fields map[string]string) {
+		if fields["Package"] == "" {
+			return
+		}
+
+		if status, found := fields["Status"]; found && !strings.HasSuffix(status, " installed") {
+			return
+		}
+
+		pkgs = append(pkgs, Package{
+			Type:    PackageTypeDeb,
+			Name:    fields["Package"],
+			Version: fields["Version"],
+			Arch:    fields["Architecture"],
+			Origin:  dpkgSourceName(fields["Source"]),
+			Source:  "/" + source,
+		})
+	})
+
+	return pkgs, err
+}
+
+// dpkgSourceName returns the name from a Source field, which includes the
+// source package's version when it differs, e.g. 'glibc (2.31-13)'.
+func dpkgSourceName(source string) string {
+	return strings.SplitN(source, " ", 2)[0]
+}
+
+// parseApkInstalled parses apk's installed database.
+func parseApkInstalled(r io.Reader, source string) ([]Package, error) {
+	var pkgs []Package
+
+	err := parseStanzas(r, ":", func(fields map[string]string) {
+		if fields["P"] == "" {
+			return
+		}
+
+		pkgs = append(pkgs, Package{
+			Type:    PackageTypeApk,
+			Name:    fields["P"],
+			Version: fields["V"],
+			Arch:    fields["A"],
+			License: fields["L"],
+			Origin:  fields["o"],
+			Source:  "/" + source,
+		})
+	})
+
+	return pkgs, err
+}
+
+// parseStanzas parses blank line separated stanzas of 'key<sep>value'
+// fields, ignoring continuation lines (which start with a space).
+func parseStanzas(r io.Reader, sep string, stanza func(map[string]string)) error {
+	fields := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			if len(fields) > 0 {
+				stanza(fields)
+				fields = map[string]string{}
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+
+		segs := strings.SplitN(line, sep, 2)
+		if len(segs) == 2 {
+			fields[segs[0]] = strings.TrimSpace(segs[1])
+		}
+	}
+
+	if len(fields) > 0 {
+		stanza(fields)
+	}
+
+	return scanner.Err()
+}
+
+// parseOSRelease parses the KEY=value lines of os-release.
+func parseOSRelease(r io.Reader) (map[string]string, error) {
+	fields := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		segs := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(segs) != 2 || strings.HasPrefix(segs[0], "#") {
+			continue
+		}
+
+		fields[segs[0]] = strings.Trim(segs[1], `"'`)
+	}
+
+	return fields, scanner.Err()
+}
+
+// parseGoBinary lists the modules of a Go binary, along with the Go
+// standard library it was built with. Other executables are ignored.
+func parseGoBinary(r io.Reader, source string) ([]Package, error) {
+	magic := make([]byte, len(elfMagic))
+
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(magic, elfMagic) {
+		return nil, nil
+	}
+
+	// build info is found by seeking around the binary, which may be large
+	// (as may any other ELF file, e.g. shared objects), so spool it to disk
+	// rather than holding it in memory
+	var info *buildinfo.BuildInfo
+	var readErr error
+	err = withSpooledFile(io.MultiReader(bytes.NewReader(magic), r), func(file *os.File) error {
+		info, readErr = buildinfo.Read(file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if readErr != nil {
+		// not a Go binary, or one built without module support
+		return nil, nil
+	}
+
+	pkgs := []Package{
+		{
+			Type:    PackageTypeGolang,
+			Name:    "stdlib",
+			Version: strings.TrimPrefix(info.GoVersion, "go"),
+			Source:  "/" + source,
+		},
+	}
+
+	if info.Main.Path != "" {
+		pkgs = append(pkgs, Package{
+			Type:    PackageTypeGolang,
+			Name:    info.Main.Path,
+			Version: info.Main.Version,
+			Source:  "/" + source,
+		})
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+
+		pkgs = append(pkgs, Package{
+			Type:    PackageTypeGolang,
+			Name:    dep.Path,
+			Version: dep.Version,
+			Source:  "/" + source,
+		})
+	}
+
+	return pkgs, nil
+}
+
+// withSpooledFile copies r to a temporary file for formats that need random
+// access, calling fn with it before removing it.
+func withSpooledFile(r io.Reader, fn func(*os.File) error) error {
+	spool, err := ioutil.TempFile("", "spool")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	_, err = io.Copy(spool, r)
+	if err != nil {
+		return err
+	}
+
+	return fn(spool)
+}
+
+// packageURL returns the purl of a package, namespaced by the image's
+// distro for OS packages.
+func packageURL(pkg Package, distroID string, distroVersion string) string {
+	purl := "pkg:" + pkg.Type + "/"
+
+	switch pkg.Type {
+	case PackageTypeDeb, PackageTypeApk:
+		namespace := distroID
+		if namespace == "" && pkg.Type == PackageTypeDeb {
+			namespace = "debian"
+		} else if namespace == "" {
+			namespace = "alpine"
+		}
+
+		purl += namespace + "/"
+	case PackageTypeRPM:
+		if distroID != "" {
+			purl += distroID + "/"
+		}
+	}
+
+	purl += pkg.Name
+
+	// rpm's epoch is a qualifier rather than part of the version
+	version, epoch := pkg.Version, ""
+	if pkg.Type == PackageTypeRPM {
+		if segs := strings.SplitN(version, ":", 2); len(segs) == 2 {
+			epoch, version = segs[0], segs[1]
+		}
+	}
+
+	if version != "" {
+		purl += "@" + purlEscape(version)
+	}
+
+	var qualifiers []string
+	if pkg.Arch != "" {
+		qualifiers = append(qualifiers, "arch="+purlEscape(pkg.Arch))
+	}
+
+	if epoch != "" {
+		qualifiers = append(qualifiers, "epoch="+purlEscape(epoch))
+	}
+
+	if pkg.Type != PackageTypeGolang && distroID != "" && distroVersion != "" {
+		qualifiers = append(qualifiers, "distro="+purlEscape(distroID+"-"+distroVersion))
+	}
+
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+
+	return purl
+}
+
+// purlEscape percent-encodes everything but unreserved characters (and '+',
+// which is common in versions and left as-is by most tools).
+func purlEscape(s string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9',
+			b == '.', b == '-', b == '_', b == '~', b == '+':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
+
+// SPDXDocument is an SPDX 2.3 document, as JSON. Only the fields which are
+// filled in are modelled.
+type SPDXDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      SPDXCreationInfo   `json:"creationInfo"`
+	Comment           string             `json:"comment,omitempty"`
+	Packages          []SPDXPackage      `json:"packages"`
+	Relationships     []SPDXRelationship `json:"relationships"`
+}
+
+type SPDXCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type SPDXPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	Checksums        []SPDXChecksum    `json:"checksums,omitempty"`
+	ExternalRefs     []SPDXExternalRef `json:"externalRefs,omitempty"`
+}
+
+type SPDXChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type SPDXExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type SPDXRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+const (
+	spdxNoAssertion = "NOASSERTION"
+	spdxImageID     = "SPDXRef-Image"
+)
+
+// spdxLicense matches a license which is a single SPDX identifier, which is
+// all that's trusted from package databases.
+var spdxLicense = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+-]*$`)
+
+// spdxIDUnsafe matches characters which are not allowed in SPDX IDs.
+var spdxIDUnsafe = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// GenerateSBOM scans the image for packages and describes them as an SPDX
+// document for the image, which is named after the output it was built to.
+//
+// The document only depends on the image: its creation time is the image's.
+func GenerateSBOM(image v1.Image, name string) (SPDXDocument, error) {
+	scan, err := ScanPackages(image)
+	if err != nil {
+		return SPDXDocument{}, err
+	}
+
+	digest, err := image.ConfigName()
+	if err != nil {
+		return SPDXDocument{}, errors.Wrap(err, "get image digest")
+	}
+
+	config, err := image.ConfigFile()
+	if err != nil {
+		return SPDXDocument{}, errors.Wrap(err, "load image config")
+	}
+
+	doc := SPDXDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/oci-image-prototype/%s-%s", name, digest.Hex),
+		CreationInfo: SPDXCreationInfo{
+			Created:  config.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: oci-image-prototype"},
+		},
+		Comment: strings.Join(scan.Warnings, "\n"),
+		Packages: []SPDXPackage{
+			{
+				SPDXID:           spdxImageID,
+				Name:             name,
+				VersionInfo:      digest.String(),
+				DownloadLocation: spdxNoAssertion,
+				LicenseConcluded: spdxNoAssertion,
+				LicenseDeclared:  spdxNoAssertion,
+				Checksums: []SPDXChecksum{
+					{Algorithm: "SHA256", ChecksumValue: digest.Hex},
+				},
+			},
+		},
+		Relationships: []SPDXRelationship{
+			{
+				SPDXElementID:      "SPDXRef-DOCUMENT",
+				RelationshipType:   "DESCRIBES",
+				RelatedSPDXElement: spdxImageID,
+			},
+		},
+	}
+
+	for i, pkg := range scan.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%s-%s-%d", pkg.Type, spdxIDUnsafe.ReplaceAllString(pkg.Name, "-"), i)
+
+		license := spdxNoAssertion
+		if spdxLicense.MatchString(pkg.License) {
+			license = pkg.License
+		}
+
+		doc.Packages = append(doc.Packages, SPDXPackage{
+			SPDXID:           id,
+			Name:             pkg.Name,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: spdxNoAssertion,
+			LicenseConcluded: spdxNoAssertion,
+			LicenseDeclared:  license,
+			SourceInfo:       "found in " + pkg.Source,
+			ExternalRefs: []SPDXExternalRef{
+				{
+					ReferenceCategory: "PACKAGE-MANAGER",
+					ReferenceType:     "purl",
+					ReferenceLocator:  pkg.PURL,
+				},
+			},
+		})
+
+		doc.Relationships = append(doc.Relationships, SPDXRelationship{
+			SPDXElementID:      spdxImageID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+
+	return doc, nil
+}
+
+func writeSBOM(path string, doc SPDXDocument) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+
+	err = encoder.Encode(doc)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
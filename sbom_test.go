@@ -0,0 +1,729 @@
+package prototype_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type SBOMSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+const dpkgStatus = `Package: base-files
+Status: install ok installed
+Priority: required
+Architecture: amd64
+Version: 11.1+deb11u5
+Description: Debian base system miscellaneous files
+ This package contains the basic filesystem hierarchy.
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+
+Package: libc6
+Status: install ok installed
+Architecture: amd64
+Source: glibc
+Version: 2.31-13+deb11u5
+`
+
+const apkInstalled = `C:Q1abcd=
+P:musl
+V:1.2.2-r7
+A:x86_64
+L:MIT
+T:the musl c library
+
+P:busybox
+V:1.34.1-r5
+A:x86_64
+L:GPL-2.0-only AND BSD
+`
+
+// fileEntry is a file in a crafted layer; a content of "" with a name
+// starting with .wh. is a whiteout. The typeflag defaults to a regular file.
+type fileEntry struct {
+	name     string
+	content  string
+	mode     int64
+	typeflag byte
+}
+
+func (s *SBOMSuite) TestScanPackages() {
+	image := s.image(
+		[]fileEntry{
+			{name: "etc/os-release", content: "NAME=\"Debian GNU/Linux\"\nID=debian\nVERSION_ID=\"11\"\n"},
+			{name: "var/lib/dpkg/status", content: dpkgStatus},
+			{name: "var/lib/dpkg/status.d/distroless", content: "Package: tzdata\nVersion: 2021a-1\nArchitecture: all\n"},
+			{name: "var/lib/dpkg/status.d/distroless.md5sums", content: "abcd  usr/share/zoneinfo/UTC\n"},
+			{name: "var/lib/dpkg/status.d/removed-later", content: "Package: removed-later\nVersion: 1.0\n"},
+		},
+		[]fileEntry{
+			{name: "lib/apk/db/installed", content: apkInstalled},
+			{name: "var/lib/rpm/rpmdb.sqlite-wal", content: "not really a write-ahead log"},
+			{name: "usr/bin/script", content: "#!/bin/sh\necho hi\n", mode: 0755},
+			{name: "var/lib/dpkg/status.d/.wh.removed-later"},
+		},
+	)
+
+	scan, err := prototype.ScanPackages(image)
+	s.NoError(err)
+
+	s.Equal("debian", scan.DistroID)
+	s.Equal("11", scan.DistroVersion)
+
+	s.Equal([]prototype.Package{
+		{
+			Type:    prototype.PackageTypeApk,
+			Name:    "busybox",
+			Version: "1.34.1-r5",
+			Arch:    "x86_64",
+			License: "GPL-2.0-only AND BSD",
+			Source:  "/lib/apk/db/installed",
+			PURL:    "pkg:apk/debian/busybox@1.34.1-r5?arch=x86_64&distro=debian-11",
+		},
+		{
+			Type:    prototype.PackageTypeApk,
+			Name:    "musl",
+			Version: "1.2.2-r7",
+			Arch:    "x86_64",
+			License: "MIT",
+			Source:  "/lib/apk/db/installed",
+			PURL:    "pkg:apk/debian/musl@1.2.2-r7?arch=x86_64&distro=debian-11",
+		},
+		{
+			Type:    prototype.PackageTypeDeb,
+			Name:    "base-files",
+			Version: "11.1+deb11u5",
+			Arch:    "amd64",
+			Source:  "/var/lib/dpkg/status",
+			PURL:    "pkg:deb/debian/base-files@11.1+deb11u5?arch=amd64&distro=debian-11",
+		},
+		{
+			Type:    prototype.PackageTypeDeb,
+			Name:    "libc6",
+			Version: "2.31-13+deb11u5",
+			Arch:    "amd64",
+			Origin:  "glibc",
+			Source:  "/var/lib/dpkg/status",
+			PURL:    "pkg:deb/debian/libc6@2.31-13+deb11u5?arch=amd64&distro=debian-11",
+		},
+		{
+			Type:    prototype.PackageTypeDeb,
+			Name:    "tzdata",
+			Version: "2021a-1",
+			Arch:    "all",
+			Source:  "/var/lib/dpkg/status.d/distroless",
+			PURL:    "pkg:deb/debian/tzdata@2021a-1?arch=all&distro=debian-11",
+		},
+	}, scan.Packages)
+
+	s.Equal([]string{
+		"rpm database write-ahead log /var/lib/rpm/rpmdb.sqlite-wal is not read; its packages may be out of date",
+	}, scan.Warnings)
+}
+
+func (s *SBOMSuite) TestScanPackagesWithoutOSRelease() {
+	image := s.image([]fileEntry{
+		{name: "var/lib/dpkg/status", content: "Package: bash\nStatus: install ok installed\nVersion: 1:5.1-2\n"},
+		{name: "lib/apk/db/installed", content: "P:musl\nV:1.2.2-r7\n"},
+	})
+
+	scan, err := prototype.ScanPackages(image)
+	s.NoError(err)
+
+	s.Empty(scan.DistroID)
+	s.Equal("pkg:apk/alpine/musl@1.2.2-r7", scan.Packages[0].PURL)
+	s.Equal("pkg:deb/debian/bash@1%3A5.1-2", scan.Packages[1].PURL)
+}
+
+func (s *SBOMSuite) TestScanRpmNDB() {
+	db := ndbDatabase(
+		rpmHeader(map[int]string{1000: "bash", 1001: "4.4", 1002: "9.10.1", 1022: "x86_64", 1014: "GPL-3.0-or-later", 1044: "bash-4.4-9.10.1.src.rpm"}, -1),
+		rpmHeader(map[int]string{1000: "gpg-pubkey", 1001: "39db7c82", 1002: "5f68629b"}, -1),
+		rpmHeader(map[int]string{1000: "libz1", 1001: "1.2.11", 1002: "3.24.1", 1022: "x86_64", 1044: "zlib-1.2.11-3.24.1.src.rpm"}, 1),
+	)
+
+	image := s.image([]fileEntry{
+		{name: "etc/os-release", content: "ID=\"sles\"\nVERSION_ID=\"15.3\"\n"},
+		{name: "usr/lib/sysimage/rpm/Packages.db", content: string(db)},
+	})
+
+	scan, err := prototype.ScanPackages(image)
+	s.NoError(err)
+	s.Empty(scan.Warnings)
+
+	s.Equal([]prototype.Package{
+		{
+			Type:    prototype.PackageTypeRPM,
+			Name:    "bash",
+			Version: "4.4-9.10.1",
+			Arch:    "x86_64",
+			License: "GPL-3.0-or-later",
+			Source:  "/usr/lib/sysimage/rpm/Packages.db",
+			PURL:    "pkg:rpm/sles/bash@4.4-9.10.1?arch=x86_64&distro=sles-15.3",
+		},
+		{
+			Type:    prototype.PackageTypeRPM,
+			Name:    "libz1",
+			Version: "1:1.2.11-3.24.1",
+			Arch:    "x86_64",
+			Origin:  "zlib",
+			Source:  "/usr/lib/sysimage/rpm/Packages.db",
+			PURL:    "pkg:rpm/sles/libz1@1.2.11-3.24.1?arch=x86_64&epoch=1&distro=sles-15.3",
+		},
+	}, scan.Packages)
+}
+
+func (s *SBOMSuite) TestScanRpmNDBInvalid() {
+	image := s.image([]fileEntry{
+		{name: "var/lib/rpm/Packages.db", content: "not really an ndb database"},
+	})
+
+	_, err := prototype.ScanPackages(image)
+	s.EqualError(err, "parse var/lib/rpm/Packages.db: read header: unexpected EOF")
+}
+
+func (s *SBOMSuite) TestScanRpmBDB() {
+	headers := [][]byte{
+		rpmHeader(map[int]string{1000: "bash", 1001: "4.4.20", 1002: "1.el8_4", 1022: "x86_64", 1014: "GPLv3+", 1044: "bash-4.4.20-1.el8_4.src.rpm"}, -1),
+		rpmHeader(map[int]string{1000: "gpg-pubkey", 1001: "fd431d51", 1002: "4ae0493b"}, -1),
+		// long enough to span overflow pages
+		rpmHeader(map[int]string{1000: "openssl-libs", 1001: "1.1.1k", 1002: "5.el8_5", 1022: "x86_64", 1014: strings.Repeat("OpenSSL ", 100), 1044: "openssl-1.1.1k-5.el8_5.src.rpm"}, 1),
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		image := s.image([]fileEntry{
+			{name: "etc/os-release", content: "ID=\"rhel\"\nVERSION_ID=\"8.5\"\n"},
+			{name: "var/lib/rpm/Packages", content: string(bdbDatabase(order, headers...))},
+		})
+
+		scan, err := prototype.ScanPackages(image)
+		s.NoError(err)
+		s.Empty(scan.Warnings)
+
+		s.Equal([]prototype.Package{
+			{
+				Type:    prototype.PackageTypeRPM,
+				Name:    "bash",
+				Version: "4.4.20-1.el8_4",
+				Arch:    "x86_64",
+				License: "GPLv3+",
+				Source:  "/var/lib/rpm/Packages",
+				PURL:    "pkg:rpm/rhel/bash@4.4.20-1.el8_4?arch=x86_64&distro=rhel-8.5",
+			},
+			{
+				Type:    prototype.PackageTypeRPM,
+				Name:    "openssl-libs",
+				Version: "1:1.1.1k-5.el8_5",
+				Arch:    "x86_64",
+				License: strings.Repeat("OpenSSL ", 100),
+				Origin:  "openssl",
+				Source:  "/var/lib/rpm/Packages",
+				PURL:    "pkg:rpm/rhel/openssl-libs@1.1.1k-5.el8_5?arch=x86_64&epoch=1&distro=rhel-8.5",
+			},
+		}, scan.Packages)
+	}
+}
+
+func (s *SBOMSuite) TestScanRpmBDBInvalid() {
+	image := s.image([]fileEntry{
+		{name: "var/lib/rpm/Packages", content: strings.Repeat("not really a berkeley db", 4)},
+	})
+
+	_, err := prototype.ScanPackages(image)
+	s.EqualError(err, "parse var/lib/rpm/Packages: not a BerkeleyDB hash database")
+}
+
+func (s *SBOMSuite) TestScanRpmSQLite() {
+	image := s.image([]fileEntry{
+		{name: "etc/os-release", content: "ID=\"rhel\"\nVERSION_ID=\"9.0\"\n"},
+		{name: "var/lib/rpm/rpmdb.sqlite", content: string(sqliteDatabase(
+			rpmHeader(map[int]string{1000: "bash", 1001: "5.1.8", 1002: "4.el9", 1022: "x86_64", 1014: "GPLv3+", 1044: "bash-5.1.8-4.el9.src.rpm"}, -1),
+			rpmHeader(map[int]string{1000: "gpg-pubkey", 1001: "fd431d51", 1002: "4ae0493b"}, -1),
+			// the license pushes the header into overflow pages
+			rpmHeader(map[int]string{1000: "openssl-libs", 1001: "3.0.1", 1002: "41.el9_0", 1022: "x86_64", 1014: strings.Repeat("ASL 2.0 ", 200), 1044: "openssl-3.0.1-41.el9_0.src.rpm"}, 1),
+		))},
+	})
+
+	scan, err := prototype.ScanPackages(image)
+	s.NoError(err)
+
+	s.Equal([]prototype.Package{
+		{
+			Type:    prototype.PackageTypeRPM,
+			Name:    "bash",
+			Version: "5.1.8-4.el9",
+			Arch:    "x86_64",
+			License: "GPLv3+",
+			Source:  "/var/lib/rpm/rpmdb.sqlite",
+			PURL:    "pkg:rpm/rhel/bash@5.1.8-4.el9?arch=x86_64&distro=rhel-9.0",
+		},
+		{
+			Type:    prototype.PackageTypeRPM,
+			Name:    "openssl-libs",
+			Version: "1:3.0.1-41.el9_0",
+			Arch:    "x86_64",
+			License: strings.Repeat("ASL 2.0 ", 200),
+			Origin:  "openssl",
+			Source:  "/var/lib/rpm/rpmdb.sqlite",
+			PURL:    "pkg:rpm/rhel/openssl-libs@3.0.1-41.el9_0?arch=x86_64&epoch=1&distro=rhel-9.0",
+		},
+	}, scan.Packages)
+	s.Empty(scan.Warnings)
+}
+
+func (s *SBOMSuite) TestScanRpmSQLiteInvalid() {
+	image := s.image([]fileEntry{
+		{name: "usr/lib/sysimage/rpm/rpmdb.sqlite", content: strings.Repeat("not really a sqlite db", 8)},
+	})
+
+	_, err := prototype.ScanPackages(image)
+	s.EqualError(err, "parse usr/lib/sysimage/rpm/rpmdb.sqlite: not an SQLite database")
+}
+
+func (s *SBOMSuite) TestScanGoBinary() {
+	// the test binary is itself a Go binary with module info
+	executable, err := os.Executable()
+	s.NoError(err)
+
+	binary, err := ioutil.ReadFile(executable)
+	s.NoError(err)
+
+	image := s.image([]fileEntry{
+		{name: "usr/local/bin/app", content: string(binary), mode: 0755},
+	})
+
+	scan, err := prototype.ScanPackages(image)
+	s.NoError(err)
+
+	packages := map[string]prototype.Package{}
+	for _, pkg := range scan.Packages {
+		s.Equal(prototype.PackageTypeGolang, pkg.Type)
+		s.Equal("/usr/local/bin/app", pkg.Source)
+
+		packages[pkg.Name] = pkg
+	}
+
+	s.Equal(strings.TrimPrefix(runtime.Version(), "go"), packages["stdlib"].Version)
+	s.Contains(packages, "github.com/aoldershaw/oci-image-prototype")
+
+	testify := packages["github.com/stretchr/testify"]
+	s.Equal("v1.7.1", testify.Version)
+	s.Equal("pkg:golang/github.com/stretchr/testify@v1.7.1", testify.PURL)
+}
+
+func (s *SBOMSuite) TestGenerateSBOM() {
+	image := s.image([]fileEntry{
+		{name: "lib/apk/db/installed", content: apkInstalled},
+		{name: "etc/os-release", content: "ID=alpine\nVERSION_ID=3.15.0\n"},
+	})
+
+	image, err := mutate.CreatedAt(image, v1.Time{Time: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)})
+	s.NoError(err)
+
+	digest, err := image.ConfigName()
+	s.NoError(err)
+
+	doc, err := prototype.GenerateSBOM(image, "some-output")
+	s.NoError(err)
+
+	s.Equal("SPDX-2.3", doc.SPDXVersion)
+	s.Equal("some-output", doc.Name)
+	s.Equal("https://spdx.org/spdxdocs/oci-image-prototype/some-output-"+digest.Hex, doc.DocumentNamespace)
+	s.Equal("2021-01-01T00:00:00Z", doc.CreationInfo.Created)
+	s.Empty(doc.Comment)
+
+	s.Len(doc.Packages, 3)
+
+	s.Equal("SPDXRef-Image", doc.Packages[0].SPDXID)
+	s.Equal(digest.String(), doc.Packages[0].VersionInfo)
+
+	s.Equal(prototype.SPDXPackage{
+		SPDXID:           "SPDXRef-Package-apk-busybox-0",
+		Name:             "busybox",
+		VersionInfo:      "1.34.1-r5",
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		SourceInfo:       "found in /lib/apk/db/installed",
+		ExternalRefs: []prototype.SPDXExternalRef{
+			{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  "pkg:apk/alpine/busybox@1.34.1-r5?arch=x86_64&distro=alpine-3.15.0",
+			},
+		},
+	}, doc.Packages[1])
+
+	s.Equal("SPDXRef-Package-apk-musl-1", doc.Packages[2].SPDXID)
+	s.Equal("MIT", doc.Packages[2].LicenseDeclared)
+
+	s.Equal([]prototype.SPDXRelationship{
+		{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-Image"},
+		{SPDXElementID: "SPDXRef-Image", RelationshipType: "CONTAINS", RelatedSPDXElement: "SPDXRef-Package-apk-busybox-0"},
+		{SPDXElementID: "SPDXRef-Image", RelationshipType: "CONTAINS", RelatedSPDXElement: "SPDXRef-Package-apk-musl-1"},
+	}, doc.Relationships)
+}
+
+func (s *SBOMSuite) image(layers ...[]fileEntry) v1.Image {
+	return craftImage(s.Assertions, layers...)
+}
+
+// craftImage creates an image with a layer for each list of files.
+func craftImage(s *require.Assertions, layers ...[]fileEntry) v1.Image {
+	image := empty.Image
+
+	for _, files := range layers {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+
+		for _, file := range files {
+			mode := file.mode
+			if mode == 0 {
+				mode = 0644
+			}
+
+			typeflag := file.typeflag
+			if typeflag == 0 {
+				typeflag = tar.TypeReg
+			}
+
+			err := tw.WriteHeader(&tar.Header{
+				Name:     file.name,
+				Typeflag: typeflag,
+				Mode:     mode,
+				Size:     int64(len(file.content)),
+			})
+			s.NoError(err)
+
+			_, err = tw.Write([]byte(file.content))
+			s.NoError(err)
+		}
+
+		s.NoError(tw.Close())
+
+		content := buf.Bytes()
+
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		})
+		s.NoError(err)
+
+		image, err = mutate.AppendLayers(image, layer)
+		s.NoError(err)
+	}
+
+	return image
+}
+
+// rpmHeader encodes an rpm header with the given string tags, and an epoch
+// unless it is negative.
+func rpmHeader(strs map[int]string, epoch int) []byte {
+	var index, data bytes.Buffer
+
+	entry := func(tag, typ int) {
+		for _, field := range []int{tag, typ, data.Len(), 1} {
+			binary.Write(&index, binary.BigEndian, uint32(field))
+		}
+	}
+
+	for _, tag := range []int{1000, 1001, 1002, 1014, 1022, 1044} {
+		if str, found := strs[tag]; found {
+			entry(tag, 6)
+			data.WriteString(str + "\x00")
+		}
+	}
+
+	if epoch >= 0 {
+		// ints are aligned
+		for data.Len()%4 != 0 {
+			data.WriteByte(0)
+		}
+
+		entry(1003, 4)
+		binary.Write(&data, binary.BigEndian, uint32(epoch))
+	}
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, uint32(index.Len()/16))
+	binary.Write(&header, binary.BigEndian, uint32(data.Len()))
+	header.Write(index.Bytes())
+	header.Write(data.Bytes())
+
+	return header.Bytes()
+}
+
+// ndbDatabase encodes an rpm NDB database with a single page of slots,
+// followed by the headers' blobs.
+func ndbDatabase(headers ...[]byte) []byte {
+	const pageSize, blkSize = 4096, 16
+
+	magic := func(s string) uint32 {
+		return binary.LittleEndian.Uint32([]byte(s))
+	}
+
+	var slots, blobs bytes.Buffer
+	binary.Write(&slots, binary.LittleEndian, []uint32{magic("RpmP"), 0, 0, 1, 0, 0, 0, 0})
+
+	for i, header := range headers {
+		blkOffset := (pageSize + blobs.Len()) / blkSize
+
+		binary.Write(&blobs, binary.LittleEndian, []uint32{magic("BlbS"), uint32(i + 1), 0, uint32(len(header))})
+		blobs.Write(header)
+		for blobs.Len()%blkSize != 0 {
+			blobs.WriteByte(0)
+		}
+
+		blkCount := (pageSize+blobs.Len())/blkSize - blkOffset
+		binary.Write(&slots, binary.LittleEndian, []uint32{magic("Slot"), uint32(i + 1), uint32(blkOffset), uint32(blkCount)})
+	}
+
+	for slots.Len() < pageSize {
+		binary.Write(&slots, binary.LittleEndian, []uint32{magic("Slot"), 0, 0, 0})
+	}
+
+	return append(slots.Bytes(), blobs.Bytes()...)
+}
+
+func TestSBOM(t *testing.T) {
+	suite.Run(t, &SBOMSuite{
+		Assertions: require.New(t),
+	})
+}
+
+// bdbDatabase encodes an rpm BerkeleyDB hash database with a single hash
+// page, whose values are the headers stored in overflow pages.
+func bdbDatabase(order binary.ByteOrder, headers ...[]byte) []byte {
+	const pageSize, headerSize = 512, 26
+
+	var overflow [][]byte
+	hashPage := make([]byte, pageSize)
+
+	// entries are written from the end of the page, indexed from its start
+	free := pageSize
+	addEntry := func(i int, entry []byte) {
+		free -= len(entry)
+		copy(hashPage[free:], entry)
+		order.PutUint16(hashPage[headerSize+i*2:], uint16(free))
+	}
+
+	for i, header := range headers {
+		key := make([]byte, 5)
+		key[0] = 1
+		order.PutUint32(key[1:], uint32(i+1))
+		addEntry(i*2, key)
+
+		// the chain starts after the metadata, hash and previous overflow
+		// pages
+		value := make([]byte, 12)
+		value[0] = 3
+		order.PutUint32(value[4:], uint32(2+len(overflow)))
+		order.PutUint32(value[8:], uint32(len(header)))
+		addEntry(i*2+1, value)
+
+		for len(header) > 0 {
+			n := len(header)
+			if n > pageSize-headerSize {
+				n = pageSize - headerSize
+			}
+
+			page := make([]byte, pageSize)
+			page[25] = 7
+			order.PutUint16(page[22:], uint16(n))
+			copy(page[headerSize:], header[:n])
+
+			header = header[n:]
+			if len(header) > 0 {
+				order.PutUint32(page[16:], uint32(2+len(overflow)+1))
+			}
+
+			overflow = append(overflow, page)
+		}
+	}
+
+	hashPage[25] = 13
+	order.PutUint16(hashPage[20:], uint16(len(headers)*2))
+
+	meta := make([]byte, pageSize)
+	order.PutUint32(meta[12:], 0x061561)
+	order.PutUint32(meta[16:], 9)
+	order.PutUint32(meta[20:], pageSize)
+	meta[25] = 8
+	order.PutUint32(meta[32:], uint32(1+len(overflow)))
+
+	db := append(meta, hashPage...)
+	for _, page := range overflow {
+		db = append(db, page...)
+	}
+
+	return db
+}
+
+// sqliteDatabase encodes an rpm SQLite database whose Packages table has an
+// interior root page with a leaf page per header. Headers which don't fit in
+// their leaf page continue in overflow pages.
+func sqliteDatabase(headers ...[]byte) []byte {
+	const pageSize = 512
+
+	varint := func(v uint64) []byte {
+		b := []byte{byte(v & 0x7f)}
+		for v >>= 7; v > 0; v >>= 7 {
+			b = append([]byte{byte(v&0x7f) | 0x80}, b...)
+		}
+
+		return b
+	}
+
+	uint32be := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+
+	record := func(values ...interface{}) []byte {
+		var header, body []byte
+		for _, value := range values {
+			switch v := value.(type) {
+			case nil:
+				header = append(header, 0)
+			case int:
+				header = append(header, 1)
+				body = append(body, byte(v))
+			case string:
+				header = append(header, varint(uint64(len(v)*2+13))...)
+				body = append(body, v...)
+			case []byte:
+				header = append(header, varint(uint64(len(v)*2+12))...)
+				body = append(body, v...)
+			}
+		}
+
+		// the header's size includes itself
+		return append(append(varint(uint64(len(header)+1)), header...), body...)
+	}
+
+	var pages [][]byte
+	newPage := func() uint32 {
+		pages = append(pages, make([]byte, pageSize))
+		return uint32(len(pages))
+	}
+
+	// cells are written from the end of the page, indexed from its start
+	writePage := func(pgno uint32, pageType byte, cells [][]byte, rightmost uint32) {
+		page := pages[pgno-1]
+
+		start, headerSize := 0, 8
+		if pgno == 1 {
+			start = 100
+		}
+
+		if rightmost != 0 {
+			headerSize = 12
+			binary.BigEndian.PutUint32(page[start+8:], rightmost)
+		}
+
+		page[start] = pageType
+		binary.BigEndian.PutUint16(page[start+3:], uint16(len(cells)))
+
+		free := pageSize
+		for i, cell := range cells {
+			free -= len(cell)
+			copy(page[free:], cell)
+			binary.BigEndian.PutUint16(page[start+headerSize+i*2:], uint16(free))
+		}
+
+		binary.BigEndian.PutUint16(page[start+5:], uint16(free))
+	}
+
+	leafCell := func(rowid int, payload []byte) []byte {
+		cell := append(varint(uint64(len(payload))), varint(uint64(rowid))...)
+
+		local := len(payload)
+		if maxLocal := pageSize - 35; local > maxLocal {
+			minLocal := (pageSize-12)*32/255 - 23
+			local = minLocal + (len(payload)-minLocal)%(pageSize-4)
+			if local > maxLocal {
+				local = minLocal
+			}
+		}
+
+		cell = append(cell, payload[:local]...)
+		if local == len(payload) {
+			return cell
+		}
+
+		// overflow pages hold the next page's number, then the payload
+		cell = append(cell, uint32be(uint32(len(pages)+1))...)
+		for rest := payload[local:]; len(rest) > 0; {
+			pgno := newPage()
+			rest = rest[copy(pages[pgno-1][4:], rest):]
+			if len(rest) > 0 {
+				copy(pages[pgno-1], uint32be(pgno+1))
+			}
+		}
+
+		return cell
+	}
+
+	schema := newPage()
+	sequence := newPage()
+	root := newPage()
+
+	var leaves []uint32
+	for i, header := range headers {
+		leaf := newPage()
+		writePage(leaf, 0x0d, [][]byte{leafCell(i+1, record(nil, header))}, 0)
+		leaves = append(leaves, leaf)
+	}
+
+	// interior cells hold a child page and its largest rowid
+	var interior [][]byte
+	for i, leaf := range leaves[:len(leaves)-1] {
+		interior = append(interior, append(uint32be(leaf), varint(uint64(i+1))...))
+	}
+
+	writePage(root, 0x05, interior, leaves[len(leaves)-1])
+	writePage(sequence, 0x0d, nil, 0)
+
+	writePage(schema, 0x0d, [][]byte{
+		leafCell(1, record("table", "Packages", "Packages", int(root), "CREATE TABLE 'Packages' (hnum INTEGER PRIMARY KEY AUTOINCREMENT,blob BLOB NOT NULL)")),
+		leafCell(2, record("table", "sqlite_sequence", "sqlite_sequence", int(sequence), "CREATE TABLE sqlite_sequence(name,seq)")),
+	}, 0)
+
+	header := pages[0]
+	copy(header, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(header[16:], pageSize)
+	header[18], header[19] = 1, 1
+	header[21], header[22], header[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(header[28:], uint32(len(pages)))
+	binary.BigEndian.PutUint32(header[44:], 4)
+	binary.BigEndian.PutUint32(header[56:], 1)
+
+	var db []byte
+	for _, page := range pages {
+		db = append(db, page...)
+	}
+
+	return db
+}
@@ -0,0 +1,368 @@
+package prototype
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	prototype "github.com/aoldershaw/prototype-sdk-go"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Files next to image.tar which the scan message writes its report to.
+const (
+	ScanReportFile = "scan.json"
+	ScanSARIFFile  = "scan.sarif"
+)
+
+// ScanConfig is the config for the scan message: the built image is both an
+// input and an output (so that the reports are written next to it), and the
+// vulnerability database is an input.
+func ScanConfig(img OCIImage) prototype.Config {
+	var config prototype.Config
+
+	config.Inputs = []prototype.Input{{Name: img.Output, Path: finalOutput}}
+
+	if img.Scan != nil {
+		if input := inputName(img.Scan.Database); input != "" {
+			config.Inputs = append(config.Inputs, prototype.Input{Name: input})
+		}
+	}
+
+	config.Outputs = []prototype.Output{{Name: img.Output, Path: finalOutput}}
+
+	return config
+}
+
+// RunScan scans the image built by the build message for vulnerabilities.
+func RunScan(img OCIImage) ([]prototype.MessageResponse, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("get root path: %w", err)
+	}
+
+	return nil, Scan(img, wd)
+}
+
+// Scan matches the packages in each target's image.tar within outputsDir
+// against the vulnerability database, writing a report of each to scan.json
+// and scan.sarif next to it. Additional targets which were not output are
+// skipped.
+//
+// All targets are scanned before failing if any has a vulnerability at or
+// above the FailOn severity.
+func Scan(img OCIImage, outputsDir string) error {
+	sanitize(&img)
+
+	err := img.ValidateScan()
+	if err != nil {
+		return errors.Wrap(err, "config")
+	}
+
+	db, err := LoadVulnerabilityDB(img.Scan.Database)
+	if err != nil {
+		return errors.Wrap(err, "load vulnerability database")
+	}
+
+	logrus.Infof("loaded %d advisories from %s", db.Len(), img.Scan.Database)
+
+	var failed []string
+	for _, output := range append([]string{finalOutput}, img.AdditionalTargets...) {
+		imagePath := filepath.Join(outputsDir, output, "image.tar")
+		if _, err := os.Stat(imagePath); err != nil && output != finalOutput {
+			continue
+		}
+
+		image, err := tarball.ImageFromPath(imagePath, nil)
+		if err != nil {
+			return errors.Wrapf(err, "read image '%s'", output)
+		}
+
+		report, err := ScanImage(db, image)
+		if err != nil {
+			return errors.Wrapf(err, "scan image '%s'", output)
+		}
+
+		for _, warning := range report.Warnings {
+			logrus.Warnf("%s: %s", output, warning)
+		}
+
+		logrus.Infof("%s: %s", output, report.Summary())
+
+		err = writeScanReport(filepath.Join(outputsDir, output), report)
+		if err != nil {
+			return errors.Wrapf(err, "write scan report for '%s'", output)
+		}
+
+		if img.Scan.FailOn == "" {
+			continue
+		}
+
+		if n := len(report.AtOrAbove(img.Scan.FailOn)); n > 0 {
+			failed = append(failed, fmt.Sprintf("'%s' has %d", output, n))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("vulnerabilities of %s severity or higher found: image %s", img.Scan.FailOn, strings.Join(failed, ", image "))
+	}
+
+	return nil
+}
+
+// ScanReport lists the vulnerabilities found in an image.
+type ScanReport struct {
+	// Manifest digest of the scanned image.
+	Image string `json:"image"`
+
+	// Distro the image is based on, e.g. "debian 11".
+	Distro string `json:"distro,omitempty"`
+
+	// Number of packages found.
+	Packages int `json:"packages"`
+
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+
+	// Package databases which could not be read, and packages which could
+	// not be matched, so were not scanned.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ScanImage finds the packages in the image and matches them against the
+// database.
+func ScanImage(db VulnerabilityDB, image v1.Image) (ScanReport, error) {
+	digest, err := image.Digest()
+	if err != nil {
+		return ScanReport{}, errors.Wrap(err, "get digest")
+	}
+
+	scan, err := ScanPackages(image)
+	if err != nil {
+		return ScanReport{}, err
+	}
+
+	report := ScanReport{
+		Image:           digest.String(),
+		Distro:          strings.TrimSpace(scan.DistroID + " " + scan.DistroVersion),
+		Packages:        len(scan.Packages),
+		Vulnerabilities: db.Match(scan),
+		Warnings:        scan.Warnings,
+	}
+
+	if report.Vulnerabilities == nil {
+		report.Vulnerabilities = []Vulnerability{}
+	}
+
+	// rpm distros' advisories aren't supported, so their packages are
+	// listed but not matched
+	var unmatched int
+	for _, pkg := range scan.Packages {
+		if ecosystem, _ := packageEcosystem(pkg, scan.DistroID, scan.DistroVersion); ecosystem == "" && pkg.Type == PackageTypeRPM {
+			unmatched++
+		}
+	}
+
+	if unmatched > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("%d rpm packages were not matched against the database; advisories for rpm distros are not supported", unmatched))
+	}
+
+	return report, nil
+}
+
+// AtOrAbove returns the vulnerabilities which are at least as severe as the
+// given severity.
+func (report ScanReport) AtOrAbove(severity string) []Vulnerability {
+	var vulns []Vulnerability
+	for _, vuln := range report.Vulnerabilities {
+		if severityRanks[vuln.Severity] >= severityRanks[severity] {
+			vulns = append(vulns, vuln)
+		}
+	}
+
+	return vulns
+}
+
+// Summary counts the vulnerabilities by severity, e.g. "3 vulnerabilities in
+// 120 packages (1 critical, 2 low)".
+func (report ScanReport) Summary() string {
+	summary := fmt.Sprintf("%d vulnerabilities in %d packages", len(report.Vulnerabilities), report.Packages)
+
+	var counts []string
+	for _, severity := range []string{SeverityCritical, SeverityHigh, SeverityMedium, SeverityLow, SeverityUnknown} {
+		var n int
+		for _, vuln := range report.Vulnerabilities {
+			if vuln.Severity == severity {
+				n++
+			}
+		}
+
+		if n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, severity))
+		}
+	}
+
+	if len(counts) > 0 {
+		summary += " (" + strings.Join(counts, ", ") + ")"
+	}
+
+	return summary
+}
+
+func writeScanReport(dir string, report ScanReport) error {
+	payload, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, ScanReportFile), payload, 0644)
+	if err != nil {
+		return err
+	}
+
+	payload, err = json.MarshalIndent(report.SARIF(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, ScanSARIFFile), payload, 0644)
+}
+
+// SARIFLog is a SARIF 2.1.0 log, as consumed by e.g. GitHub code scanning.
+// Only the fields that are written are defined.
+type SARIFLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []SARIFRun `json:"runs"`
+}
+
+type SARIFRun struct {
+	Tool    SARIFTool     `json:"tool"`
+	Results []SARIFResult `json:"results"`
+}
+
+type SARIFTool struct {
+	Driver SARIFDriver `json:"driver"`
+}
+
+type SARIFDriver struct {
+	Name  string      `json:"name"`
+	Rules []SARIFRule `json:"rules"`
+}
+
+type SARIFRule struct {
+	ID               string            `json:"id"`
+	ShortDescription SARIFMessage      `json:"shortDescription"`
+	HelpURI          string            `json:"helpUri"`
+	Properties       map[string]string `json:"properties,omitempty"`
+}
+
+type SARIFResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   SARIFMessage    `json:"message"`
+	Locations []SARIFLocation `json:"locations"`
+}
+
+type SARIFMessage struct {
+	Text string `json:"text"`
+}
+
+type SARIFLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+// sarifSecurityScores are the 'security-severity' given to rules for
+// advisories without a CVSS score, at the bottom of each severity's range.
+var sarifSecurityScores = map[string]float64{
+	SeverityLow:      0.1,
+	SeverityMedium:   4,
+	SeverityHigh:     7,
+	SeverityCritical: 9,
+}
+
+// SARIF converts the report to a SARIF log, with a rule per advisory and a
+// result per vulnerable package, located at the package's database or
+// binary.
+func (report ScanReport) SARIF() SARIFLog {
+	driver := SARIFDriver{
+		Name:  "oci-image-prototype",
+		Rules: []SARIFRule{},
+	}
+
+	results := []SARIFResult{}
+
+	seen := map[string]bool{}
+	for _, vuln := range report.Vulnerabilities {
+		if !seen[vuln.ID] {
+			seen[vuln.ID] = true
+
+			rule := SARIFRule{
+				ID:               vuln.ID,
+				ShortDescription: SARIFMessage{Text: vuln.Summary},
+				HelpURI:          "https://osv.dev/vulnerability/" + vuln.ID,
+			}
+
+			if rule.ShortDescription.Text == "" {
+				rule.ShortDescription.Text = vuln.ID
+			}
+
+			score, found := sarifSecurityScores[vuln.Severity]
+			if vuln.Score > 0 {
+				score, found = vuln.Score, true
+			}
+
+			if found {
+				rule.Properties = map[string]string{
+					"security-severity": strconv.FormatFloat(score, 'f', 1, 64),
+				}
+			}
+
+			driver.Rules = append(driver.Rules, rule)
+		}
+
+		message := fmt.Sprintf("%s %s is affected by %s (%s)", vuln.Package.Name, vuln.Package.Version, vuln.ID, vuln.Severity)
+		if vuln.FixedVersion != "" {
+			message += "; fixed in " + vuln.FixedVersion
+		}
+
+		var location SARIFLocation
+		location.PhysicalLocation.ArtifactLocation.URI = vuln.Package.Source
+
+		results = append(results, SARIFResult{
+			RuleID:    vuln.ID,
+			Level:     sarifLevel(vuln.Severity),
+			Message:   SARIFMessage{Text: message},
+			Locations: []SARIFLocation{location},
+		})
+	}
+
+	return SARIFLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []SARIFRun{
+			{Tool: SARIFTool{Driver: driver}, Results: results},
+		},
+	}
+}
+
+func sarifLevel(severity string) string {
+	switch severity {
+	case SeverityCritical, SeverityHigh:
+		return "error"
+	case SeverityMedium:
+		return "warning"
+	default:
+		return "note"
+	}
+}
@@ -0,0 +1,349 @@
+package prototype_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type ScanSuite struct {
+	suite.Suite
+	*require.Assertions
+
+	db string
+}
+
+var osvAdvisories = map[string]string{
+	// matched through libc6's source package
+	"debian/DSA-0001-1.json": `{
+		"id": "DSA-0001-1",
+		"aliases": ["CVE-2022-0001"],
+		"summary": "glibc - buffer overflow",
+		"severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"}],
+		"affected": [{
+			"package": {"ecosystem": "Debian:11", "name": "glibc"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "2.31-13+deb11u6"}]}]
+		}]
+	}`,
+
+	// for another release
+	"debian/DSA-0002-1.json": `{
+		"id": "DSA-0002-1",
+		"affected": [{
+			"package": {"ecosystem": "Debian:10", "name": "glibc"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "2.28-10+deb10u2"}]}]
+		}]
+	}`,
+
+	// already fixed
+	"debian/DSA-0003-1.json": `{
+		"id": "DSA-0003-1",
+		"affected": [{
+			"package": {"ecosystem": "Debian:11", "name": "base-files"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "11.1+deb11u5"}]}]
+		}]
+	}`,
+
+	// affected up to and including a version
+	"debian/DLA-0004-1.json": `{
+		"id": "DLA-0004-1",
+		"affected": [{
+			"package": {"ecosystem": "Debian", "name": "base-files"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "11.0"}, {"last_affected": "11.1+deb11u5"}]}]
+		}]
+	}`,
+
+	"debian/withdrawn.json": `{
+		"id": "DSA-0005-1",
+		"withdrawn": "2022-01-01T00:00:00Z",
+		"affected": [{
+			"package": {"ecosystem": "Debian:11", "name": "libc6"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}]}]
+		}]
+	}`,
+
+	// affected by explicit version, with a severity but no score
+	"debian/nested/GHSA-0006.json": `{
+		"id": "GHSA-0006",
+		"summary": "tzdata is out of date",
+		"affected": [{
+			"package": {"ecosystem": "Debian:11", "name": "tzdata"},
+			"versions": ["2020a-1", "2021a-1"],
+			"database_specific": {"severity": "MODERATE"}
+		}]
+	}`,
+
+	"alpine/ALPINE-0007.json": `{
+		"id": "ALPINE-0007",
+		"affected": [{
+			"package": {"ecosystem": "Alpine:v3.15", "name": "musl"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "1.2.2-r8"}]}]
+		}]
+	}`,
+
+	// Go advisories list versions without the module's 'v' prefix
+	"go/GO-0008.json": `{
+		"id": "GO-0008",
+		"affected": [{
+			"package": {"ecosystem": "Go", "name": "example.com/some/module"},
+			"versions": ["1.2.3"]
+		}]
+	}`,
+
+	"README.md": "not an advisory",
+}
+
+func (s *ScanSuite) SetupTest() {
+	var err error
+	s.db, err = ioutil.TempDir("", "osv")
+	s.NoError(err)
+
+	for name, content := range osvAdvisories {
+		path := filepath.Join(s.db, name)
+		s.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		s.NoError(ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func (s *ScanSuite) TearDownTest() {
+	s.NoError(os.RemoveAll(s.db))
+}
+
+func (s *ScanSuite) TestScanImage() {
+	db, err := prototype.LoadVulnerabilityDB(s.db)
+	s.NoError(err)
+
+	image := craftImage(s.Assertions, []fileEntry{
+		{name: "etc/os-release", content: "ID=debian\nVERSION_ID=\"11\"\n"},
+		{name: "var/lib/dpkg/status", content: dpkgStatus},
+		{name: "var/lib/dpkg/status.d/distroless", content: "Package: tzdata\nVersion: 2021a-1\nArchitecture: all\n"},
+		{name: "var/lib/rpm/rpmdb.sqlite-wal", content: "write-ahead log"},
+	})
+
+	digest, err := image.Digest()
+	s.NoError(err)
+
+	report, err := prototype.ScanImage(db, image)
+	s.NoError(err)
+
+	s.Equal(digest.String(), report.Image)
+	s.Equal("debian 11", report.Distro)
+	s.Equal(3, report.Packages)
+	s.Equal([]string{"rpm database write-ahead log /var/lib/rpm/rpmdb.sqlite-wal is not read; its packages may be out of date"}, report.Warnings)
+
+	s.Len(report.Vulnerabilities, 3)
+
+	s.Equal(prototype.Vulnerability{
+		ID:       "DLA-0004-1",
+		Severity: prototype.SeverityUnknown,
+		Package:  report.Vulnerabilities[0].Package,
+	}, report.Vulnerabilities[0])
+	s.Equal("base-files", report.Vulnerabilities[0].Package.Name)
+
+	s.Equal(prototype.Vulnerability{
+		ID:           "DSA-0001-1",
+		Aliases:      []string{"CVE-2022-0001"},
+		Summary:      "glibc - buffer overflow",
+		Severity:     prototype.SeverityCritical,
+		Score:        9.8,
+		Package:      report.Vulnerabilities[1].Package,
+		FixedVersion: "2.31-13+deb11u6",
+	}, report.Vulnerabilities[1])
+	s.Equal("libc6", report.Vulnerabilities[1].Package.Name)
+
+	s.Equal(prototype.Vulnerability{
+		ID:       "GHSA-0006",
+		Summary:  "tzdata is out of date",
+		Severity: prototype.SeverityMedium,
+		Package:  report.Vulnerabilities[2].Package,
+	}, report.Vulnerabilities[2])
+	s.Equal("tzdata", report.Vulnerabilities[2].Package.Name)
+
+	s.Equal("3 vulnerabilities in 3 packages (1 critical, 1 medium, 1 unknown)", report.Summary())
+	s.Len(report.AtOrAbove(prototype.SeverityHigh), 1)
+	s.Len(report.AtOrAbove(prototype.SeverityUnknown), 3)
+}
+
+func (s *ScanSuite) TestScanImageAlpine() {
+	db, err := prototype.LoadVulnerabilityDB(s.db)
+	s.NoError(err)
+
+	for version, vulnerable := range map[string]bool{
+		"3.15.4": true,
+		"3.16.0": false,
+	} {
+		image := craftImage(s.Assertions, []fileEntry{
+			{name: "etc/os-release", content: "ID=alpine\nVERSION_ID=" + version + "\n"},
+			{name: "lib/apk/db/installed", content: apkInstalled},
+		})
+
+		report, err := prototype.ScanImage(db, image)
+		s.NoError(err)
+
+		if vulnerable {
+			s.Len(report.Vulnerabilities, 1, version)
+			s.Equal("ALPINE-0007", report.Vulnerabilities[0].ID)
+			s.Equal("1.2.2-r8", report.Vulnerabilities[0].FixedVersion)
+		} else {
+			s.Empty(report.Vulnerabilities, version)
+		}
+	}
+}
+
+func (s *ScanSuite) TestScanImageRpm() {
+	db, err := prototype.LoadVulnerabilityDB(s.db)
+	s.NoError(err)
+
+	image := craftImage(s.Assertions, []fileEntry{
+		{name: "etc/os-release", content: "ID=\"sles\"\nVERSION_ID=\"15.3\"\n"},
+		{name: "usr/lib/sysimage/rpm/Packages.db", content: string(ndbDatabase(
+			rpmHeader(map[int]string{1000: "bash", 1001: "4.4", 1002: "9.10.1"}, -1),
+		))},
+	})
+
+	report, err := prototype.ScanImage(db, image)
+	s.NoError(err)
+
+	s.Equal(1, report.Packages)
+	s.Empty(report.Vulnerabilities)
+	s.Equal([]string{"1 rpm packages were not matched against the database; advisories for rpm distros are not supported"}, report.Warnings)
+}
+
+func (s *ScanSuite) TestMatchGoVersions() {
+	db, err := prototype.LoadVulnerabilityDB(s.db)
+	s.NoError(err)
+
+	for version, vulnerable := range map[string]bool{
+		"v1.2.3": true,
+		"v1.2.4": false,
+	} {
+		vulns := db.Match(prototype.PackageScan{
+			Packages: []prototype.Package{
+				{Type: prototype.PackageTypeGolang, Name: "example.com/some/module", Version: version},
+			},
+		})
+
+		if vulnerable {
+			s.Len(vulns, 1, version)
+			s.Equal("GO-0008", vulns[0].ID)
+		} else {
+			s.Empty(vulns, version)
+		}
+	}
+}
+
+func (s *ScanSuite) TestScan() {
+	outputsDir, err := ioutil.TempDir("", "scan-outputs")
+	s.NoError(err)
+
+	defer os.RemoveAll(outputsDir)
+
+	image := craftImage(s.Assertions, []fileEntry{
+		{name: "etc/os-release", content: "ID=debian\nVERSION_ID=\"11\"\n"},
+		{name: "var/lib/dpkg/status", content: dpkgStatus},
+	})
+
+	s.NoError(os.MkdirAll(filepath.Join(outputsDir, "image"), 0755))
+	s.NoError(tarball.WriteToFile(filepath.Join(outputsDir, "image", "image.tar"), nil, image))
+
+	img := prototype.OCIImage{
+		Output: "image",
+
+		// not output, so skipped
+		AdditionalTargets: []string{"some-target"},
+
+		Scan: &prototype.VulnerabilityScan{Database: s.db},
+	}
+
+	err = prototype.Scan(img, outputsDir)
+	s.NoError(err)
+
+	var report prototype.ScanReport
+	s.readJSON(filepath.Join(outputsDir, "image", prototype.ScanReportFile), &report)
+	s.Len(report.Vulnerabilities, 2)
+
+	var sarif prototype.SARIFLog
+	s.readJSON(filepath.Join(outputsDir, "image", prototype.ScanSARIFFile), &sarif)
+
+	s.Equal("2.1.0", sarif.Version)
+	s.Len(sarif.Runs, 1)
+
+	run := sarif.Runs[0]
+	s.Equal("oci-image-prototype", run.Tool.Driver.Name)
+	s.Equal([]prototype.SARIFRule{
+		{
+			ID:               "DLA-0004-1",
+			ShortDescription: prototype.SARIFMessage{Text: "DLA-0004-1"},
+			HelpURI:          "https://osv.dev/vulnerability/DLA-0004-1",
+		},
+		{
+			ID:               "DSA-0001-1",
+			ShortDescription: prototype.SARIFMessage{Text: "glibc - buffer overflow"},
+			HelpURI:          "https://osv.dev/vulnerability/DSA-0001-1",
+			Properties:       map[string]string{"security-severity": "9.8"},
+		},
+	}, run.Tool.Driver.Rules)
+
+	s.Len(run.Results, 2)
+	s.Equal("note", run.Results[0].Level)
+	s.Equal("error", run.Results[1].Level)
+	s.Equal("libc6 2.31-13+deb11u5 is affected by DSA-0001-1 (critical); fixed in 2.31-13+deb11u6", run.Results[1].Message.Text)
+	s.Equal("/var/lib/dpkg/status", run.Results[1].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+
+	img.Scan.FailOn = prototype.SeverityCritical
+	err = prototype.Scan(img, outputsDir)
+	s.EqualError(err, "vulnerabilities of critical severity or higher found: image 'image' has 1")
+
+	img.Scan.FailOn = prototype.SeverityUnknown
+	err = prototype.Scan(img, outputsDir)
+	s.EqualError(err, "vulnerabilities of unknown severity or higher found: image 'image' has 2")
+
+	img.Scan.FailOn = "severe"
+	err = prototype.Scan(img, outputsDir)
+	s.EqualError(err, "config: invalid configuration:\n  - scan.fail_on: must be unknown, low, medium, high or critical: severe")
+}
+
+func (s *ScanSuite) TestCVSSv3BaseScore() {
+	for vector, expected := range map[string]float64{
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H": 9.8,
+		"CVSS:3.0/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H": 10,
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:C/C:L/I:L/A:N": 6.1,
+		"CVSS:3.1/AV:L/AC:L/PR:L/UI:N/S:U/C:H/I:N/A:N": 5.5,
+		"CVSS:3.1/AV:P/AC:H/PR:H/UI:R/S:U/C:L/I:N/A:N": 1.6,
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N": 0,
+
+		// temporal metrics are ignored
+		"CVSS:3.1/AV:N/AC:L/PR:L/UI:N/S:U/C:H/I:H/A:H/E:P": 8.8,
+	} {
+		score, err := prototype.CVSSv3BaseScore(vector)
+		s.NoError(err, vector)
+		s.Equal(expected, score, vector)
+	}
+
+	_, err := prototype.CVSSv3BaseScore("AV:N/AC:L/Au:N/C:P/I:P/A:P")
+	s.EqualError(err, "not a CVSS v3 vector: AV:N/AC:L/Au:N/C:P/I:P/A:P")
+
+	_, err = prototype.CVSSv3BaseScore("CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H")
+	s.EqualError(err, "invalid or missing A in CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H")
+}
+
+func (s *ScanSuite) readJSON(path string, dest interface{}) {
+	payload, err := ioutil.ReadFile(path)
+	s.NoError(err)
+
+	s.NoError(json.Unmarshal(payload, dest))
+}
+
+func TestScan(t *testing.T) {
+	suite.Run(t, &ScanSuite{
+		Assertions: require.New(t),
+	})
+}
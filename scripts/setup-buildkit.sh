@@ -16,6 +16,7 @@ if [ "$(id -u)" != "0" ]; then
       make
     popd
 
+    mkdir -p bin
     cp rootlesskit/bin/* bin/
   fi
 fi
@@ -0,0 +1,188 @@
+package prototype
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// secretMask replaces secret values in masked output.
+const secretMask = "***"
+
+// secretsTmpfs is where inline secret values are written for buildctl to
+// read, so that they never reach a persistent disk. Falls back to the temp
+// dir where it does not exist.
+const secretsTmpfs = "/dev/shm"
+
+// secretSources are the secrets passed to buildctl other than as configured
+// files: environment variables, which buildctl reads from the environment it
+// inherits, and inline values, which are written to files readable only by
+// this user for the duration of the build.
+type secretSources struct {
+	args   []string
+	values []string
+
+	dir string
+}
+
+// resolveSecrets determines the buildctl flags for secrets sourced from
+// environment variables and inline values, along with the secret values that
+// should be masked in the build output. Close removes the inline values'
+// files.
+func resolveSecrets(envs map[string]string, values map[string]string) (*secretSources, error) {
+	sources := &secretSources{}
+
+	for _, id := range sortedKeys(envs) {
+		name := envs[id]
+
+		value, found := os.LookupEnv(name)
+		if !found {
+			return nil, fmt.Errorf("secret %s: environment variable %s is not set", id, name)
+		}
+
+		sources.args = append(sources.args, "--secret", "id="+id+",env="+name)
+		sources.values = append(sources.values, value)
+	}
+
+	if len(values) == 0 {
+		return sources, nil
+	}
+
+	parent := secretsTmpfs
+	if !dirExists(parent) {
+		parent = os.TempDir()
+	}
+
+	// created with mode 0700
+	dir, err := ioutil.TempDir(parent, "oci-image-secrets")
+	if err != nil {
+		return nil, fmt.Errorf("create secrets dir: %w", err)
+	}
+
+	sources.dir = dir
+
+	for i, id := range sortedKeys(values) {
+		path := filepath.Join(dir, strconv.Itoa(i))
+
+		err := ioutil.WriteFile(path, []byte(values[id]), 0600)
+		if err != nil {
+			sources.Close()
+			return nil, fmt.Errorf("secret %s: %w", id, err)
+		}
+
+		sources.args = append(sources.args, "--secret", "id="+id+",src="+path)
+		sources.values = append(sources.values, values[id])
+	}
+
+	return sources, nil
+}
+
+// Close removes the files holding inline secret values.
+func (sources *secretSources) Close() error {
+	if sources.dir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(sources.dir)
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// SecretMasker is a writer which replaces any occurrence of the given secrets
+// with '***' before writing to the underlying writer.
+//
+// Output is buffered a line at a time so that a secret split across writes is
+// still masked; Close flushes any incomplete final line.
+type SecretMasker struct {
+	dest     io.Writer
+	replacer *strings.Replacer
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// NewSecretMasker returns a SecretMasker writing to dest. Empty secrets are
+// ignored. Each line of a multi-line secret (e.g. a PEM key) is masked on its
+// own, as output is masked a line at a time.
+func NewSecretMasker(dest io.Writer, secrets []string) *SecretMasker {
+	var masked []string
+	for _, secret := range secrets {
+		for _, line := range strings.Split(secret, "\n") {
+			line = strings.TrimRight(line, "\r")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+
+			masked = append(masked, line)
+		}
+	}
+
+	// replace longer secrets first, in case one secret contains another
+	sort.Slice(masked, func(i, j int) bool {
+		return len(masked[i]) > len(masked[j])
+	})
+
+	var oldnew []string
+	for _, secret := range masked {
+		oldnew = append(oldnew, secret, secretMask)
+	}
+
+	return &SecretMasker{
+		dest:     dest,
+		replacer: strings.NewReplacer(oldnew...),
+	}
+}
+
+func (masker *SecretMasker) Write(p []byte) (int, error) {
+	masker.mu.Lock()
+	defer masker.mu.Unlock()
+
+	masker.buf.Write(p)
+
+	for {
+		i := bytes.IndexByte(masker.buf.Bytes(), '\n')
+		if i == -1 {
+			break
+		}
+
+		line := masker.buf.Next(i + 1)
+
+		_, err := io.WriteString(masker.dest, masker.replacer.Replace(string(line)))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close writes out any remaining buffered output.
+func (masker *SecretMasker) Close() error {
+	masker.mu.Lock()
+	defer masker.mu.Unlock()
+
+	if masker.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(masker.dest, masker.replacer.Replace(masker.buf.String()))
+	masker.buf.Reset()
+
+	return err
+}
@@ -0,0 +1,325 @@
+package prototype
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureFile is the file next to image.tar which the base64 encoded
+	// signature is written to, as by 'cosign sign --output-signature'.
+	SignatureFile = "signature"
+
+	// SignaturePayloadFile is the file next to image.tar which the signed
+	// payload is written to, as by 'cosign sign --output-payload'.
+	SignaturePayloadFile = "signature-payload.json"
+)
+
+const (
+	simpleSigningMediaType = types.MediaType("application/vnd.dev.cosign.simplesigning.v1+json")
+	signatureAnnotation    = "dev.cosignproject.cosign/signature"
+	signatureAttachment    = "sig"
+	cosignSignatureType    = "cosign container image signature"
+)
+
+// SimpleSigning is the payload that cosign signs for an image: a 'simple
+// signing' document identifying the image by its repository and manifest
+// digest.
+type SimpleSigning struct {
+	Critical SimpleSigningCritical `json:"critical"`
+	Optional map[string]string     `json:"optional"`
+}
+
+type SimpleSigningCritical struct {
+	Identity SimpleSigningIdentity `json:"identity"`
+	Image    SimpleSigningImage    `json:"image"`
+	Type     string                `json:"type"`
+}
+
+type SimpleSigningIdentity struct {
+	DockerReference string `json:"docker-reference"`
+}
+
+type SimpleSigningImage struct {
+	DockerManifestDigest string `json:"docker-manifest-digest"`
+}
+
+// SignaturePayload returns the payload to sign for the image with the given
+// manifest digest, identified as being in the repository.
+func SignaturePayload(repository string, digest v1.Hash) ([]byte, error) {
+	return json.Marshal(SimpleSigning{
+		Critical: SimpleSigningCritical{
+			Identity: SimpleSigningIdentity{DockerReference: repository},
+			Image:    SimpleSigningImage{DockerManifestDigest: digest.String()},
+			Type:     cosignSignatureType,
+		},
+	})
+}
+
+// ParseSigningKey parses a PEM encoded, unencrypted ECDSA or ed25519 private
+// key, in PKCS #8 or (for ECDSA) SEC 1 form. cosign's encrypted key format is
+// not supported; 'openssl pkcs8' can convert keys to PKCS #8.
+func ParseSigningKey(pemBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// ParsePublicKey parses a PEM encoded ECDSA or ed25519 public key, e.g. as
+// written by 'cosign generate-key-pair'.
+func ParsePublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// SignPayload signs the payload as cosign does: ECDSA keys sign its SHA-256
+// digest, and ed25519 keys sign the payload itself.
+func SignPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(payload)
+
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// VerifyPayload checks a signature made by SignPayload.
+func VerifyPayload(key crypto.PublicKey, payload []byte, signature []byte) error {
+	var valid bool
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, payload, signature)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		valid = ecdsa.VerifyASN1(key, digest[:], signature)
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	if !valid {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// VerifyImage checks that the base64 encoded signature is valid for the
+// payload, and that the payload is for the image's manifest digest.
+func VerifyImage(key crypto.PublicKey, image v1.Image, payload []byte, signature string) error {
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace([]byte(signature))))
+	if err != nil {
+		return errors.Wrap(err, "decode signature")
+	}
+
+	err = VerifyPayload(key, payload, decoded)
+	if err != nil {
+		return err
+	}
+
+	var signed SimpleSigning
+	err = json.Unmarshal(payload, &signed)
+	if err != nil {
+		return errors.Wrap(err, "decode payload")
+	}
+
+	if signed.Critical.Type != cosignSignatureType {
+		return fmt.Errorf("unknown signature type %q", signed.Critical.Type)
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		return errors.Wrap(err, "get manifest digest")
+	}
+
+	if signed.Critical.Image.DockerManifestDigest != digest.String() {
+		return fmt.Errorf("signature is for %s, not %s", signed.Critical.Image.DockerManifestDigest, digest)
+	}
+
+	return nil
+}
+
+// VerifyImageArgs checks each image tarball against the signature and
+// payload files next to it (i.e. as written to a build's output) before they
+// are served to the build.
+func VerifyImageArgs(imagePaths map[string]string, publicKeyPath string) error {
+	pemBytes, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		return errors.Wrap(err, "read public key")
+	}
+
+	key, err := ParsePublicKey(pemBytes)
+	if err != nil {
+		return errors.Wrap(err, "parse public key")
+	}
+
+	for _, arg := range sortedKeys(imagePaths) {
+		path := imagePaths[arg]
+
+		err := verifyImageTarball(key, path)
+		if err != nil {
+			return errors.Wrapf(err, "verify image arg %s (%s)", arg, path)
+		}
+
+		logrus.Debugf("verified signature of image arg %s", arg)
+	}
+
+	return nil
+}
+
+func verifyImageTarball(key crypto.PublicKey, path string) error {
+	image, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+
+	signature, err := ioutil.ReadFile(filepath.Join(dir, SignatureFile))
+	if err != nil {
+		return err
+	}
+
+	payload, err := ioutil.ReadFile(filepath.Join(dir, SignaturePayloadFile))
+	if err != nil {
+		return err
+	}
+
+	return VerifyImage(key, image, payload, string(signature))
+}
+
+// readSigningKey reads the signing key from a file or an environment
+// variable, or returns nil if neither is configured.
+func readSigningKey(img OCIImage) (crypto.Signer, error) {
+	var pemBytes []byte
+	switch {
+	case img.SigningKey != "":
+		var err error
+		pemBytes, err = ioutil.ReadFile(img.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+	case img.SigningKeyEnv != "":
+		pemBytes = []byte(os.Getenv(img.SigningKeyEnv))
+	default:
+		return nil, nil
+	}
+
+	return ParseSigningKey(pemBytes)
+}
+
+// signImage writes the signature and payload for the image to outputDir,
+// and pushes them to the repository if one is configured. Without a
+// repository, the image is identified by the output's name.
+func signImage(outputDir string, image v1.Image, key crypto.Signer, output string, repository string) error {
+	digest, err := image.Digest()
+	if err != nil {
+		return errors.Wrap(err, "get manifest digest")
+	}
+
+	reference := output
+	if repository != "" {
+		repo, err := name.NewRepository(repository)
+		if err != nil {
+			return err
+		}
+
+		reference = repo.Name()
+	}
+
+	payload, err := SignaturePayload(reference, digest)
+	if err != nil {
+		return err
+	}
+
+	signature, err := SignPayload(key, payload)
+	if err != nil {
+		return errors.Wrap(err, "sign")
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(signature)
+
+	err = ioutil.WriteFile(filepath.Join(outputDir, SignatureFile), []byte(encoded), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(outputDir, SignaturePayloadFile), payload, 0644)
+	if err != nil {
+		return err
+	}
+
+	if repository == "" {
+		return nil
+	}
+
+	ref, err := AttachArtifact(repository, digest, signatureAttachment, Artifact{
+		MediaType: simpleSigningMediaType,
+		Payload:   payload,
+		Annotations: map[string]string{
+			signatureAnnotation: encoded,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "push signature")
+	}
+
+	logrus.Infof("pushed signature as %s", ref)
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package prototype_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type SigningSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *SigningSuite) TestSignaturePayload() {
+	digest := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("ab", 32)}
+
+	payload, err := prototype.SignaturePayload("registry.example.com/some-image", digest)
+	s.NoError(err)
+
+	// the same form cosign signs
+	s.JSONEq(`{
+		"critical": {
+			"identity": {"docker-reference": "registry.example.com/some-image"},
+			"image": {"docker-manifest-digest": "sha256:`+digest.Hex+`"},
+			"type": "cosign container image signature"
+		},
+		"optional": null
+	}`, string(payload))
+}
+
+func (s *SigningSuite) TestSignAndVerify() {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.NoError(err)
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	s.NoError(err)
+
+	ecDER, err := x509.MarshalECPrivateKey(ecdsaKey)
+	s.NoError(err)
+
+	for desc, keyPEM := range map[string][]byte{
+		"ecdsa (pkcs8)":   s.privateKeyPEM(ecdsaKey),
+		"ecdsa (sec1)":    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}),
+		"ed25519 (pkcs8)": s.privateKeyPEM(ed25519Key),
+	} {
+		key, err := prototype.ParseSigningKey(keyPEM)
+		s.NoError(err, desc)
+
+		public, err := prototype.ParsePublicKey(s.publicKeyPEM(key.Public()))
+		s.NoError(err, desc)
+
+		image, err := random.Image(1024, 1)
+		s.NoError(err)
+
+		digest, err := image.Digest()
+		s.NoError(err)
+
+		payload, err := prototype.SignaturePayload("some-output", digest)
+		s.NoError(err)
+
+		signature, err := prototype.SignPayload(key, payload)
+		s.NoError(err, desc)
+
+		encoded := base64.StdEncoding.EncodeToString(signature)
+
+		err = prototype.VerifyImage(public, image, payload, encoded)
+		s.NoError(err, desc)
+
+		tampered := append([]byte{}, payload...)
+		tampered[len(tampered)-2] = ' '
+		err = prototype.VerifyImage(public, image, tampered, encoded)
+		s.EqualError(err, "invalid signature", desc)
+
+		otherImage, err := random.Image(1024, 1)
+		s.NoError(err)
+
+		otherDigest, err := otherImage.Digest()
+		s.NoError(err)
+
+		err = prototype.VerifyImage(public, otherImage, payload, encoded)
+		s.EqualError(err, "signature is for "+digest.String()+", not "+otherDigest.String(), desc)
+	}
+}
+
+func (s *SigningSuite) TestParseSigningKeyUnsupported() {
+	_, err := prototype.ParseSigningKey([]byte("not a key"))
+	s.EqualError(err, "no PEM block found")
+
+	_, err = prototype.ParseSigningKey(pem.EncodeToMemory(&pem.Block{
+		Type:  "ENCRYPTED COSIGN PRIVATE KEY",
+		Bytes: []byte("encrypted"),
+	}))
+	s.EqualError(err, `unsupported PEM block type "ENCRYPTED COSIGN PRIVATE KEY"`)
+}
+
+func (s *SigningSuite) TestVerifyImageArgs() {
+	dir, err := ioutil.TempDir("", "verify-image-args")
+	s.NoError(err)
+
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.NoError(err)
+
+	publicKeyPath := filepath.Join(dir, "cosign.pub")
+	s.NoError(ioutil.WriteFile(publicKeyPath, s.publicKeyPEM(key.Public()), 0644))
+
+	signedPath := s.writeImage(filepath.Join(dir, "signed"))
+
+	signed, err := tarball.ImageFromPath(signedPath, nil)
+	s.NoError(err)
+
+	digest, err := signed.Digest()
+	s.NoError(err)
+
+	payload, err := prototype.SignaturePayload("signed", digest)
+	s.NoError(err)
+
+	signature, err := prototype.SignPayload(key, payload)
+	s.NoError(err)
+
+	s.NoError(ioutil.WriteFile(filepath.Join(dir, "signed", prototype.SignaturePayloadFile), payload, 0644))
+	s.NoError(ioutil.WriteFile(filepath.Join(dir, "signed", prototype.SignatureFile), []byte(base64.StdEncoding.EncodeToString(signature)), 0644))
+
+	err = prototype.VerifyImageArgs(map[string]string{"base_image": signedPath}, publicKeyPath)
+	s.NoError(err)
+
+	unsignedPath := s.writeImage(filepath.Join(dir, "unsigned"))
+
+	err = prototype.VerifyImageArgs(map[string]string{
+		"base_image":  signedPath,
+		"other_image": unsignedPath,
+	}, publicKeyPath)
+	s.Error(err)
+	s.Contains(err.Error(), "verify image arg other_image ("+unsignedPath+"): open ")
+}
+
+func (s *SigningSuite) writeImage(dir string) string {
+	s.NoError(os.MkdirAll(dir, 0755))
+
+	image, err := random.Image(1024, 1)
+	s.NoError(err)
+
+	path := filepath.Join(dir, "image.tar")
+	s.NoError(tarball.WriteToFile(path, nil, image))
+
+	return path
+}
+
+func (s *SigningSuite) privateKeyPEM(key crypto.PrivateKey) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	s.NoError(err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func (s *SigningSuite) publicKeyPEM(key crypto.PublicKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	s.NoError(err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestSigning(t *testing.T) {
+	suite.Run(t, &SigningSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -0,0 +1,114 @@
+package prototype
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgents are in-process SSH agents, one per SSH ID, which are forwarded
+// to RUN --mount=type=ssh by buildctl.
+type sshAgents struct {
+	dir       string
+	sockets   map[string]string
+	listeners []net.Listener
+}
+
+// startSSHAgents starts an agent for each SSH ID, holding the private keys
+// read from the given paths.
+func startSSHAgents(keyPaths map[string][]string) (*sshAgents, error) {
+	dir, err := ioutil.TempDir("", "ssh-agents")
+	if err != nil {
+		return nil, err
+	}
+
+	agents := &sshAgents{
+		dir:     dir,
+		sockets: map[string]string{},
+	}
+
+	for _, id := range sortedSSHKeys(keyPaths) {
+		keyring := agent.NewKeyring()
+
+		for _, path := range keyPaths[id] {
+			keyBytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				agents.Close()
+				return nil, fmt.Errorf("read ssh key: %w", err)
+			}
+
+			key, err := ssh.ParseRawPrivateKey(keyBytes)
+			if err != nil {
+				agents.Close()
+				return nil, fmt.Errorf("parse ssh key %s: %w", path, err)
+			}
+
+			err = keyring.Add(agent.AddedKey{
+				PrivateKey: key,
+				Comment:    path,
+			})
+			if err != nil {
+				agents.Close()
+				return nil, fmt.Errorf("add ssh key %s: %w", path, err)
+			}
+		}
+
+		socket := filepath.Join(dir, fmt.Sprintf("agent-%d.sock", len(agents.sockets)))
+
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			agents.Close()
+			return nil, fmt.Errorf("listen: %w", err)
+		}
+
+		go serveSSHAgent(listener, keyring)
+
+		agents.sockets[id] = socket
+		agents.listeners = append(agents.listeners, listener)
+	}
+
+	return agents, nil
+}
+
+// BuildctlArgs returns the --ssh flags for forwarding each agent.
+func (agents *sshAgents) BuildctlArgs() []string {
+	var args []string
+	for _, id := range sortedKeys(agents.sockets) {
+		args = append(args, "--ssh", id+"="+agents.sockets[id])
+	}
+
+	return args
+}
+
+func (agents *sshAgents) Close() error {
+	for _, listener := range agents.listeners {
+		listener.Close()
+	}
+
+	return os.RemoveAll(agents.dir)
+}
+
+func serveSSHAgent(listener net.Listener, keyring agent.Agent) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			err := agent.ServeAgent(keyring, conn)
+			if err != nil && err != io.EOF {
+				logrus.Debugf("ssh agent: %s", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,223 @@
+package prototype
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// BuildStats summarizes a single target's build, as observed through the
+// solve status events reported by BuildKit.
+type BuildStats struct {
+	Target string `json:"target"`
+
+	// Wall time of the whole build, including exporting, in seconds.
+	Duration float64 `json:"duration"`
+
+	CachedSteps   int   `json:"cached_steps"`
+	ExecutedSteps int   `json:"executed_steps"`
+	BytesPulled   int64 `json:"bytes_pulled"`
+
+	Steps []StepStats `json:"steps"`
+}
+
+// StepStats describes a single Dockerfile instruction.
+type StepStats struct {
+	Name   string `json:"name"`
+	Cached bool   `json:"cached"`
+
+	// Wall time of the step in seconds; zero for cached steps.
+	Duration float64 `json:"duration"`
+
+	// When the step completed, if it did.
+	Completed *time.Time `json:"completed,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// solveStatus mirrors the JSON encoding of BuildKit's client.SolveStatus, as
+// written by 'buildctl build --trace'.
+type solveStatus struct {
+	Vertexes []struct {
+		Digest    string
+		Name      string
+		Started   *time.Time
+		Completed *time.Time
+		Cached    bool
+		Error     string
+	}
+
+	Statuses []struct {
+		ID     string
+		Vertex string
+		Total  int64
+	}
+}
+
+type layerStatus struct {
+	vertex string
+	id     string
+}
+
+// CacheHitRatio is the fraction of steps that were cached.
+func (stats BuildStats) CacheHitRatio() float64 {
+	total := stats.CachedSteps + stats.ExecutedSteps
+	if total == 0 {
+		return 0
+	}
+
+	return float64(stats.CachedSteps) / float64(total)
+}
+
+// ParseBuildStats reads the stream of solve statuses written by buildctl's
+// --trace flag.
+//
+// Only vertexes corresponding to Dockerfile instructions (e.g. "[stage 1/2]
+// RUN ...") are counted as steps; bytes pulled are counted from the layer
+// downloads of FROM instructions.
+func ParseBuildStats(target string, trace io.Reader) (BuildStats, error) {
+	stats := BuildStats{Target: target}
+
+	var order []string
+	steps := map[string]StepStats{}
+	fromVertexes := map[string]bool{}
+	layerSizes := map[layerStatus]int64{}
+
+	decoder := json.NewDecoder(trace)
+	for {
+		var status solveStatus
+		err := decoder.Decode(&status)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return BuildStats{}, fmt.Errorf("decode solve status: %w", err)
+		}
+
+		for _, vertex := range status.Vertexes {
+			if !isInstruction(vertex.Name) {
+				continue
+			}
+
+			if strings.Contains(vertex.Name, "] FROM ") {
+				fromVertexes[vertex.Digest] = true
+			}
+
+			if _, seen := steps[vertex.Digest]; !seen {
+				order = append(order, vertex.Digest)
+			}
+
+			step := StepStats{
+				Name:      vertex.Name,
+				Cached:    vertex.Cached,
+				Completed: vertex.Completed,
+				Error:     vertex.Error,
+			}
+
+			if !vertex.Cached && vertex.Started != nil && vertex.Completed != nil {
+				step.Duration = vertex.Completed.Sub(*vertex.Started).Seconds()
+			}
+
+			steps[vertex.Digest] = step
+		}
+
+		for _, vertexStatus := range status.Statuses {
+			if strings.HasPrefix(vertexStatus.ID, "sha256:") {
+				layerSizes[layerStatus{vertexStatus.Vertex, vertexStatus.ID}] = vertexStatus.Total
+			}
+		}
+	}
+
+	for layer, size := range layerSizes {
+		if fromVertexes[layer.vertex] {
+			stats.BytesPulled += size
+		}
+	}
+
+	for _, digest := range order {
+		step := steps[digest]
+		if step.Cached {
+			stats.CachedSteps++
+		} else {
+			stats.ExecutedSteps++
+		}
+
+		stats.Steps = append(stats.Steps, step)
+	}
+
+	return stats, nil
+}
+
+func readBuildStats(target string, tracePath string) (BuildStats, error) {
+	trace, err := os.Open(tracePath)
+	if err != nil {
+		return BuildStats{}, err
+	}
+
+	defer trace.Close()
+
+	return ParseBuildStats(target, trace)
+}
+
+func isInstruction(name string) bool {
+	return strings.HasPrefix(name, "[") && !strings.HasPrefix(name, "[internal]")
+}
+
+func writeBuildStats(path string, stats BuildStats) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+
+	err = encoder.Encode(stats)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func printBuildStats(out io.Writer, stats BuildStats) {
+	fmt.Fprintf(out, "%s: %d/%d steps cached (%.0f%%), %s pulled, %.1fs\n",
+		stats.Target,
+		stats.CachedSteps,
+		stats.CachedSteps+stats.ExecutedSteps,
+		stats.CacheHitRatio()*100,
+		formatBytes(stats.BytesPulled),
+		stats.Duration,
+	)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tCACHED\tTIME")
+
+	for _, step := range stats.Steps {
+		cached := "no"
+		if step.Cached {
+			cached = "yes"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%.1fs\n", limitString(step.Name, 60), cached, step.Duration)
+	}
+
+	w.Flush()
+}
+
+// limitString truncates s to limit characters, counting runes so that a
+// multi-byte character is never split.
+func limitString(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+
+	return string(runes[:limit-3]) + "..."
+}
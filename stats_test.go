@@ -0,0 +1,67 @@
+package prototype_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type StatsSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *StatsSuite) TestParseBuildStats() {
+	trace, err := os.Open("testdata/build-stats/trace.json")
+	s.NoError(err)
+
+	defer trace.Close()
+
+	stats, err := prototype.ParseBuildStats("some-target", trace)
+	s.NoError(err)
+
+	s.Equal(prototype.BuildStats{
+		Target:        "some-target",
+		CachedSteps:   1,
+		ExecutedSteps: 2,
+		BytesPulled:   1024,
+		Steps: []prototype.StepStats{
+			{Name: "[1/3] FROM docker.io/library/busybox@sha256:abcd", Duration: 2, Completed: timestamp("2021-01-01T00:00:03Z")},
+			{Name: "[2/3] COPY Dockerfile /", Cached: true, Completed: timestamp("2021-01-01T00:00:03Z")},
+			{Name: "[3/3] RUN make", Duration: 2.5, Completed: timestamp("2021-01-01T00:00:05.5Z")},
+		},
+	}, stats)
+
+	s.InDelta(1.0/3.0, stats.CacheHitRatio(), 0.001)
+}
+
+func (s *StatsSuite) TestParseBuildStatsEmpty() {
+	trace, err := os.Open(os.DevNull)
+	s.NoError(err)
+
+	defer trace.Close()
+
+	stats, err := prototype.ParseBuildStats("", trace)
+	s.NoError(err)
+	s.Zero(stats.CacheHitRatio())
+}
+
+func timestamp(value string) *time.Time {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		panic(err)
+	}
+
+	return &t
+}
+
+func TestStats(t *testing.T) {
+	suite.Run(t, &StatsSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -0,0 +1,40 @@
+// A minimal, statically linkable stand-in for 'ssh-add -l', for asserting
+// that an SSH agent has been forwarded into a build.
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func main() {
+	if len(os.Args) != 2 || os.Args[1] != "-l" {
+		fmt.Fprintln(os.Stderr, "usage: ssh-add -l")
+		os.Exit(2)
+	}
+
+	conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not open a connection to your authentication agent.")
+		os.Exit(2)
+	}
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error fetching identities:", err)
+		os.Exit(1)
+	}
+
+	if len(keys) == 0 {
+		fmt.Println("The agent has no identities.")
+		os.Exit(1)
+	}
+
+	for _, key := range keys {
+		fmt.Printf("%s %s (%s)\n", ssh.FingerprintSHA256(key), key.Comment, key.Type())
+	}
+}
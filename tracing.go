@@ -0,0 +1,508 @@
+package prototype
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceFile is the file in the output which spans are written to.
+const TraceFile = "trace.json"
+
+const (
+	traceServiceName = "oci-image-prototype"
+	traceScopeName   = "github.com/aoldershaw/oci-image-prototype"
+)
+
+// Tracer records the spans of a single trace with the OpenTelemetry SDK, to
+// be written as OTLP JSON and exported over OTLP/HTTP once the task is done.
+// A nil Tracer records nothing.
+//
+// BuildKit v0.8 only reports its own spans to Jaeger, so its steps are
+// recorded from the solve status written by 'buildctl --trace' instead.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+	spans    *spanCollector
+
+	root *Span
+}
+
+// Span is a timed operation within a trace. A nil Span ignores everything.
+type Span struct {
+	span trace.Span
+
+	// when the span ended, for a span which has already happened
+	end time.Time
+}
+
+// spanCollector keeps every span from when it starts, so that the trace can
+// be written at any point, including spans which are still running.
+type spanCollector struct {
+	lock  sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (collector *spanCollector) OnStart(_ context.Context, span sdktrace.ReadWriteSpan) {
+	collector.lock.Lock()
+	collector.spans = append(collector.spans, span)
+	collector.lock.Unlock()
+}
+
+func (collector *spanCollector) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (collector *spanCollector) Shutdown(context.Context) error   { return nil }
+func (collector *spanCollector) ForceFlush(context.Context) error { return nil }
+
+func (collector *spanCollector) snapshot() []sdktrace.ReadOnlySpan {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	return append([]sdktrace.ReadOnlySpan{}, collector.spans...)
+}
+
+// NewTracer starts a trace whose root span has the given name.
+func NewTracer(name string) *Tracer {
+	collector := &spanCollector{}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", traceServiceName))),
+		sdktrace.WithSpanProcessor(collector),
+	)
+
+	tracer := &Tracer{
+		provider: provider,
+		tracer:   provider.Tracer(traceScopeName),
+		spans:    collector,
+	}
+
+	tracer.root = tracer.Start(name, nil)
+
+	return tracer
+}
+
+// Root returns the span every other span descends from.
+func (tracer *Tracer) Root() *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	return tracer.root
+}
+
+// Start starts a span under parent, or under the root span if parent is
+// nil.
+func (tracer *Tracer) Start(name string, parent *Span) *Span {
+	return tracer.Record(name, parent, time.Now(), time.Time{})
+}
+
+// Record records a span which has already happened, e.g. a step reported by
+// BuildKit. It is ended at the given end time by End, so its attributes must
+// be set before then. An end time of zero records a running span as Start
+// does.
+func (tracer *Tracer) Record(name string, parent *Span, start time.Time, end time.Time) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	if parent == nil {
+		parent = tracer.root
+	}
+
+	ctx := context.Background()
+	if parent != nil {
+		ctx = trace.ContextWithSpan(ctx, parent.span)
+	}
+
+	_, span := tracer.tracer.Start(ctx, name, trace.WithTimestamp(start))
+
+	return &Span{span: span, end: end}
+}
+
+// SetAttribute sets an attribute of the span. The value must be a string,
+// bool, int, int64 or float64.
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+
+	var attr attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		attr = attribute.String(key, v)
+	case bool:
+		attr = attribute.Bool(key, v)
+	case int:
+		attr = attribute.Int(key, v)
+	case int64:
+		attr = attribute.Int64(key, v)
+	case float64:
+		attr = attribute.Float64(key, v)
+	default:
+		attr = attribute.String(key, fmt.Sprint(v))
+	}
+
+	span.span.SetAttributes(attr)
+}
+
+// SetError marks the span as failed, if err is non-nil.
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+
+	span.span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the span, at its recorded end time if it has one.
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+
+	if !span.end.IsZero() {
+		span.span.End(trace.WithTimestamp(span.end))
+		return
+	}
+
+	span.span.End()
+}
+
+// WriteOTLP writes every span as an OTLP JSON ExportTraceServiceRequest.
+// Spans which are still running are written as ending now.
+func (tracer *Tracer) WriteOTLP(w io.Writer) error {
+	if tracer == nil {
+		return nil
+	}
+
+	var spans []otlpSpan
+	for _, span := range tracer.spans.snapshot() {
+		spans = append(spans, otlpFromSpan(span))
+	}
+
+	return json.NewEncoder(w).Encode(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpAttribute{otlpAttr(attribute.String("service.name", traceServiceName))},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: traceScopeName},
+						Spans: spans,
+					},
+				},
+			},
+		},
+	})
+}
+
+// Export sends every span which has ended to an OTLP/HTTP endpoint, e.g.
+// 'http://collector:4318', with the SDK's OTLP exporter.
+func (tracer *Tracer) Export(endpoint string) error {
+	if tracer == nil {
+		return nil
+	}
+
+	endpointURL, err := url.Parse(traceEndpointURL(endpoint))
+	if err != nil {
+		return err
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpointURL.Host),
+		otlptracehttp.WithURLPath(endpointURL.Path),
+		otlptracehttp.WithTimeout(10 * time.Second),
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{Enabled: false}),
+	}
+
+	if endpointURL.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	ctx := context.Background()
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	var ended []sdktrace.ReadOnlySpan
+	for _, span := range tracer.spans.snapshot() {
+		if !span.EndTime().IsZero() {
+			ended = append(ended, span)
+		}
+	}
+
+	err = exporter.ExportSpans(ctx, ended)
+	if err != nil {
+		exporter.Shutdown(ctx)
+		return err
+	}
+
+	return exporter.Shutdown(ctx)
+}
+
+// traceEndpointURL is the URL that traces are posted to for an OTLP/HTTP
+// endpoint.
+func traceEndpointURL(endpoint string) string {
+	if strings.HasSuffix(endpoint, "/v1/traces") {
+		return endpoint
+	}
+
+	return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+}
+
+// startTrace starts tracing the task if configured to.
+func startTrace(img OCIImage) *Tracer {
+	if !img.Trace && img.TraceEndpoint == "" {
+		return nil
+	}
+
+	tracer := NewTracer("oci-image build")
+	tracer.Root().SetAttribute("context", img.ContextDir)
+	tracer.Root().SetAttribute("target", img.Target)
+
+	return tracer
+}
+
+// finishTrace ends the trace with the task's error and exports it to
+// TraceFile in outputDir and to the configured endpoint. Failing to export
+// is only warned about.
+func finishTrace(tracer *Tracer, img OCIImage, outputDir string, taskErr error) {
+	if tracer == nil {
+		return
+	}
+
+	tracer.Root().SetError(taskErr)
+	tracer.Root().End()
+
+	err := writeTraceFile(tracer, filepath.Join(outputDir, TraceFile))
+	if err != nil {
+		logrus.Warn("failed to write trace:", err)
+	}
+
+	if img.TraceEndpoint != "" {
+		err := tracer.Export(img.TraceEndpoint)
+		if err != nil {
+			logrus.Warn("failed to export trace:", err)
+		}
+	}
+}
+
+func writeTraceFile(tracer *Tracer, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = tracer.WriteOTLP(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// recordSolveSpans records a span under parent for each vertex BuildKit
+// reported in the solve status written by 'buildctl --trace', e.g. each
+// Dockerfile instruction and exporting the image and cache.
+func recordSolveSpans(tracer *Tracer, parent *Span, tracePath string) error {
+	if tracer == nil {
+		return nil
+	}
+
+	trace, err := os.Open(tracePath)
+	if err != nil {
+		return err
+	}
+
+	defer trace.Close()
+
+	type vertex struct {
+		name      string
+		started   *time.Time
+		completed *time.Time
+		cached    bool
+		err       string
+	}
+
+	var order []string
+	vertexes := map[string]vertex{}
+
+	decoder := json.NewDecoder(trace)
+	for {
+		var status solveStatus
+		err := decoder.Decode(&status)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "decode solve status")
+		}
+
+		for _, v := range status.Vertexes {
+			if _, seen := vertexes[v.Digest]; !seen {
+				order = append(order, v.Digest)
+			}
+
+			vertexes[v.Digest] = vertex{
+				name:      v.Name,
+				started:   v.Started,
+				completed: v.Completed,
+				cached:    v.Cached,
+				err:       v.Error,
+			}
+		}
+	}
+
+	for _, digest := range order {
+		v := vertexes[digest]
+		if v.started == nil || v.completed == nil {
+			continue
+		}
+
+		span := tracer.Record(v.name, parent, *v.started, *v.completed)
+		span.SetAttribute("buildkit.vertex", digest)
+		span.SetAttribute("buildkit.cached", v.cached)
+
+		if v.err != "" {
+			span.SetError(errors.New(v.err))
+		}
+
+		span.End()
+	}
+
+	return nil
+}
+
+// The JSON encoding of OTLP's ExportTraceServiceRequest. See
+// https://github.com/open-telemetry/opentelemetry-proto.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeError  = 2
+)
+
+// otlpFromSpan encodes a span recorded by the SDK.
+func otlpFromSpan(span sdktrace.ReadOnlySpan) otlpSpan {
+	end := span.EndTime()
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	encoded := otlpSpan{
+		TraceID:           span.SpanContext().TraceID().String(),
+		SpanID:            span.SpanContext().SpanID().String(),
+		Name:              span.Name(),
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime().UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+
+	if span.Parent().IsValid() {
+		encoded.ParentSpanID = span.Parent().SpanID().String()
+	}
+
+	for _, attr := range span.Attributes() {
+		encoded.Attributes = append(encoded.Attributes, otlpAttr(attr))
+	}
+
+	if span.Status().Code == codes.Error {
+		encoded.Status = otlpStatus{
+			Code:    otlpStatusCodeError,
+			Message: span.Status().Description,
+		}
+	}
+
+	return encoded
+}
+
+func otlpAttr(attr attribute.KeyValue) otlpAttribute {
+	var encoded otlpValue
+
+	switch attr.Value.Type() {
+	case attribute.BOOL:
+		v := attr.Value.AsBool()
+		encoded.BoolValue = &v
+	case attribute.INT64:
+		i := strconv.FormatInt(attr.Value.AsInt64(), 10)
+		encoded.IntValue = &i
+	case attribute.FLOAT64:
+		v := attr.Value.AsFloat64()
+		encoded.DoubleValue = &v
+	default:
+		v := attr.Value.Emit()
+		encoded.StringValue = &v
+	}
+
+	return otlpAttribute{Key: string(attr.Key), Value: encoded}
+}
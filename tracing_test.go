@@ -0,0 +1,189 @@
+package prototype_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type TracingSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+// exportedTrace is the subset of an OTLP JSON ExportTraceServiceRequest
+// that is checked.
+type exportedTrace struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []exportedAttribute
+		}
+
+		ScopeSpans []struct {
+			Spans []exportedSpan
+		}
+	}
+}
+
+type exportedSpan struct {
+	TraceID           string
+	SpanID            string
+	ParentSpanID      string
+	Name              string
+	StartTimeUnixNano string
+	EndTimeUnixNano   string
+	Attributes        []exportedAttribute
+	Status            struct {
+		Code    int
+		Message string
+	}
+}
+
+type exportedAttribute struct {
+	Key   string
+	Value map[string]interface{}
+}
+
+func (s *TracingSuite) TestWriteOTLP() {
+	tracer := prototype.NewTracer("some-task")
+
+	span := tracer.Start("some-span", nil)
+	span.SetAttribute("some-string", "some-value")
+	span.SetAttribute("some-int", 42)
+	span.SetAttribute("some-bool", true)
+	span.End()
+
+	child := tracer.Record("some-child", span, time.Unix(1, 0), time.Unix(2, 500))
+	child.SetError(errors.New("some-error"))
+	child.End()
+
+	tracer.Root().End()
+
+	trace := s.writeOTLP(tracer)
+
+	s.Len(trace.ResourceSpans, 1)
+	s.Equal([]exportedAttribute{
+		{Key: "service.name", Value: map[string]interface{}{"stringValue": "oci-image-prototype"}},
+	}, trace.ResourceSpans[0].Resource.Attributes)
+
+	spans := trace.ResourceSpans[0].ScopeSpans[0].Spans
+	s.Len(spans, 3)
+
+	root, parent, child2 := spans[0], spans[1], spans[2]
+
+	s.Equal("some-task", root.Name)
+	s.Empty(root.ParentSpanID)
+
+	s.Equal("some-span", parent.Name)
+	s.Equal(root.SpanID, parent.ParentSpanID)
+	s.Equal([]exportedAttribute{
+		{Key: "some-string", Value: map[string]interface{}{"stringValue": "some-value"}},
+		{Key: "some-int", Value: map[string]interface{}{"intValue": "42"}},
+		{Key: "some-bool", Value: map[string]interface{}{"boolValue": true}},
+	}, parent.Attributes)
+	s.Zero(parent.Status.Code)
+
+	s.Equal("some-child", child2.Name)
+	s.Equal(parent.SpanID, child2.ParentSpanID)
+	s.Equal("1000000000", child2.StartTimeUnixNano)
+	s.Equal("2000000500", child2.EndTimeUnixNano)
+	s.Equal(2, child2.Status.Code)
+	s.Equal("some-error", child2.Status.Message)
+
+	for _, span := range spans {
+		s.Regexp(`^[0-9a-f]{32}$`, span.TraceID)
+		s.Equal(root.TraceID, span.TraceID)
+		s.Regexp(`^[0-9a-f]{16}$`, span.SpanID)
+	}
+}
+
+func (s *TracingSuite) TestNilTracer() {
+	var tracer *prototype.Tracer
+
+	span := tracer.Start("some-span", tracer.Root())
+	s.Nil(span)
+
+	span.SetAttribute("some-key", "some-value")
+	span.SetError(errors.New("some-error"))
+	span.End()
+
+	s.NoError(tracer.WriteOTLP(ioutil.Discard))
+	s.NoError(tracer.Export("http://does-not-exist"))
+}
+
+func (s *TracingSuite) TestExport() {
+	var requests []*http.Request
+	var bodies [][]byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		s.NoError(err)
+
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+	}))
+
+	defer server.Close()
+
+	tracer := prototype.NewTracer("some-task")
+	tracer.Start("still-running", nil)
+	tracer.Root().End()
+
+	err := tracer.Export(server.URL)
+	s.NoError(err)
+
+	s.Len(requests, 1)
+	s.Equal(http.MethodPost, requests[0].Method)
+	s.Equal("/v1/traces", requests[0].URL.Path)
+	s.Equal("application/x-protobuf", requests[0].Header.Get("Content-Type"))
+
+	var trace coltracepb.ExportTraceServiceRequest
+	s.NoError(proto.Unmarshal(bodies[0], &trace))
+
+	spans := trace.ResourceSpans[0].ScopeSpans[0].Spans
+	s.Len(spans, 1)
+	s.Equal("some-task", spans[0].Name)
+}
+
+func (s *TracingSuite) TestExportError() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad trace", http.StatusBadRequest)
+	}))
+
+	defer server.Close()
+
+	tracer := prototype.NewTracer("some-task")
+	tracer.Root().End()
+
+	err := tracer.Export(server.URL + "/v1/traces")
+	s.Error(err)
+	s.Contains(err.Error(), "400 Bad Request")
+}
+
+func (s *TracingSuite) writeOTLP(tracer *prototype.Tracer) exportedTrace {
+	buf := new(bytes.Buffer)
+	s.NoError(tracer.WriteOTLP(buf))
+
+	var trace exportedTrace
+	s.NoError(json.Unmarshal(buf.Bytes(), &trace))
+
+	return trace
+}
+
+func TestTracing(t *testing.T) {
+	suite.Run(t, &TracingSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -4,13 +4,46 @@ package prototype
 type OCIImage struct {
 	Debug bool `json:"debug"`
 
-	ContextDir     string            `json:"context" prototype:"required"`
-	ContextInputs  map[string]string `json:"context_inputs,omitempty"`
-	DockerfilePath string            `json:"dockerfile,omitempty"`
+	// The build context: a directory, or a tarball (.tar, .tar.gz or .tgz)
+	// which is streamed to BuildKit without being extracted.
+	ContextDir    string            `json:"context" prototype:"required"`
+	ContextInputs map[string]string `json:"context_inputs,omitempty"`
+
+	// A git ref to build from. When set, ContextDir must be a git repository,
+	// and only the files committed at the ref are used as the context (i.e.
+	// excluding .git and any uncommitted changes).
+	ContextRef string `json:"context_ref,omitempty"`
+
+	// Path to the Dockerfile. Defaults to the Dockerfile in ContextDir, or
+	// for a tarball or git ref context, the Dockerfile within it.
+	DockerfilePath string `json:"dockerfile,omitempty"`
 
 	Output string `json:"output" prototype:"required"`
 	Cache  bool   `json:"cache,omitempty"`
 
+	// Maximum size (in MB) of the local cache. After each build, blobs that
+	// are no longer referenced are removed from the cache, and if it is still
+	// too large, the least recently exported target caches are removed.
+	CacheMaxSize int64 `json:"cache_max_size,omitempty"`
+
+	// Registry refs to import build cache from, tried in order after the
+	// local cache. An image built with InlineCache may be used as a source.
+	CacheFrom []string `json:"cache_from,omitempty"`
+
+	// Registry ref to export build cache to. BuildKit only supports one cache
+	// export per build, so this takes precedence over InlineCache and the
+	// local cache.
+	CacheTo string `json:"cache_to,omitempty"`
+
+	// Embed build cache metadata in the built image, so that it can be used
+	// in CacheFrom once pushed. Takes precedence over the local cache.
+	InlineCache bool `json:"inline_cache,omitempty"`
+
+	// Which layers to export to the cache: "min" (the default) only exports
+	// the layers of the resulting image, while "max" exports all
+	// intermediate steps too. Not supported with InlineCache.
+	CacheMode string `json:"cache_mode,omitempty"`
+
 	Target            string   `json:"target"`
 	AdditionalTargets []string `json:"additional_targets"`
 
@@ -18,10 +51,40 @@ type OCIImage struct {
 
 	RegistryMirrors []string `json:"registry_mirrors"`
 
+	// Garbage collection settings for buildkitd's state. Without these,
+	// buildkitd's root dir grows without bound when it persists across builds
+	// (i.e. on /scratch).
+	GC *GCConfig `json:"gc,omitempty"`
+
+	// Worker backend, snapshotter and OCI runtime for buildkitd to use. See
+	// BuildkitdOpts.
+	Worker            string `json:"worker,omitempty"`
+	ContainerdAddress string `json:"containerd_address,omitempty"`
+	Snapshotter       string `json:"snapshotter,omitempty"`
+	Runtime           string `json:"runtime,omitempty"`
+
 	Labels []string `json:"labels"`
 
 	BuildkitSecrets map[string]string `json:"buildkit_secrets"`
 
+	// Secrets read from the task's environment, never written to disk.
+	// Mapping from secret ID to environment variable name.
+	BuildkitSecretEnvs map[string]string `json:"buildkit_secret_envs,omitempty"`
+
+	// Secrets given inline. Mapping from secret ID to the secret value.
+	//
+	// For the duration of the build, each value is written to a file
+	// readable only by the build's user on a tmpfs (/dev/shm, where it
+	// exists), from which buildctl serves it.
+	//
+	// The values of both BuildkitSecretEnvs and BuildkitSecretValues are
+	// masked in the build output.
+	BuildkitSecretValues map[string]string `json:"buildkit_secret_values,omitempty"`
+
+	// Private keys to serve from an SSH agent to RUN --mount=type=ssh.
+	// Mapping from SSH ID (e.g. "default") to private key file paths.
+	SSH map[string][]string `json:"ssh,omitempty"`
+
 	// Unpack the OCI image into Concourse's rootfs/ + metadata.json image scheme.
 	//
 	// Theoretically this would go away if/when we standardize on OCI.
@@ -35,6 +98,146 @@ type OCIImage struct {
 	ImageArgs []string `json:"image_args"`
 
 	AddHosts string `json:"add_hosts"`
+
+	// Additional named build contexts, which the Dockerfile can refer to by
+	// name, e.g. 'COPY --from=assets' or 'FROM deps'. Mapping from context
+	// name to a directory, an OCI image tarball (.tar) or a
+	// 'docker-image://' ref.
+	//
+	// Requires a dockerfile frontend that supports named contexts, e.g.
+	// '# syntax=docker/dockerfile:1.4'.
+	BuildContexts map[string]string `json:"build_contexts,omitempty"`
+
+	// Produce an image whose digest only depends on its content. The
+	// SOURCE_DATE_EPOCH build arg is set, and afterwards file timestamps are
+	// clamped to it and the config's creation time and history are set to it.
+	Reproducible bool `json:"reproducible,omitempty"`
+
+	// Write an SPDX SBOM listing the packages in each target's image to
+	// sbom.spdx.json, next to image.tar. Packages are found in dpkg's and
+	// apk's databases, rpm's databases (NDB as used by SUSE, BerkeleyDB as
+	// used by RHEL 8 and older, and SQLite as used by RHEL 9 and Fedora) and
+	// Go binaries' build info.
+	SBOM bool `json:"sbom,omitempty"`
+
+	// Write an in-toto statement of SLSA provenance to provenance.json, next
+	// to image.tar. It records the image's manifest digest, this
+	// configuration (with secret values redacted), the digests of the
+	// context, Dockerfile, context inputs, build contexts and image args, the
+	// base images that were pulled, and when the target was built.
+	Provenance bool `json:"provenance,omitempty"`
+
+	// Also attach the provenance statement to the image as an OCI artifact
+	// in this repository, tagged 'sha256-<digest>.att'. Implies Provenance.
+	ProvenanceRepository string `json:"provenance_repository,omitempty"`
+
+	// Sign each target's manifest digest with this private key, writing a
+	// cosign-compatible signature to 'signature' and the payload it signs to
+	// 'signature-payload.json', next to image.tar. The key must be a PEM
+	// encoded, unencrypted ECDSA or ed25519 key; cosign's encrypted keys are
+	// not supported.
+	SigningKey string `json:"signing_key,omitempty"`
+
+	// As SigningKey, but read from an environment variable, e.g. one set
+	// from a secret. Mutually exclusive with SigningKey.
+	SigningKeyEnv string `json:"signing_key_env,omitempty"`
+
+	// Also push each signature to this repository as cosign does, tagged
+	// 'sha256-<digest>.sig'. The payload then identifies the image as being
+	// in this repository, rather than by the output's name.
+	SignatureRepository string `json:"signature_repository,omitempty"`
+
+	// Verify each of the ImageArgs with this PEM encoded public key before
+	// serving it to the build. Every image tarball must be next to a
+	// signature and payload for its digest, as written by SigningKey.
+	ImageArgsPublicKey string `json:"image_args_public_key,omitempty"`
+
+	// Rules that the Dockerfile's base images and each built image must
+	// follow. See Policy.
+	Policy *Policy `json:"policy,omitempty"`
+
+	// Configures the scan message, which scans the built images for
+	// vulnerabilities. See VulnerabilityScan.
+	Scan *VulnerabilityScan `json:"scan,omitempty"`
+
+	// Seconds since the epoch to use as SOURCE_DATE_EPOCH. Defaults to the
+	// commit time of the context's git HEAD.
+	SourceDateEpoch *int64 `json:"source_date_epoch,omitempty"`
+
+	// Print the build plan instead of building: each target, its frontend
+	// options, cache imports and exports and outputs, along with secrets
+	// (redacted) and image args. buildkitd is not started.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Format of the printed build plan: "text" (the default) or "json".
+	PlanFormat string `json:"plan_format,omitempty"`
+
+	// Write a log of JSON events (buildkitd starting, each target's build and
+	// steps, unpacking and the digest being written), one per line, to
+	// "stderr" or to a file of this name in the output.
+	EventLog string `json:"event_log,omitempty"`
+
+	// Trace the task (spawning buildkitd, each target's build and BuildKit's
+	// steps within it, writing the digest and unpacking) and write the spans
+	// as OTLP JSON to trace.json in the output.
+	Trace bool `json:"trace,omitempty"`
+
+	// OTLP/HTTP endpoint to also export the trace to, e.g.
+	// 'http://collector:4318'. Implies Trace.
+	TraceEndpoint string `json:"trace_endpoint,omitempty"`
+}
+
+// GCConfig configures garbage collection for buildkitd's worker.
+type GCConfig struct {
+	// Amount of storage (in MB) to keep after garbage collection. Defaults to
+	// buildkitd's own default when unset.
+	KeepStorage int64 `json:"keep_storage,omitempty"`
+
+	// Policies to apply in order, replacing buildkitd's default policies.
+	// KeepDuration is in seconds.
+	Policies []GCPolicy `json:"policies,omitempty"`
+}
+
+// Policy is checked before and after building each target. Any violations
+// fail the build with a PolicyError.
+type Policy struct {
+	// Registries (or repository prefixes, e.g. 'registry.example.com/team')
+	// that FROM images may be pulled from. Images pinned by digest, image
+	// args, local build contexts and other stages are always allowed. When
+	// empty, FROM is not checked.
+	AllowedRegistries []string `json:"allowed_registries,omitempty"`
+
+	// The image must not run as root, i.e. its config's User must be set to
+	// a user other than 'root' or UID 0.
+	NonRootUser bool `json:"non_root_user,omitempty"`
+
+	// Labels that the image config must set.
+	RequiredLabels []string `json:"required_labels,omitempty"`
+
+	// Maximum total size (in MB) of the image's compressed layers.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Maximum number of layers in the image.
+	MaxLayers int `json:"max_layers,omitempty"`
+
+	// The image must not contain files or directories which anyone can
+	// write to, apart from directories with the sticky bit set (e.g. /tmp).
+	NoWorldWritable bool `json:"no_world_writable,omitempty"`
+}
+
+// VulnerabilityScan configures matching the packages in each built image
+// (as listed in the SBOM) against a vulnerability database, without any
+// network access.
+type VulnerabilityScan struct {
+	// Directory of OSV advisories (e.g. an extracted export of osv.dev's
+	// database for each ecosystem), within an input. Every .json file within
+	// it is loaded.
+	Database string `json:"database"`
+
+	// Fail if any vulnerability is at least this severe: "unknown" (i.e.
+	// any vulnerability), "low", "medium", "high" or "critical". When empty,
+	// the scan only reports vulnerabilities.
+	FailOn string `json:"fail_on,omitempty"`
 }
 
 // ImageMetadata is the schema written to manifest.json when producing the
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/concourse/go-archive/tarfs"
 	"github.com/fatih/color"
@@ -21,7 +22,7 @@ import (
 
 const whiteoutPrefix = ".wh."
 
-func unpackImage(dest string, img v1.Image, debug bool) error {
+func unpackImage(dest string, img v1.Image, debug bool, layerUnpacked func(v1.Layer, time.Time) error) error {
 	layers, err := img.Layers()
 	if err != nil {
 		return err
@@ -63,10 +64,17 @@ func unpackImage(dest string, img v1.Image, debug bool) error {
 	for i, layer := range layers {
 		logrus.Debugf("extracting layer %d of %d", i+1, len(layers))
 
+		started := time.Now()
+
 		err = extractLayer(dest, layer, bars[i], chown)
 		if err != nil {
 			return err
 		}
+
+		err = layerUnpacked(layer, started)
+		if err != nil {
+			return err
+		}
 	}
 
 	progress.Wait()
@@ -0,0 +1,347 @@
+package prototype
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ValidationError reports every problem found with an OCIImage.
+type ValidationError struct {
+	Errors []error
+}
+
+func (err ValidationError) Error() string {
+	msg := "invalid configuration:"
+	for _, e := range err.Errors {
+		msg += "\n  - " + e.Error()
+	}
+
+	return msg
+}
+
+// Validate checks the configuration, including that the files it refers to
+// exist, so that mistakes are reported before buildkitd is started.
+//
+// All problems are reported at once as a ValidationError.
+func (img OCIImage) Validate() error {
+	sanitize(&img)
+
+	v := &validator{}
+
+	switch {
+	case img.ContextRef != "":
+		v.dir("context", img.ContextDir)
+
+		if isContextArchive(img.ContextDir) {
+			v.errorf("context_ref", "cannot be used with a tarball context")
+		}
+	case isContextArchive(img.ContextDir):
+		v.file("context", img.ContextDir)
+	default:
+		v.dir("context", img.ContextDir)
+	}
+
+	if isStreamedContext(img) && len(img.ContextInputs) > 0 {
+		v.errorf("context_inputs", "not supported with a tarball or git ref context")
+	}
+
+	for _, input := range sortedKeys(img.ContextInputs) {
+		v.relativePath(fmt.Sprintf("context_inputs[%s]", input), img.ContextInputs[input])
+	}
+
+	if img.DockerfilePath != "" {
+		v.file("dockerfile", img.DockerfilePath)
+	}
+
+	switch img.CacheMode {
+	case "min":
+	case "max":
+		if img.InlineCache {
+			v.errorf("cache_mode", "max is not supported with inline cache")
+		}
+	default:
+		v.errorf("cache_mode", "unknown cache mode: %s", img.CacheMode)
+	}
+
+	if img.CacheMaxSize < 0 {
+		v.errorf("cache_max_size", "must not be negative")
+	}
+
+	for i, ref := range img.CacheFrom {
+		v.reference(fmt.Sprintf("cache_from[%d]", i), ref)
+	}
+
+	if img.CacheTo != "" {
+		v.reference("cache_to", img.CacheTo)
+	}
+
+	for i, target := range img.AdditionalTargets {
+		if target == "" {
+			v.errorf(fmt.Sprintf("additional_targets[%d]", i), "must not be empty")
+		}
+	}
+
+	for i, arg := range img.BuildArgs {
+		v.keyValue(fmt.Sprintf("build_args[%d]", i), arg)
+	}
+
+	for i, arg := range img.Labels {
+		v.keyValue(fmt.Sprintf("labels[%d]", i), arg)
+	}
+
+	if img.GC != nil && img.GC.KeepStorage < 0 {
+		v.errorf("gc.keep_storage", "must not be negative")
+	}
+
+	switch img.Worker {
+	case "", WorkerOCI:
+	case WorkerContainerd:
+		if img.Runtime != "" {
+			v.errorf("runtime", "cannot be configured for the containerd worker")
+		}
+	default:
+		v.errorf("worker", "unknown worker: %s", img.Worker)
+	}
+
+	for _, id := range sortedKeys(img.BuildkitSecrets) {
+		v.file(fmt.Sprintf("buildkit_secrets[%s]", id), img.BuildkitSecrets[id])
+	}
+
+	for _, id := range sortedKeys(img.BuildkitSecretEnvs) {
+		env := img.BuildkitSecretEnvs[id]
+		if _, found := os.LookupEnv(env); !found {
+			v.errorf(fmt.Sprintf("buildkit_secret_envs[%s]", id), "environment variable %s is not set", env)
+		}
+	}
+
+	for _, id := range sortedKeys(img.BuildkitSecretValues) {
+		if _, found := img.BuildkitSecrets[id]; found {
+			v.errorf(fmt.Sprintf("buildkit_secret_values[%s]", id), "secret is also configured in buildkit_secrets")
+		}
+
+		if _, found := img.BuildkitSecretEnvs[id]; found {
+			v.errorf(fmt.Sprintf("buildkit_secret_values[%s]", id), "secret is also configured in buildkit_secret_envs")
+		}
+	}
+
+	for _, id := range sortedSSHKeys(img.SSH) {
+		for i, path := range img.SSH[id] {
+			v.file(fmt.Sprintf("ssh[%s][%d]", id, i), path)
+		}
+	}
+
+	for i, arg := range img.ImageArgs {
+		field := fmt.Sprintf("image_args[%d]", i)
+		if v.keyValue(field, arg) {
+			v.file(field, strings.SplitN(arg, "=", 2)[1])
+		}
+	}
+
+	if img.AddHosts != "" {
+		for _, host := range strings.Split(img.AddHosts, ",") {
+			segs := strings.SplitN(host, "=", 2)
+			if len(segs) != 2 {
+				v.errorf("add_hosts", "expected host=ip: %s", host)
+			} else if net.ParseIP(segs[1]) == nil {
+				v.errorf("add_hosts", "invalid IP for %s: %s", segs[0], segs[1])
+			}
+		}
+	}
+
+	for _, contextName := range sortedKeys(img.BuildContexts) {
+		field := fmt.Sprintf("build_contexts[%s]", contextName)
+		src := img.BuildContexts[contextName]
+
+		switch {
+		case contextName == "context" || contextName == "dockerfile":
+			v.errorf(field, "name is reserved")
+		case strings.HasPrefix(src, dockerImagePrefix):
+			v.reference(field, strings.TrimPrefix(src, dockerImagePrefix))
+		case isImageTarball(src):
+			v.file(field, src)
+		default:
+			v.dir(field, src)
+		}
+	}
+
+	if img.SourceDateEpoch != nil && *img.SourceDateEpoch < 0 {
+		v.errorf("source_date_epoch", "must not be negative")
+	}
+
+	switch img.PlanFormat {
+	case "", PlanFormatText, PlanFormatJSON:
+	default:
+		v.errorf("plan_format", "unknown plan format: %s", img.PlanFormat)
+	}
+
+	switch {
+	case img.EventLog == "", img.EventLog == EventLogStderr:
+	case filepath.Base(img.EventLog) != img.EventLog, img.EventLog == ".", img.EventLog == "..":
+		v.errorf("event_log", "must be stderr or a file name: %s", img.EventLog)
+	case isOutputFile(img.EventLog):
+		v.errorf("event_log", "%s is written to the output by the build", img.EventLog)
+	}
+
+	if img.TraceEndpoint != "" {
+		endpoint, err := url.Parse(img.TraceEndpoint)
+		if err != nil {
+			v.errorf("trace_endpoint", "invalid URL: %s", err)
+		} else if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+			v.errorf("trace_endpoint", "must be an http or https URL: %s", img.TraceEndpoint)
+		}
+	}
+
+	if img.ProvenanceRepository != "" {
+		_, err := name.NewRepository(img.ProvenanceRepository)
+		if err != nil {
+			v.errorf("provenance_repository", "invalid repository: %s", err)
+		}
+	}
+
+	switch {
+	case img.SigningKey != "" && img.SigningKeyEnv != "":
+		v.errorf("signing_key_env", "cannot be configured with signing_key")
+	case img.SigningKey != "":
+		v.file("signing_key", img.SigningKey)
+	case img.SigningKeyEnv != "":
+		if _, found := os.LookupEnv(img.SigningKeyEnv); !found {
+			v.errorf("signing_key_env", "environment variable %s is not set", img.SigningKeyEnv)
+		}
+	case img.SignatureRepository != "":
+		v.errorf("signature_repository", "requires signing_key or signing_key_env")
+	}
+
+	if img.SignatureRepository != "" {
+		_, err := name.NewRepository(img.SignatureRepository)
+		if err != nil {
+			v.errorf("signature_repository", "invalid repository: %s", err)
+		}
+	}
+
+	if img.ImageArgsPublicKey != "" {
+		v.file("image_args_public_key", img.ImageArgsPublicKey)
+	}
+
+	if img.Policy != nil {
+		for i, allowed := range img.Policy.AllowedRegistries {
+			_, err := name.NewRepository(strings.TrimSuffix(allowed, "/") + "/image")
+			if err != nil {
+				v.errorf(fmt.Sprintf("policy.allowed_registries[%d]", i), "invalid registry: %s", allowed)
+			}
+		}
+
+		if img.Policy.MaxSize < 0 {
+			v.errorf("policy.max_size", "must not be negative")
+		}
+
+		if img.Policy.MaxLayers < 0 {
+			v.errorf("policy.max_layers", "must not be negative")
+		}
+	}
+
+	if img.Scan != nil {
+		v.severity("scan.fail_on", img.Scan.FailOn)
+	}
+
+	if len(v.errs) > 0 {
+		return ValidationError{Errors: v.errs}
+	}
+
+	return nil
+}
+
+// ValidateScan checks the configuration for the scan message, which only
+// needs the scan settings and not the build context.
+func (img OCIImage) ValidateScan() error {
+	v := &validator{}
+
+	if img.Scan == nil || img.Scan.Database == "" {
+		v.errorf("scan.database", "must be configured")
+	} else {
+		v.dir("scan.database", img.Scan.Database)
+	}
+
+	if img.Scan != nil {
+		v.severity("scan.fail_on", img.Scan.FailOn)
+	}
+
+	if len(v.errs) > 0 {
+		return ValidationError{Errors: v.errs}
+	}
+
+	return nil
+}
+
+// validator accumulates errors for fields of the configuration.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) errorf(field string, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) file(field string, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		v.errorf(field, "%s does not exist", path)
+	} else if info.IsDir() {
+		v.errorf(field, "%s is a directory", path)
+	}
+}
+
+func (v *validator) dir(field string, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		v.errorf(field, "%s does not exist", path)
+	} else if !info.IsDir() {
+		v.errorf(field, "%s is not a directory", path)
+	}
+}
+
+func (v *validator) relativePath(field string, path string) {
+	if filepath.IsAbs(path) || strings.HasPrefix(filepath.Clean(path), "..") {
+		v.errorf(field, "%s must be a relative path within the context", path)
+	}
+}
+
+func (v *validator) reference(field string, ref string) {
+	_, err := name.ParseReference(ref)
+	if err != nil {
+		v.errorf(field, "invalid reference %s: %s", ref, err)
+	}
+}
+
+func (v *validator) severity(field string, severity string) {
+	if _, found := severityRanks[severity]; severity != "" && !found {
+		v.errorf(field, "must be unknown, low, medium, high or critical: %s", severity)
+	}
+}
+
+func (v *validator) keyValue(field string, arg string) bool {
+	segs := strings.SplitN(arg, "=", 2)
+	if len(segs) != 2 || segs[0] == "" {
+		v.errorf(field, "expected key=value: %s", arg)
+		return false
+	}
+
+	return true
+}
+
+func sortedSSHKeys(m map[string][]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
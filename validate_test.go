@@ -0,0 +1,243 @@
+package prototype_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type ValidateSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *ValidateSuite) TestValid() {
+	err := prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		BuildArgs:  []string{"some_arg=some_value"},
+		ImageArgs:  []string{"some_image=testdata/build-stats/trace.json"},
+		BuildkitSecrets: map[string]string{
+			"secret": "testdata/buildkit-secret/secret",
+		},
+		AddHosts: "some-host=10.0.0.1,other-host=::1",
+	}.Validate()
+	s.NoError(err)
+}
+
+func (s *ValidateSuite) TestDefaultDockerfile() {
+	err := prototype.OCIImage{
+		ContextDir: "testdata",
+	}.Validate()
+	s.EqualError(err, "invalid configuration:\n  - dockerfile: testdata/Dockerfile does not exist")
+}
+
+func (s *ValidateSuite) TestTarballContext() {
+	err := prototype.OCIImage{
+		ContextDir:    "testdata/does-not-exist.tar.gz",
+		ContextInputs: map[string]string{"some-input": "some-input"},
+	}.Validate()
+	s.EqualError(err, "invalid configuration:"+
+		"\n  - context: testdata/does-not-exist.tar.gz does not exist"+
+		"\n  - context_inputs: not supported with a tarball or git ref context",
+	)
+}
+
+func (s *ValidateSuite) TestReportsAllErrors() {
+	err := prototype.OCIImage{
+		ContextDir:     "testdata/basic",
+		DockerfilePath: "testdata/basic",
+		CacheMode:      "max",
+		InlineCache:    true,
+		CacheFrom:      []string{"Not A Ref"},
+		BuildArgs:      []string{"missing_value"},
+		Labels:         []string{"=no-key"},
+		ImageArgs:      []string{"no_path", "some_image=testdata/does-not-exist.tar"},
+		BuildkitSecrets: map[string]string{
+			"secret": "testdata/does-not-exist",
+		},
+		BuildkitSecretEnvs: map[string]string{
+			"env-secret": "SOME_ENV_THAT_IS_NOT_SET",
+		},
+		SSH: map[string][]string{
+			"default": {"testdata/does-not-exist"},
+		},
+		Worker:   prototype.WorkerContainerd,
+		Runtime:  "crun",
+		AddHosts: "some-host,other-host=bogus",
+		BuildContexts: map[string]string{
+			"context": "testdata/basic",
+		},
+	}.Validate()
+	s.Error(err)
+
+	var validationErr prototype.ValidationError
+	s.True(errors.As(err, &validationErr))
+
+	_, refErr := name.ParseReference("Not A Ref")
+	s.Error(refErr)
+
+	var messages []string
+	for _, e := range validationErr.Errors {
+		messages = append(messages, e.Error())
+	}
+
+	s.Equal([]string{
+		"dockerfile: testdata/basic is a directory",
+		"cache_mode: max is not supported with inline cache",
+		"cache_from[0]: invalid reference Not A Ref: " + refErr.Error(),
+		"build_args[0]: expected key=value: missing_value",
+		"labels[0]: expected key=value: =no-key",
+		"runtime: cannot be configured for the containerd worker",
+		"buildkit_secrets[secret]: testdata/does-not-exist does not exist",
+		"buildkit_secret_envs[env-secret]: environment variable SOME_ENV_THAT_IS_NOT_SET is not set",
+		"ssh[default][0]: testdata/does-not-exist does not exist",
+		"image_args[0]: expected key=value: no_path",
+		"image_args[1]: testdata/does-not-exist.tar does not exist",
+		"add_hosts: expected host=ip: some-host",
+		"add_hosts: invalid IP for other-host: bogus",
+		"build_contexts[context]: name is reserved",
+	}, messages)
+}
+
+func (s *ValidateSuite) TestEventLog() {
+	for _, dest := range []string{"stderr", "events.json"} {
+		err := prototype.OCIImage{
+			ContextDir: "testdata/basic",
+			EventLog:   dest,
+		}.Validate()
+		s.NoError(err, dest)
+	}
+
+	err := prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		EventLog:   "../events.json",
+	}.Validate()
+	s.EqualError(err, "invalid configuration:\n  - event_log: must be stderr or a file name: ../events.json")
+
+	err = prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		EventLog:   "digest",
+	}.Validate()
+	s.EqualError(err, "invalid configuration:\n  - event_log: digest is written to the output by the build")
+}
+
+func (s *ValidateSuite) TestTraceEndpoint() {
+	err := prototype.OCIImage{
+		ContextDir:    "testdata/basic",
+		TraceEndpoint: "http://collector:4318",
+	}.Validate()
+	s.NoError(err)
+
+	err = prototype.OCIImage{
+		ContextDir:    "testdata/basic",
+		TraceEndpoint: "collector:4318",
+	}.Validate()
+	s.EqualError(err, "invalid configuration:\n  - trace_endpoint: must be an http or https URL: collector:4318")
+}
+
+func (s *ValidateSuite) TestProvenanceRepository() {
+	err := prototype.OCIImage{
+		ContextDir:           "testdata/basic",
+		ProvenanceRepository: "registry.example.com/some-image",
+	}.Validate()
+	s.NoError(err)
+
+	err = prototype.OCIImage{
+		ContextDir:           "testdata/basic",
+		ProvenanceRepository: "Some Image",
+	}.Validate()
+	s.Error(err)
+	s.Contains(err.Error(), "provenance_repository: invalid repository:")
+}
+
+func (s *ValidateSuite) TestSigning() {
+	err := prototype.OCIImage{
+		ContextDir:          "testdata/basic",
+		SigningKey:          "testdata/basic/Dockerfile",
+		SignatureRepository: "registry.example.com/some-image",
+		ImageArgsPublicKey:  "testdata/basic/Dockerfile",
+	}.Validate()
+	s.NoError(err)
+
+	err = prototype.OCIImage{
+		ContextDir:         "testdata/basic",
+		SigningKey:         "testdata/basic/Dockerfile",
+		SigningKeyEnv:      "SOME_KEY",
+		ImageArgsPublicKey: "does-not-exist",
+	}.Validate()
+	s.EqualError(err, "invalid configuration:\n"+
+		"  - signing_key_env: cannot be configured with signing_key\n"+
+		"  - image_args_public_key: does-not-exist does not exist")
+
+	err = prototype.OCIImage{
+		ContextDir:          "testdata/basic",
+		SignatureRepository: "registry.example.com/some-image",
+	}.Validate()
+	s.EqualError(err, "invalid configuration:\n  - signature_repository: requires signing_key or signing_key_env")
+}
+
+func (s *ValidateSuite) TestPolicy() {
+	err := prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		Policy: &prototype.Policy{
+			AllowedRegistries: []string{"docker.io", "registry.example.com:5000/team"},
+			MaxSize:           100,
+		},
+	}.Validate()
+	s.NoError(err)
+
+	err = prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		Policy: &prototype.Policy{
+			AllowedRegistries: []string{"Not A Registry"},
+			MaxSize:           -1,
+			MaxLayers:         -1,
+		},
+	}.Validate()
+	s.EqualError(err, "invalid configuration:\n"+
+		"  - policy.allowed_registries[0]: invalid registry: Not A Registry\n"+
+		"  - policy.max_size: must not be negative\n"+
+		"  - policy.max_layers: must not be negative")
+}
+
+func (s *ValidateSuite) TestScan() {
+	err := prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		Scan:       &prototype.VulnerabilityScan{Database: "does-not-exist", FailOn: "high"},
+	}.Validate()
+	s.NoError(err)
+
+	err = prototype.OCIImage{
+		ContextDir: "testdata/basic",
+		Scan:       &prototype.VulnerabilityScan{FailOn: "severe"},
+	}.Validate()
+	s.EqualError(err, "invalid configuration:\n  - scan.fail_on: must be unknown, low, medium, high or critical: severe")
+
+	// the scan doesn't need the build context
+	err = prototype.OCIImage{
+		ContextDir: "does-not-exist",
+		Scan:       &prototype.VulnerabilityScan{Database: "testdata", FailOn: "critical"},
+	}.ValidateScan()
+	s.NoError(err)
+
+	err = prototype.OCIImage{}.ValidateScan()
+	s.EqualError(err, "invalid configuration:\n  - scan.database: must be configured")
+
+	err = prototype.OCIImage{
+		Scan: &prototype.VulnerabilityScan{Database: "testdata/basic/Dockerfile", FailOn: "severe"},
+	}.ValidateScan()
+	s.EqualError(err, "invalid configuration:\n"+
+		"  - scan.database: testdata/basic/Dockerfile is not a directory\n"+
+		"  - scan.fail_on: must be unknown, low, medium, high or critical: severe")
+}
+
+func TestValidate(t *testing.T) {
+	suite.Run(t, &ValidateSuite{
+		Assertions: require.New(t),
+	})
+}
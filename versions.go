@@ -0,0 +1,296 @@
+package prototype
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CompareVersions compares two versions of a package of the given type,
+// returning -1, 0 or 1. deb versions are compared as dpkg does, apk versions
+// as apk does, and anything else as semver (with an optional 'v' prefix).
+func CompareVersions(packageType string, a, b string) int {
+	switch packageType {
+	case PackageTypeDeb:
+		return compareDpkgVersions(a, b)
+	case PackageTypeApk:
+		return compareApkVersions(a, b)
+	default:
+		return compareSemver(a, b)
+	}
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareDpkgVersions compares '[epoch:]upstream[-revision]' versions, as
+// described in deb-version(7).
+func compareDpkgVersions(a, b string) int {
+	aEpoch, aUpstream, aRevision := splitDpkgVersion(a)
+	bEpoch, bUpstream, bRevision := splitDpkgVersion(b)
+
+	if c := compareInts(aEpoch, bEpoch); c != 0 {
+		return c
+	}
+
+	if c := compareDpkgPart(aUpstream, bUpstream); c != 0 {
+		return c
+	}
+
+	return compareDpkgPart(aRevision, bRevision)
+}
+
+func splitDpkgVersion(version string) (int, string, string) {
+	epoch := 0
+	if i := strings.Index(version, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(version[:i])
+		version = version[i+1:]
+	}
+
+	revision := ""
+	if i := strings.LastIndex(version, "-"); i >= 0 {
+		revision = version[i+1:]
+		version = version[:i]
+	}
+
+	return epoch, version, revision
+}
+
+// compareDpkgPart alternately compares non-digit runs, where '~' sorts before
+// anything (even the end) and letters sort before other characters, and
+// digit runs numerically.
+func compareDpkgPart(a, b string) int {
+	for a != "" || b != "" {
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			ac, bc := dpkgOrder(a), dpkgOrder(b)
+			if ac != bc {
+				return compareInts(ac, bc)
+			}
+
+			a, b = a[1:], b[1:]
+		}
+
+		var aNum, bNum int
+		aNum, a = leadingNumber(a)
+		bNum, b = leadingNumber(b)
+
+		if c := compareInts(aNum, bNum); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+func dpkgOrder(s string) int {
+	switch {
+	case s == "" || isDigit(s[0]):
+		return 0
+	case s[0] == '~':
+		return -1
+	case isLetter(s[0]):
+		return int(s[0])
+	default:
+		return int(s[0]) + 256
+	}
+}
+
+// apkSuffixes are the order of apk's version suffixes relative to having no
+// suffix, which sorts between _rc and _cvs.
+var apkSuffixes = map[string]int{
+	"alpha": -4,
+	"beta":  -3,
+	"pre":   -2,
+	"rc":    -1,
+	"cvs":   1,
+	"svn":   2,
+	"git":   3,
+	"hg":    4,
+	"p":     5,
+}
+
+// compareApkVersions compares 'digits[.digits...][letter][_suffix[N]...][-rN]'
+// versions, as apk does.
+func compareApkVersions(a, b string) int {
+	aVersion, aRevision := splitApkRevision(a)
+	bVersion, bRevision := splitApkRevision(b)
+
+	aParts := strings.Split(aVersion, "_")
+	bParts := strings.Split(bVersion, "_")
+
+	if c := compareApkNumbers(aParts[0], bParts[0]); c != 0 {
+		return c
+	}
+
+	for i := 1; i < len(aParts) || i < len(bParts); i++ {
+		aSuffix, aNum := apkSuffix(aParts, i)
+		bSuffix, bNum := apkSuffix(bParts, i)
+
+		if c := compareInts(aSuffix, bSuffix); c != 0 {
+			return c
+		}
+
+		if c := compareInts(aNum, bNum); c != 0 {
+			return c
+		}
+	}
+
+	return compareInts(aRevision, bRevision)
+}
+
+func splitApkRevision(version string) (string, int) {
+	i := strings.LastIndex(version, "-r")
+	if i < 0 {
+		return version, 0
+	}
+
+	revision, err := strconv.Atoi(version[i+2:])
+	if err != nil {
+		return version, 0
+	}
+
+	return version[:i], revision
+}
+
+// compareApkNumbers compares dotted numbers, with an optional trailing
+// letter, e.g. '1.2.3a'.
+func compareApkNumbers(a, b string) int {
+	aFields := strings.Split(a, ".")
+	bFields := strings.Split(b, ".")
+
+	for i := 0; i < len(aFields) || i < len(bFields); i++ {
+		var aField, bField string
+		if i < len(aFields) {
+			aField = aFields[i]
+		}
+
+		if i < len(bFields) {
+			bField = bFields[i]
+		}
+
+		aNum, aLetter := leadingNumber(aField)
+		bNum, bLetter := leadingNumber(bField)
+
+		if c := compareInts(aNum, bNum); c != 0 {
+			return c
+		}
+
+		if c := strings.Compare(aLetter, bLetter); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+func apkSuffix(parts []string, i int) (int, int) {
+	if i >= len(parts) {
+		return 0, 0
+	}
+
+	name := strings.TrimRight(parts[i], "0123456789")
+	num, _ := strconv.Atoi(parts[i][len(name):])
+
+	return apkSuffixes[name], num
+}
+
+// compareSemver compares 'major.minor.patch[-prerelease][+build]' versions,
+// treating missing components as 0.
+func compareSemver(a, b string) int {
+	aCore, aPre := splitSemver(a)
+	bCore, bPre := splitSemver(b)
+
+	aFields := strings.Split(aCore, ".")
+	bFields := strings.Split(bCore, ".")
+
+	for i := 0; i < len(aFields) || i < len(bFields); i++ {
+		var aNum, bNum int
+		if i < len(aFields) {
+			aNum, _ = leadingNumber(aFields[i])
+		}
+
+		if i < len(bFields) {
+			bNum, _ = leadingNumber(bFields[i])
+		}
+
+		if c := compareInts(aNum, bNum); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+
+	aIDs := strings.Split(aPre, ".")
+	bIDs := strings.Split(bPre, ".")
+
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		aNum, aErr := strconv.Atoi(aIDs[i])
+		bNum, bErr := strconv.Atoi(bIDs[i])
+
+		var c int
+		switch {
+		case aErr == nil && bErr == nil:
+			c = compareInts(aNum, bNum)
+		case aErr == nil:
+			c = -1
+		case bErr == nil:
+			c = 1
+		default:
+			c = strings.Compare(aIDs[i], bIDs[i])
+		}
+
+		if c != 0 {
+			return c
+		}
+	}
+
+	return compareInts(len(aIDs), len(bIDs))
+}
+
+func splitSemver(version string) (string, string) {
+	version = strings.TrimPrefix(version, "v")
+
+	if i := strings.Index(version, "+"); i >= 0 {
+		version = version[:i]
+	}
+
+	if i := strings.Index(version, "-"); i >= 0 {
+		return version[:i], version[i+1:]
+	}
+
+	return version, ""
+}
+
+// leadingNumber splits the leading digits from s.
+func leadingNumber(s string) (int, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+
+	num, _ := strconv.Atoi(s[:i])
+
+	return num, s[i:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,84 @@
+package prototype_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	prototype "github.com/aoldershaw/oci-image-prototype"
+)
+
+type VersionsSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+type versionCase struct {
+	a, b string
+	want int
+}
+
+func (s *VersionsSuite) TestCompareDpkgVersions() {
+	s.compare(prototype.PackageTypeDeb, []versionCase{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1:1.0", "2.0", 1},
+		{"0:1.0", "1.0", 0},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0a", "1.0", 1},
+		{"1.0a", "1.0+", -1},
+		{"2.31-13+deb11u5", "2.31-13+deb11u6", -1},
+		{"2.31-13+deb11u5", "2.31-13", 1},
+		{"11.1+deb11u5", "11.1+deb11u10", -1},
+	})
+}
+
+func (s *VersionsSuite) TestCompareApkVersions() {
+	s.compare(prototype.PackageTypeApk, []versionCase{
+		{"1.2.2-r7", "1.2.2-r7", 0},
+		{"1.2.2-r7", "1.2.2-r10", -1},
+		{"1.2.2", "1.2.2-r0", 0},
+		{"1.2.10", "1.2.9", 1},
+		{"1.2.3a", "1.2.3", 1},
+		{"1.2.3a", "1.2.3b", -1},
+		{"1.0_rc1", "1.0", -1},
+		{"1.0_alpha2", "1.0_beta1", -1},
+		{"1.0_p1", "1.0", 1},
+		{"1.0_rc2", "1.0_rc10", -1},
+		{"1.34.1-r5", "1.35.0-r0", -1},
+	})
+}
+
+func (s *VersionsSuite) TestCompareSemver() {
+	s.compare(prototype.PackageTypeGolang, []versionCase{
+		{"v1.2.3", "1.2.3", 0},
+		{"v1.2.3", "v1.2.10", -1},
+		{"v1.2", "v1.2.0", 0},
+		{"v2.0.0", "v1.99.99", 1},
+		{"v1.0.0-rc.1", "v1.0.0", -1},
+		{"v1.0.0-alpha", "v1.0.0-alpha.1", -1},
+		{"v1.0.0-alpha.1", "v1.0.0-alpha.beta", -1},
+		{"v1.0.0-beta.2", "v1.0.0-beta.11", -1},
+		{"v1.0.0+build.1", "v1.0.0", 0},
+		{"v0.0.0-20210422173821-87baa3ea93eb", "v0.0.0", -1},
+	})
+}
+
+func (s *VersionsSuite) compare(packageType string, cases []versionCase) {
+	for _, c := range cases {
+		s.Equal(c.want, prototype.CompareVersions(packageType, c.a, c.b), "%s vs %s", c.a, c.b)
+		s.Equal(-c.want, prototype.CompareVersions(packageType, c.b, c.a), "%s vs %s", c.b, c.a)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	suite.Run(t, &VersionsSuite{
+		Assertions: require.New(t),
+	})
+}